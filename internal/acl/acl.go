@@ -0,0 +1,276 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/die-net/conduit/internal/hostmatch"
+	"github.com/die-net/conduit/internal/session"
+)
+
+// ErrDenied is returned (wrapped) by Check for connections an ACL denies.
+var ErrDenied = errors.New("denied by ACL")
+
+// Action is what a rule does with the connections it matches.
+type Action uint8
+
+const (
+	// Allow lets a connection through.
+	Allow Action = iota
+	// Deny refuses it.
+	Deny
+)
+
+// ParseAction parses "allow" or "deny".
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	default:
+		return Allow, fmt.Errorf("unknown action %q (expected allow or deny)", s)
+	}
+}
+
+// String returns "allow" or "deny".
+func (a Action) String() string {
+	if a == Deny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Lo, Hi uint16
+}
+
+// ParsePortRange parses a port, such as "443", or a range, such as
+// "8000-8999".
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		hi = lo
+	}
+	l, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || h < l {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{Lo: uint16(l), Hi: uint16(h)}, nil //nolint:gosec // ParseUint checked the size.
+}
+
+// Contains reports whether port is within r.
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Lo && port <= r.Hi
+}
+
+// Rule matches connections by all of its non-empty fields; a rule with no
+// fields set matches everything.
+type Rule struct {
+	Action Action
+
+	// Sources are the client address prefixes to match.
+	Sources []netip.Prefix
+	// Users are the authenticated usernames to match.
+	Users []string
+	// Hosts are patterns for the destination host as requested.  IP
+	// patterns only match destinations given as IP literals.
+	Hosts hostmatch.List
+	// IPs are prefixes for the destination's addresses: the IP literal, or
+	// what the hostname resolves to.  A deny rule matches if any address
+	// is within them, but an allow rule only if all of them are.  If the
+	// hostname can't be resolved, deny rules match and allow rules don't.
+	IPs []netip.Prefix
+	// Ports are the destination ports to match.
+	Ports []PortRange
+}
+
+// Resolver looks up the addresses of a hostname, like net.Resolver.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// ACL is a list of rules.  A nil *ACL allows everything.
+type ACL struct {
+	Rules []Rule
+	// Default is the action when no rule matches.
+	Default Action
+	// Resolver resolves destination hostnames for rules that match IPs.  It
+	// defaults to net.DefaultResolver.
+	Resolver Resolver
+}
+
+// Request describes a connection to be checked.
+type Request struct {
+	// Client is the client's address, if known.
+	Client netip.Addr
+	// User is the authenticated username, if any.
+	User string
+	// Target is the destination host:port.
+	Target string
+}
+
+// NewRequest returns a Request for sess's client and user to connect to
+// target.
+func NewRequest(sess *session.Session, target string) Request {
+	req := Request{Target: target}
+	if sess == nil {
+		return req
+	}
+	req.User = sess.User()
+	if ap, err := netip.ParseAddrPort(sess.Client); err == nil {
+		req.Client = ap.Addr()
+	}
+	return req
+}
+
+// Check returns nil if a allows req, or an error wrapping ErrDenied that
+// says which rule denied it.
+//
+// IP rules are matched against what the target's hostname resolves to now,
+// which may not be where the connection is made, so dials should also be
+// made with NewContext's context to check the address connected to.
+func (a *ACL) Check(ctx context.Context, req Request) error {
+	if a == nil {
+		return nil
+	}
+	return a.check(req, func(host string) ([]netip.Addr, error) {
+		return a.resolve(ctx, host)
+	})
+}
+
+type contextKey struct{}
+
+// guard is an ACL and the request it allowed.
+type guard struct {
+	a   *ACL
+	req Request
+}
+
+// NewContext returns ctx carrying a and req, which a has allowed, for
+// CheckConnect to check the connections made for req.
+func NewContext(ctx context.Context, a *ACL, req Request) context.Context {
+	if a == nil || !slices.ContainsFunc(a.Rules, func(r Rule) bool { return len(r.IPs) > 0 }) {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, guard{a: a, req: req})
+}
+
+// CheckConnect checks a connection about to be made to addr against the ACL
+// and request in ctx, if any, as Check would if the target resolved to just
+// addr.  Direct dialers call it with the address of each connection, so
+// that a hostname that resolves differently when it's checked and when
+// it's connected to, such as by DNS rebinding, can't get around IP rules.
+func CheckConnect(ctx context.Context, addr netip.Addr) error {
+	g, ok := ctx.Value(contextKey{}).(guard)
+	if !ok {
+		return nil
+	}
+	addrs := []netip.Addr{addr.Unmap().WithZone("")}
+	return g.a.check(g.req, func(string) ([]netip.Addr, error) { return addrs, nil })
+}
+
+// check applies a to req, using resolve to look up the target host's
+// addresses if an IP rule needs them.
+func (a *ACL) check(req Request, resolve func(host string) ([]netip.Addr, error)) error {
+	host, portStr, err := net.SplitHostPort(req.Target)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDenied, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("%w: invalid port %q", ErrDenied, portStr)
+	}
+	dport := uint16(port) //nolint:gosec // ParseUint checked the size.
+	client := req.Client.Unmap()
+
+	var (
+		addrs      []netip.Addr
+		resolveErr error
+		resolved   bool
+	)
+	resolveOnce := func() ([]netip.Addr, error) {
+		if !resolved {
+			resolved = true
+			addrs, resolveErr = resolve(host)
+		}
+		return addrs, resolveErr
+	}
+
+	for i, r := range a.Rules {
+		if len(r.Sources) > 0 && !containsAny(r.Sources, client) {
+			continue
+		}
+		if len(r.Users) > 0 && !slices.Contains(r.Users, req.User) {
+			continue
+		}
+		if len(r.Hosts) > 0 && !r.Hosts.Match(host) {
+			continue
+		}
+		if len(r.Ports) > 0 && !slices.ContainsFunc(r.Ports, func(pr PortRange) bool { return pr.Contains(dport) }) {
+			continue
+		}
+		if len(r.IPs) > 0 && !r.matchIPs(resolveOnce) {
+			continue
+		}
+		if r.Action == Deny {
+			return fmt.Errorf("%w (rule %d)", ErrDenied, i+1)
+		}
+		return nil
+	}
+
+	if a.Default == Deny {
+		return fmt.Errorf("%w (default)", ErrDenied)
+	}
+	return nil
+}
+
+func (r *Rule) matchIPs(resolve func() ([]netip.Addr, error)) bool {
+	addrs, err := resolve()
+	if err != nil || len(addrs) == 0 {
+		return r.Action == Deny
+	}
+	in := func(addr netip.Addr) bool { return containsAny(r.IPs, addr) }
+	if r.Action == Deny {
+		return slices.ContainsFunc(addrs, in)
+	}
+	for _, addr := range addrs {
+		if !in(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *ACL) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap().WithZone("")}, nil
+	}
+	var res Resolver = net.DefaultResolver
+	if a.Resolver != nil {
+		res = a.Resolver
+	}
+	addrs, err := res.LookupNetIP(ctx, "ip", host)
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap().WithZone("")
+	}
+	return addrs, err
+}
+
+func containsAny(prefixes []netip.Prefix, addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
@@ -0,0 +1,142 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/die-net/conduit/internal/hostmatch"
+)
+
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func mustPrefixes(t *testing.T, ss ...string) []netip.Prefix {
+	t.Helper()
+	var ps []netip.Prefix
+	for _, s := range ss {
+		ps = append(ps, netip.MustParsePrefix(s))
+	}
+	return ps
+}
+
+func TestCheck(t *testing.T) {
+	hosts, err := hostmatch.ParseList([]string{"*.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &ACL{
+		Rules: []Rule{
+			{Action: Deny, IPs: mustPrefixes(t, "127.0.0.0/8", "169.254.0.0/16", "::1/128")},
+			{Action: Allow, Users: []string{"admin"}},
+			{Action: Allow, Sources: mustPrefixes(t, "10.0.0.0/8"), Hosts: hosts, Ports: []PortRange{{Lo: 443, Hi: 443}, {Lo: 8000, Hi: 8999}}},
+			{Action: Allow, IPs: mustPrefixes(t, "192.0.2.0/24")},
+		},
+		Default: Deny,
+		Resolver: staticResolver{
+			"www.example.com":    {netip.MustParseAddr("93.184.216.34")},
+			"rebind.example.com": {netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("127.0.0.1")},
+			"docs.test":          {netip.MustParseAddr("192.0.2.10")},
+			"mixed.test":         {netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("198.51.100.1")},
+		},
+	}
+
+	internal := netip.MustParseAddr("10.1.2.3")
+	outside := netip.MustParseAddr("203.0.113.5")
+	tests := []struct {
+		name string
+		req  Request
+		deny bool
+	}{
+		{name: "loopback literal", req: Request{Client: internal, User: "admin", Target: "127.0.0.1:22"}, deny: true},
+		{name: "mapped loopback", req: Request{Client: internal, User: "admin", Target: "[::ffff:127.0.0.1]:22"}, deny: true},
+		{name: "metadata", req: Request{Client: internal, Target: "169.254.169.254:80"}, deny: true},
+		{name: "resolves to loopback", req: Request{Client: internal, Target: "rebind.example.com:443"}, deny: true},
+		{name: "unresolvable", req: Request{Client: internal, User: "admin", Target: "nxdomain.example.com:443"}, deny: true},
+		{name: "admin", req: Request{Client: outside, User: "admin", Target: "www.example.com:22"}},
+		{name: "internal https", req: Request{Client: internal, Target: "www.example.com:443"}},
+		{name: "internal port range", req: Request{Client: internal, Target: "www.example.com:8080"}},
+		{name: "internal wrong port", req: Request{Client: internal, Target: "www.example.com:22"}, deny: true},
+		{name: "outside", req: Request{Client: outside, Target: "www.example.com:443"}, deny: true},
+		{name: "allowed ips", req: Request{Client: outside, Target: "docs.test:80"}},
+		{name: "partly allowed ips", req: Request{Client: outside, Target: "mixed.test:80"}, deny: true},
+		{name: "bad target", req: Request{Client: internal, Target: "www.example.com"}, deny: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.Check(context.Background(), tt.req)
+			if denied := errors.Is(err, ErrDenied); denied != tt.deny {
+				t.Fatalf("Check=%v, want denied=%v", err, tt.deny)
+			}
+		})
+	}
+
+	var nilACL *ACL
+	if err := nilACL.Check(context.Background(), Request{Target: "127.0.0.1:22"}); err != nil {
+		t.Fatalf("nil ACL: %v", err)
+	}
+}
+
+func TestCheckConnect(t *testing.T) {
+	a := &ACL{
+		Rules: []Rule{
+			{Action: Deny, IPs: mustPrefixes(t, "127.0.0.0/8", "::1/128")},
+		},
+		Default: Allow,
+		Resolver: staticResolver{
+			"rebind.example.com": {netip.MustParseAddr("93.184.216.34")},
+		},
+	}
+	req := Request{Client: netip.MustParseAddr("10.1.2.3"), Target: "rebind.example.com:80"}
+	if err := a.Check(context.Background(), req); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	// The name has since resolved to loopback.
+	ctx := NewContext(context.Background(), a, req)
+	for _, addr := range []string{"127.0.0.1", "::ffff:127.0.0.1", "::1"} {
+		if err := CheckConnect(ctx, netip.MustParseAddr(addr)); !errors.Is(err, ErrDenied) {
+			t.Errorf("CheckConnect(%s)=%v, want ErrDenied", addr, err)
+		}
+	}
+	if err := CheckConnect(ctx, netip.MustParseAddr("93.184.216.34")); err != nil {
+		t.Errorf("CheckConnect(public)=%v", err)
+	}
+
+	// Without IP rules or an ACL, there's nothing to check.
+	if err := CheckConnect(context.Background(), netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Errorf("CheckConnect without ACL=%v", err)
+	}
+	noIPs := &ACL{Rules: []Rule{{Action: Allow, Users: []string{"admin"}}}, Default: Deny}
+	if ctx := NewContext(context.Background(), noIPs, req); ctx != context.Background() {
+		t.Error("NewContext added an ACL without IP rules")
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PortRange
+		err  bool
+	}{
+		{in: "443", want: PortRange{Lo: 443, Hi: 443}},
+		{in: "8000-8999", want: PortRange{Lo: 8000, Hi: 8999}},
+		{in: "9000-8000", err: true},
+		{in: "70000", err: true},
+		{in: "http", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParsePortRange(%q)=%v, %v", tt.in, got, err)
+		}
+	}
+}
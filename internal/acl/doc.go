@@ -0,0 +1,7 @@
+// Package acl decides which connections conduit's listeners may make, by
+// the client's address and username and the destination's host, resolved
+// addresses and port.
+//
+// An ACL is a list of allow and deny rules checked in order; the first rule
+// that matches decides.
+package acl
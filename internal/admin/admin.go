@@ -0,0 +1,148 @@
+package admin
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/session"
+	"github.com/die-net/conduit/internal/ssh"
+)
+
+// Connection is an active connection (or, for non-CONNECT HTTP proxying,
+// request), as listed by GET /connections.
+type Connection struct {
+	ID        uint64    `json:"id"`
+	Listener  string    `json:"listener"`
+	Protocol  string    `json:"protocol"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	Start     time.Time `json:"start"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// Upstream is the state of an upstream, as listed by GET /upstreams.
+type Upstream struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Health is "ok" if the most recent failed dial (if any) was followed
+	// by a successful one, "failing" if not, or "unknown" if there have
+	// been no dials yet.
+	Health      string     `json:"health"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	SSH         *SSH       `json:"ssh,omitempty"`
+}
+
+// SSH is the state of an ssh:// upstream's transport.
+type SSH struct {
+	Connected  bool       `json:"connected"`
+	Since      *time.Time `json:"since,omitempty"`
+	Reconnects int        `json:"reconnects"`
+	Channels   int64      `json:"channels"`
+}
+
+// NewUpstream describes the upstream with the given name and URL, which
+// dials with d.
+func NewUpstream(name, rawURL string, d dialer.ContextDialer) Upstream {
+	up := Upstream{Name: name, URL: rawURL, Health: "unknown"}
+	if u, err := url.Parse(rawURL); err == nil {
+		up.URL = u.Redacted()
+	}
+
+	if i, ok := d.(*dialer.Instrumented); ok {
+		st := i.Status()
+		up.LastSuccess = timePtr(st.LastSuccess)
+		up.LastFailure = timePtr(st.LastFailure)
+		up.Error = st.Error
+		switch {
+		case !st.LastFailure.IsZero() && !st.LastFailure.Before(st.LastSuccess):
+			up.Health = "failing"
+		case !st.LastSuccess.IsZero():
+			up.Health = "ok"
+		}
+	}
+
+	if c, ok := dialer.Unwrap(d).(*ssh.Client); ok {
+		st := c.Status()
+		up.SSH = &SSH{
+			Connected:  st.Connected,
+			Since:      timePtr(st.Since),
+			Reconnects: st.Reconnects,
+			Channels:   st.Channels,
+		}
+	}
+	return up
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Register adds the API's handlers to mux:
+//
+//   - GET /connections lists the sessions in registry.
+//   - DELETE /connections/{id} closes one of them.
+//   - GET /upstreams lists the result of upstreams.
+func Register(mux *http.ServeMux, registry *session.Registry, upstreams func() []Upstream) {
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, _ *http.Request) {
+		sessions := registry.List()
+		list := make([]Connection, 0, len(sessions))
+		for _, s := range sessions {
+			up, down := s.Bytes()
+			list = append(list, Connection{
+				ID:        s.ID,
+				Listener:  s.Listener,
+				Protocol:  s.Protocol,
+				Client:    s.Client,
+				User:      s.User(),
+				Target:    s.Target(),
+				Upstream:  s.Upstream(),
+				Start:     s.Start,
+				BytesUp:   up,
+				BytesDown: down,
+			})
+		}
+		writeJSON(w, list)
+	})
+
+	mux.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		if !registry.Close(id) {
+			http.Error(w, "no such connection", http.StatusNotFound)
+			return
+		}
+		slog.Info("connection closed via admin API", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /upstreams", func(w http.ResponseWriter, _ *http.Request) {
+		list := upstreams()
+		if list == nil {
+			list = []Upstream{}
+		}
+		writeJSON(w, list)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
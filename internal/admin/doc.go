@@ -0,0 +1,4 @@
+// Package admin serves conduit's administrative HTTP API on the debug
+// listener: listing and closing active connections, and reporting the state
+// of each upstream.
+package admin
@@ -0,0 +1,570 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+
+	"github.com/die-net/conduit/internal/acl"
+	"github.com/die-net/conduit/internal/hostmatch"
+	"github.com/die-net/conduit/internal/hosts"
+	"github.com/die-net/conduit/internal/tlsconfig"
+)
+
+// Listener types.
+const (
+	TypeHTTP   = "http"
+	TypeSOCKS5 = "socks5"
+	TypeTProxy = "tproxy"
+)
+
+// Transparent proxy listener modes.
+const (
+	// ModeTProxy accepts connections redirected by TPROXY rules.
+	ModeTProxy = "tproxy"
+	// ModeRedirect accepts connections redirected by NAT rules, such as
+	// iptables REDIRECT or DNAT.
+	ModeRedirect = "redirect"
+)
+
+// Built-in upstream names.
+const (
+	// DirectUpstream dials destinations directly. It's always defined,
+	// unless the configuration overrides it.
+	DirectUpstream = "direct"
+	// DefaultUpstream is used by listeners that name neither an upstream
+	// nor a route, if it is defined.  Otherwise they use DirectUpstream.
+	DefaultUpstream = "default"
+)
+
+// Settings are global settings, which correspond to command-line flags.
+type Settings struct {
+	DialTimeout        time.Duration `yaml:"dial_timeout"`
+	NegotiationTimeout time.Duration `yaml:"negotiation_timeout"`
+	ShutdownGrace      time.Duration `yaml:"shutdown_grace"`
+	HTTPIdleTimeout    time.Duration `yaml:"http_idle_timeout"`
+	HTTPMaxIdleConns   int           `yaml:"http_max_idle_conns"`
+	TunnelIdleTimeout  time.Duration `yaml:"tunnel_idle_timeout"`
+	UDPIdleTimeout     time.Duration `yaml:"udp_idle_timeout"`
+	TCPKeepAlive       string        `yaml:"tcp_keepalive"`
+	PublicOnly         bool          `yaml:"public_only"`
+	PublicExceptions   []string      `yaml:"public_exceptions"`
+	OutboundMark       uint32        `yaml:"outbound_mark"`
+	DNS                string        `yaml:"dns"`
+	DNSUpstream        string        `yaml:"dns_upstream"`
+	DNSCache           bool          `yaml:"dns_cache"`
+	DNSCacheMinTTL     time.Duration `yaml:"dns_cache_min_ttl"`
+	DNSCacheMaxTTL     time.Duration `yaml:"dns_cache_max_ttl"`
+	DNSCacheStale      time.Duration `yaml:"dns_cache_stale"`
+	DNSListen          string        `yaml:"dns_listen"`
+	FakeIP             bool          `yaml:"fake_ip"`
+	FakeIPRanges       []string      `yaml:"fake_ip_ranges"`
+	FakeIPExclude      []string      `yaml:"fake_ip_exclude"`
+	HostsFile          string        `yaml:"hosts_file"`
+	SSHKey             string        `yaml:"ssh_key"`
+	SSHKnownHosts      string        `yaml:"ssh_known_hosts"`
+	DebugListen        string        `yaml:"debug_listen"`
+	Verbose            bool          `yaml:"verbose"`
+	LogFormat          string        `yaml:"log_format"`
+	LogFile            string        `yaml:"log_file"`
+	AccessLog          bool          `yaml:"access_log"`
+}
+
+// Config is a complete conduit configuration.
+type Config struct {
+	Settings `yaml:",inline"`
+
+	Upstreams map[string]*Upstream `yaml:"upstreams"`
+	Routes    map[string]*Route    `yaml:"routes"`
+	ACLs      map[string]*ACL      `yaml:"acls"`
+	Hosts     map[string]*Hosts    `yaml:"hosts"`
+	Listeners map[string]*Listener `yaml:"listeners"`
+
+	file string
+	root *yaml.Node
+}
+
+// Upstream is a named outbound dialer.
+//
+// In YAML, an upstream may also be given as just its URL.
+type Upstream struct {
+	// URL is an upstream URL as accepted by dialer.New.
+	URL   string      `yaml:"url"`
+	TLS   UpstreamTLS `yaml:"tls"`
+	HTTP2 bool        `yaml:"http2"`
+	// SSHKey and SSHKnownHosts override the global settings if set.
+	SSHKey        *string `yaml:"ssh_key"`
+	SSHKnownHosts *string `yaml:"ssh_known_hosts"`
+}
+
+// UnmarshalYAML accepts either a mapping or a URL string.
+func (u *Upstream) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		u.URL = value.Value
+		return nil
+	}
+	type plain Upstream
+	return value.Decode((*plain)(u))
+}
+
+// UpstreamTLS configures TLS to an https:// or socks5+tls:// upstream.
+type UpstreamTLS struct {
+	Cert       string   `yaml:"cert"`
+	Key        string   `yaml:"key"`
+	CA         string   `yaml:"ca"`
+	Pins       []string `yaml:"pins"`
+	ServerName string   `yaml:"server_name"`
+}
+
+// Options returns t as tlsconfig.Options.
+func (t *UpstreamTLS) Options() tlsconfig.Options {
+	return tlsconfig.Options{CertFile: t.Cert, KeyFile: t.Key, CAFile: t.CA, Pins: t.Pins, ServerName: t.ServerName}
+}
+
+// Route picks an upstream for each connection by its destination host.
+type Route struct {
+	// Rules are checked in order; the first match wins.
+	Rules []*RouteRule `yaml:"rules"`
+	// Default is the upstream used when no rule matches. It defaults to
+	// DirectUpstream.
+	Default string `yaml:"default"`
+}
+
+// RouteRule sends destinations matching any of Match via Upstream.
+type RouteRule struct {
+	// Match holds hostmatch patterns.
+	Match    []string `yaml:"match"`
+	Upstream string   `yaml:"upstream"`
+
+	// Patterns is Match as parsed by Validate.
+	Patterns hostmatch.List `yaml:"-"`
+}
+
+// ACL allows or denies connections by their client and destination.
+type ACL struct {
+	// Rules are checked in order; the first match decides.
+	Rules []*ACLRule `yaml:"rules"`
+	// Default is the action, "allow" or "deny", when no rule matches.  It
+	// defaults to "allow".
+	Default string `yaml:"default"`
+
+	// Parsed is the ACL as parsed by Validate.
+	Parsed *acl.ACL `yaml:"-"`
+}
+
+// ACLRule matches connections by all of the criteria that are set.
+type ACLRule struct {
+	// Action is "allow" or "deny".
+	Action string `yaml:"action"`
+	// Sources are client IP addresses or CIDR prefixes.
+	Sources []string `yaml:"sources"`
+	// Users are authenticated usernames.
+	Users []string `yaml:"users"`
+	// Hosts are hostmatch patterns for the requested destination host.
+	Hosts []string `yaml:"hosts"`
+	// IPs are IP addresses or CIDR prefixes for the destination's
+	// resolved addresses.
+	IPs []string `yaml:"ips"`
+	// Ports are destination ports or ranges, such as 443 or "8000-8999".
+	Ports []string `yaml:"ports"`
+}
+
+// Hosts is a set of host overrides.
+type Hosts struct {
+	// Overrides are checked in order, before those in File; the first
+	// match applies.
+	Overrides []*HostsOverride `yaml:"overrides"`
+	// File is a hosts file to read more overrides from.
+	File string `yaml:"file"`
+
+	// Parsed is the set as parsed by Validate.
+	Parsed hosts.Map `yaml:"-"`
+}
+
+// HostsOverride sends connections to hosts matching Match to To instead.
+type HostsOverride struct {
+	// Match holds hostmatch patterns.
+	Match []string `yaml:"match"`
+	// To is an IP address or hostname, optionally with a port.
+	To string `yaml:"to"`
+}
+
+// Listener is a named proxy listener.
+type Listener struct {
+	// Type is one of TypeHTTP, TypeSOCKS5, or TypeTProxy.
+	Type string `yaml:"type"`
+	// Listen is the IP:port to listen on.
+	Listen string `yaml:"listen"`
+	// Upstream or Route names where connections are sent.  At most one may
+	// be set; if neither is, Validate sets Upstream (see DefaultUpstream).
+	Upstream string       `yaml:"upstream"`
+	Route    string       `yaml:"route"`
+	Auth     ListenerAuth `yaml:"auth"`
+	TLS      ListenerTLS  `yaml:"tls"`
+	// ACL names the ACL that connections must pass, if any.
+	ACL string `yaml:"acl"`
+	// Hosts names the host overrides that apply to connections, if any.
+	Hosts string `yaml:"hosts"`
+	// Sniff, for tproxy listeners, dials by the hostname that clients send
+	// in a TLS ClientHello or HTTP Host header instead of by address.
+	Sniff bool `yaml:"sniff"`
+	// UDP, for tproxy listeners, also proxies UDP on the same address.
+	UDP bool `yaml:"udp"`
+	// Mode, for tproxy listeners, is ModeTProxy or ModeRedirect.  Validate
+	// sets ModeTProxy if it's empty.
+	Mode string `yaml:"mode"`
+}
+
+// ListenerAuth configures client authentication for HTTP and SOCKS5
+// listeners.
+type ListenerAuth struct {
+	// Users maps usernames to passwords.
+	Users map[string]string `yaml:"users"`
+}
+
+// ListenerTLS configures TLS for HTTP and SOCKS5 listeners.
+type ListenerTLS struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+}
+
+// IsZero reports whether TLS is not configured.
+func (t *ListenerTLS) IsZero() bool {
+	return t.Cert == "" && t.Key == "" && t.ClientCA == ""
+}
+
+// Options returns t as tlsconfig.Options.
+func (t *ListenerTLS) Options() tlsconfig.Options {
+	return tlsconfig.Options{CertFile: t.Cert, KeyFile: t.Key, CAFile: t.ClientCA}
+}
+
+// Load reads and validates the configuration file at path.  Settings not
+// present in the file are taken from base.
+func Load(path string, base Settings) (*Config, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // Path is from the command line.
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data, base)
+}
+
+// Parse parses and validates a YAML configuration.  name is used in error
+// messages.  Settings not present in data are taken from base.
+func Parse(name string, data []byte, base Settings) (*Config, error) {
+	c := &Config{Settings: base, file: name}
+
+	var root yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&root); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(root.Content) == 0 {
+		return nil, fmt.Errorf("%s: empty configuration", name)
+	}
+	c.root = &root
+
+	if err := c.checkKeys(root.Content[0], reflect.TypeOf(c), ""); err != nil {
+		return nil, err
+	}
+	if err := root.Decode(c); err != nil {
+		var te *yaml.TypeError
+		if errors.As(err, &te) {
+			return nil, fmt.Errorf("%s: %s", name, strings.Join(te.Errors, "; "))
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks c for consistency, parses route patterns, and fills in
+// defaults: the direct upstream, route defaults, and listener upstreams.
+func (c *Config) Validate() error {
+	if c.Upstreams == nil {
+		c.Upstreams = make(map[string]*Upstream)
+	}
+	if _, ok := c.Upstreams[DirectUpstream]; !ok {
+		c.Upstreams[DirectUpstream] = &Upstream{URL: "direct://"}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Upstreams)) {
+		if u := c.Upstreams[name]; u == nil || u.URL == "" {
+			return c.KeyError("upstreams."+name+".url", errors.New("missing upstream url"))
+		}
+	}
+
+	if c.DNSUpstream != "" {
+		if err := c.checkUpstream("dns_upstream", c.DNSUpstream); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Routes)) {
+		if err := c.validateRoute(name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.ACLs)) {
+		if err := c.validateACL(name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Hosts)) {
+		if err := c.validateHosts(name); err != nil {
+			return err
+		}
+	}
+
+	if len(c.Listeners) == 0 {
+		return c.KeyError("listeners", errors.New("no listeners configured"))
+	}
+
+	addrs := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(c.Listeners)) {
+		if err := c.validateListener(name); err != nil {
+			return err
+		}
+		l := c.Listeners[name]
+		if other, ok := addrs[l.Listen]; ok {
+			return c.KeyError("listeners."+name+".listen", fmt.Errorf("address %s is already used by listener %q", l.Listen, other))
+		}
+		addrs[l.Listen] = name
+	}
+
+	return nil
+}
+
+func (c *Config) validateRoute(name string) error {
+	key := "routes." + name
+	r := c.Routes[name]
+	if r == nil {
+		return c.KeyError(key, errors.New("empty route"))
+	}
+
+	for i, rule := range r.Rules {
+		rkey := fmt.Sprintf("%s.rules.%d", key, i)
+		if rule == nil || len(rule.Match) == 0 {
+			return c.KeyError(rkey+".match", errors.New("missing match patterns"))
+		}
+		var err error
+		if rule.Patterns, err = hostmatch.ParseList(rule.Match); err != nil {
+			return c.KeyError(rkey+".match", err)
+		}
+		if err := c.checkUpstream(rkey+".upstream", rule.Upstream); err != nil {
+			return err
+		}
+	}
+
+	if r.Default == "" {
+		r.Default = DirectUpstream
+	}
+	return c.checkUpstream(key+".default", r.Default)
+}
+
+func (c *Config) validateACL(name string) error {
+	key := "acls." + name
+	a := c.ACLs[name]
+	if a == nil {
+		return c.KeyError(key, errors.New("empty ACL"))
+	}
+
+	parsed := &acl.ACL{}
+	if a.Default == "" {
+		a.Default = acl.Allow.String()
+	}
+	var err error
+	if parsed.Default, err = acl.ParseAction(a.Default); err != nil {
+		return c.KeyError(key+".default", err)
+	}
+
+	for i, rule := range a.Rules {
+		rkey := fmt.Sprintf("%s.rules.%d", key, i)
+		if rule == nil {
+			return c.KeyError(rkey, errors.New("empty rule"))
+		}
+		r := acl.Rule{Users: rule.Users}
+		if r.Action, err = acl.ParseAction(rule.Action); err != nil {
+			return c.KeyError(rkey+".action", err)
+		}
+		if r.Sources, err = hostmatch.ParsePrefixes(rule.Sources); err != nil {
+			return c.KeyError(rkey+".sources", err)
+		}
+		if r.Hosts, err = hostmatch.ParseList(rule.Hosts); err != nil {
+			return c.KeyError(rkey+".hosts", err)
+		}
+		if r.IPs, err = hostmatch.ParsePrefixes(rule.IPs); err != nil {
+			return c.KeyError(rkey+".ips", err)
+		}
+		for _, p := range rule.Ports {
+			pr, err := acl.ParsePortRange(p)
+			if err != nil {
+				return c.KeyError(rkey+".ports", err)
+			}
+			r.Ports = append(r.Ports, pr)
+		}
+		parsed.Rules = append(parsed.Rules, r)
+	}
+	a.Parsed = parsed
+	return nil
+}
+
+func (c *Config) validateHosts(name string) error {
+	key := "hosts." + name
+	h := c.Hosts[name]
+	if h == nil {
+		return c.KeyError(key, errors.New("empty hosts"))
+	}
+
+	var parsed hosts.Map
+	for i, o := range h.Overrides {
+		okey := fmt.Sprintf("%s.overrides.%d", key, i)
+		if o == nil {
+			return c.KeyError(okey, errors.New("empty override"))
+		}
+		override, err := hosts.NewOverride(o.Match, o.To)
+		if err != nil {
+			return c.KeyError(okey, err)
+		}
+		parsed = append(parsed, override)
+	}
+	if h.File != "" {
+		m, err := hosts.ParseFile(h.File)
+		if err != nil {
+			return c.KeyError(key+".file", err)
+		}
+		parsed = append(parsed, m...)
+	}
+	h.Parsed = parsed
+	return nil
+}
+
+func (c *Config) validateListener(name string) error {
+	key := "listeners." + name
+	l := c.Listeners[name]
+	if l == nil {
+		return c.KeyError(key, errors.New("empty listener"))
+	}
+
+	switch l.Type {
+	case TypeHTTP, TypeSOCKS5:
+		if l.Sniff {
+			return c.KeyError(key+".sniff", errors.New("only supported for tproxy listeners"))
+		}
+		if l.UDP {
+			return c.KeyError(key+".udp", errors.New("only supported for tproxy listeners"))
+		}
+		if l.Mode != "" {
+			return c.KeyError(key+".mode", errors.New("only supported for tproxy listeners"))
+		}
+	case TypeTProxy:
+		switch l.Mode {
+		case "":
+			l.Mode = ModeTProxy
+		case ModeTProxy:
+		case ModeRedirect:
+			if l.UDP {
+				return c.KeyError(key+".udp", fmt.Errorf("not supported in %s mode", ModeRedirect))
+			}
+		default:
+			return c.KeyError(key+".mode", fmt.Errorf("unknown mode %q (expected %s or %s)", l.Mode, ModeTProxy, ModeRedirect))
+		}
+		if len(l.Auth.Users) > 0 {
+			return c.KeyError(key+".auth", errors.New("not supported for tproxy listeners"))
+		}
+		if !l.TLS.IsZero() {
+			return c.KeyError(key+".tls", errors.New("not supported for tproxy listeners"))
+		}
+	case "":
+		return c.KeyError(key+".type", errors.New("missing listener type"))
+	default:
+		return c.KeyError(key+".type", fmt.Errorf("unknown listener type %q (expected %s, %s or %s)", l.Type, TypeHTTP, TypeSOCKS5, TypeTProxy))
+	}
+
+	if _, _, err := net.SplitHostPort(l.Listen); err != nil {
+		return c.KeyError(key+".listen", err)
+	}
+
+	if (l.TLS.Cert == "") != (l.TLS.Key == "") {
+		return c.KeyError(key+".tls", errors.New("cert and key must be set together"))
+	}
+	if l.TLS.ClientCA != "" && l.TLS.Cert == "" {
+		return c.KeyError(key+".tls.client_ca", errors.New("requires cert and key"))
+	}
+
+	if l.ACL != "" {
+		if _, ok := c.ACLs[l.ACL]; !ok {
+			return c.KeyError(key+".acl", fmt.Errorf("unknown ACL %q", l.ACL))
+		}
+	}
+	if l.Hosts != "" {
+		if _, ok := c.Hosts[l.Hosts]; !ok {
+			return c.KeyError(key+".hosts", fmt.Errorf("unknown hosts %q", l.Hosts))
+		}
+	}
+
+	for user := range l.Auth.Users {
+		if user == "" || strings.Contains(user, ":") {
+			return c.KeyError(key+".auth.users", fmt.Errorf("invalid username %q", user))
+		}
+	}
+
+	switch {
+	case l.Upstream != "" && l.Route != "":
+		return c.KeyError(key+".route", errors.New("upstream and route can't both be set"))
+	case l.Route != "":
+		if _, ok := c.Routes[l.Route]; !ok {
+			return c.KeyError(key+".route", fmt.Errorf("unknown route %q", l.Route))
+		}
+	case l.Upstream != "":
+		return c.checkUpstream(key+".upstream", l.Upstream)
+	case c.Upstreams[DefaultUpstream] != nil:
+		l.Upstream = DefaultUpstream
+	default:
+		l.Upstream = DirectUpstream
+	}
+	return nil
+}
+
+func (c *Config) checkUpstream(key, name string) error {
+	if name == "" {
+		return c.KeyError(key, errors.New("missing upstream name"))
+	}
+	if _, ok := c.Upstreams[name]; !ok {
+		return c.KeyError(key, fmt.Errorf("unknown upstream %q", name))
+	}
+	return nil
+}
+
+// File returns the name of the file c was loaded from, or "" if it was built
+// some other way (such as from flags).
+func (c *Config) File() string {
+	if c.root == nil {
+		return ""
+	}
+	return c.file
+}
+
+// KeyError annotates err with key, a dotted path such as
+// "listeners.office.upstream", and with the file and line number of the key
+// if c was loaded from a file.
+func (c *Config) KeyError(key string, err error) error {
+	if c.root == nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return fmt.Errorf("%s:%d: %s: %w", c.file, c.line(key), key, err)
+}
@@ -0,0 +1,316 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/die-net/conduit/internal/acl"
+)
+
+const example = `
+dial_timeout: 5s
+verbose: true
+
+upstreams:
+  corp:
+    url: https://proxy.corp.example:3128
+    http2: true
+    tls:
+      ca: /etc/conduit/corp-ca.pem
+      pins: [abc]
+  bastion: ssh://me@bastion.example:22
+
+routes:
+  split:
+    rules:
+      - match: [".corp.example", "10.0.0.0/8"]
+        upstream: corp
+      - match: ["*.lab.example"]
+        upstream: bastion
+
+acls:
+  safe:
+    rules:
+      - action: deny
+        ips: [127.0.0.0/8, 169.254.169.254]
+      - action: allow
+        sources: [10.0.0.0/8]
+        ports: [443, 8000-8999]
+    default: deny
+
+hosts:
+  staging:
+    overrides:
+      - match: [api.example.com, "*.api.example.com"]
+        to: staging.example.net:8443
+      - match: [db.example.com]
+        to: 10.1.2.3
+
+listeners:
+  office:
+    type: http
+    listen: 0.0.0.0:8080
+    route: split
+    acl: safe
+    hosts: staging
+    auth:
+      users:
+        alice: secret
+    tls:
+      cert: server.pem
+      key: server-key.pem
+  socks:
+    type: socks5
+    listen: 127.0.0.1:1080
+    upstream: bastion
+  plain:
+    type: socks5
+    listen: 127.0.0.1:1081
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse("conduit.yaml", []byte(example), Settings{DialTimeout: time.Second, NegotiationTimeout: 7 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.DialTimeout != 5*time.Second || !c.Verbose {
+		t.Errorf("settings not decoded: %+v", c.Settings)
+	}
+	if c.NegotiationTimeout != 7*time.Second {
+		t.Errorf("base setting not kept: %v", c.NegotiationTimeout)
+	}
+
+	corp := c.Upstreams["corp"]
+	if corp == nil || !corp.HTTP2 || corp.TLS.CA != "/etc/conduit/corp-ca.pem" || len(corp.TLS.Pins) != 1 {
+		t.Errorf("unexpected corp upstream: %+v", corp)
+	}
+	if u := c.Upstreams["bastion"]; u == nil || u.URL != "ssh://me@bastion.example:22" {
+		t.Errorf("unexpected shorthand upstream: %+v", u)
+	}
+	if u := c.Upstreams[DirectUpstream]; u == nil || u.URL != "direct://" {
+		t.Errorf("missing direct upstream: %+v", u)
+	}
+
+	split := c.Routes["split"]
+	if split.Default != DirectUpstream {
+		t.Errorf("expected route default %q, got %q", DirectUpstream, split.Default)
+	}
+	if !split.Rules[0].Patterns.Match("www.corp.example") || split.Rules[1].Patterns.Match("www.corp.example") {
+		t.Error("route patterns not parsed")
+	}
+
+	safe := c.ACLs["safe"].Parsed
+	if safe == nil || safe.Default != acl.Deny || len(safe.Rules) != 2 {
+		t.Fatalf("unexpected ACL: %+v", safe)
+	}
+	if r := safe.Rules[1]; r.Action != acl.Allow || len(r.Sources) != 1 || len(r.Ports) != 2 || r.Ports[1] != (acl.PortRange{Lo: 8000, Hi: 8999}) {
+		t.Errorf("unexpected ACL rule: %+v", r)
+	}
+
+	staging := c.Hosts["staging"].Parsed
+	if got := staging.Rewrite("v1.api.example.com:443"); got != "staging.example.net:8443" {
+		t.Errorf("hosts rewrote to %q", got)
+	}
+	if got := staging.Rewrite("db.example.com:5432"); got != "10.1.2.3:5432" {
+		t.Errorf("hosts rewrote to %q", got)
+	}
+
+	office := c.Listeners["office"]
+	if office.Hosts != "staging" || office.ACL != "safe" || office.Type != TypeHTTP || office.Route != "split" || office.Auth.Users["alice"] != "secret" || office.TLS.Cert != "server.pem" {
+		t.Errorf("unexpected office listener: %+v", office)
+	}
+	if l := c.Listeners["plain"]; l.Upstream != DirectUpstream {
+		t.Errorf("expected plain listener to default to %q, got %q", DirectUpstream, l.Upstream)
+	}
+}
+
+func TestParseDefaultUpstream(t *testing.T) {
+	c, err := Parse("conduit.yaml", []byte(`
+upstreams:
+  default: socks5://127.0.0.1:1080
+listeners:
+  a: {type: http, listen: "127.0.0.1:8080"}
+`), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Listeners["a"].Upstream; got != DefaultUpstream {
+		t.Fatalf("expected %q, got %q", DefaultUpstream, got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "empty",
+			yaml: "",
+			want: "conduit.yaml: empty configuration",
+		},
+		{
+			name: "unknown top-level key",
+			yaml: "listners: {}\n",
+			want: "conduit.yaml:1: listners: unknown key",
+		},
+		{
+			name: "unknown nested key",
+			yaml: "listeners:\n  a:\n    type: http\n    listen: 127.0.0.1:1\n    tls:\n      certfile: x\n",
+			want: "conduit.yaml:6: listeners.a.tls.certfile: unknown key",
+		},
+		{
+			name: "bad duration",
+			yaml: "dial_timeout: soon\nlisteners: {a: {type: http, listen: '127.0.0.1:1'}}\n",
+			want: "line 1: cannot unmarshal",
+		},
+		{
+			name: "unknown dns upstream",
+			yaml: "dns: tls://1.1.1.1\ndns_upstream: corp\nlisteners: {a: {type: http, listen: '127.0.0.1:1'}}\n",
+			want: "conduit.yaml:2: dns_upstream: unknown upstream \"corp\"",
+		},
+		{
+			name: "unknown hosts",
+			yaml: "listeners: {a: {type: http, listen: '127.0.0.1:1', hosts: staging}}\n",
+			want: "conduit.yaml:1: listeners.a.hosts: unknown hosts \"staging\"",
+		},
+		{
+			name: "bad hosts override",
+			yaml: "hosts:\n  staging:\n    overrides:\n      - match: [a.example]\n        to: 'b.example:http'\nlisteners: {a: {type: http, listen: '127.0.0.1:1'}}\n",
+			want: "conduit.yaml:4: hosts.staging.overrides.0: invalid port in target",
+		},
+		{
+			name: "no listeners",
+			yaml: "verbose: true\n",
+			want: "conduit.yaml:1: listeners: no listeners configured",
+		},
+		{
+			name: "bad type",
+			yaml: "listeners:\n  a:\n    type: ftp\n    listen: 127.0.0.1:1\n",
+			want: `conduit.yaml:3: listeners.a.type: unknown listener type "ftp"`,
+		},
+		{
+			name: "missing type",
+			yaml: "listeners:\n  a:\n    listen: 127.0.0.1:1\n",
+			want: "conduit.yaml:2: listeners.a.type: missing listener type",
+		},
+		{
+			name: "bad listen",
+			yaml: "listeners:\n  a:\n    type: http\n    listen: localhost\n",
+			want: "conduit.yaml:4: listeners.a.listen:",
+		},
+		{
+			name: "duplicate listen",
+			yaml: "listeners:\n  a: {type: http, listen: '127.0.0.1:1'}\n  b: {type: socks5, listen: '127.0.0.1:1'}\n",
+			want: `conduit.yaml:3: listeners.b.listen: address 127.0.0.1:1 is already used by listener "a"`,
+		},
+		{
+			name: "unknown upstream",
+			yaml: "listeners:\n  a:\n    type: http\n    listen: 127.0.0.1:1\n    upstream: corp\n",
+			want: `conduit.yaml:5: listeners.a.upstream: unknown upstream "corp"`,
+		},
+		{
+			name: "unknown route",
+			yaml: "listeners:\n  a:\n    type: http\n    listen: 127.0.0.1:1\n    route: split\n",
+			want: `conduit.yaml:5: listeners.a.route: unknown route "split"`,
+		},
+		{
+			name: "upstream and route",
+			yaml: "routes: {r: {}}\nlisteners:\n  a:\n    type: http\n    listen: 127.0.0.1:1\n    upstream: direct\n    route: r\n",
+			want: "conduit.yaml:7: listeners.a.route: upstream and route can't both be set",
+		},
+		{
+			name: "tproxy auth",
+			yaml: "listeners:\n  a:\n    type: tproxy\n    listen: 127.0.0.1:1\n    auth:\n      users: {a: b}\n",
+			want: "conduit.yaml:5: listeners.a.auth: not supported for tproxy listeners",
+		},
+		{
+			name: "sniff on socks5",
+			yaml: "listeners:\n  a:\n    type: socks5\n    listen: 127.0.0.1:1\n    sniff: true\n",
+			want: "conduit.yaml:5: listeners.a.sniff: only supported for tproxy listeners",
+		},
+		{
+			name: "udp on http",
+			yaml: "listeners:\n  a:\n    type: http\n    listen: 127.0.0.1:1\n    udp: true\n",
+			want: "conduit.yaml:5: listeners.a.udp: only supported for tproxy listeners",
+		},
+		{
+			name: "mode on socks5",
+			yaml: "listeners:\n  a:\n    type: socks5\n    listen: 127.0.0.1:1\n    mode: redirect\n",
+			want: "conduit.yaml:5: listeners.a.mode: only supported for tproxy listeners",
+		},
+		{
+			name: "unknown tproxy mode",
+			yaml: "listeners:\n  a:\n    type: tproxy\n    listen: 127.0.0.1:1\n    mode: dnat\n",
+			want: `conduit.yaml:5: listeners.a.mode: unknown mode "dnat" (expected tproxy or redirect)`,
+		},
+		{
+			name: "udp in redirect mode",
+			yaml: "listeners:\n  a:\n    type: tproxy\n    listen: 127.0.0.1:1\n    mode: redirect\n    udp: true\n",
+			want: "conduit.yaml:6: listeners.a.udp: not supported in redirect mode",
+		},
+		{
+			name: "tls key without cert",
+			yaml: "listeners:\n  a:\n    type: http\n    listen: 127.0.0.1:1\n    tls:\n      key: k.pem\n",
+			want: "conduit.yaml:5: listeners.a.tls: cert and key must be set together",
+		},
+		{
+			name: "upstream missing url",
+			yaml: "upstreams:\n  corp:\n    http2: true\nlisteners: {a: {type: http, listen: '127.0.0.1:1'}}\n",
+			want: "conduit.yaml:2: upstreams.corp.url: missing upstream url",
+		},
+		{
+			name: "unknown acl",
+			yaml: "listeners:\n  a:\n    type: http\n    listen: 127.0.0.1:1\n    acl: safe\n",
+			want: `conduit.yaml:5: listeners.a.acl: unknown ACL "safe"`,
+		},
+		{
+			name: "bad acl action",
+			yaml: "acls:\n  a:\n    rules:\n      - action: reject\nlisteners: {a: {type: http, listen: '127.0.0.1:1'}}\n",
+			want: `conduit.yaml:4: acls.a.rules.0.action: unknown action "reject"`,
+		},
+		{
+			name: "bad acl ips",
+			yaml: "acls:\n  a:\n    rules:\n      - action: deny\n        ips: [localhost]\nlisteners: {a: {type: http, listen: '127.0.0.1:1'}}\n",
+			want: `conduit.yaml:5: acls.a.rules.0.ips: invalid IP address or CIDR prefix "localhost"`,
+		},
+		{
+			name: "bad acl ports",
+			yaml: "acls:\n  a:\n    rules:\n      - action: deny\n        ports: [0-x]\nlisteners: {a: {type: http, listen: '127.0.0.1:1'}}\n",
+			want: `conduit.yaml:5: acls.a.rules.0.ports: invalid port range "0-x"`,
+		},
+		{
+			name: "bad route pattern",
+			yaml: "routes:\n  r:\n    rules:\n      - upstream: direct\n        match: ['10.0.0.0/99']\nlisteners: {a: {type: http, listen: '127.0.0.1:1'}}\n",
+			want: "conduit.yaml:5: routes.r.rules.0.match: invalid CIDR prefix",
+		},
+		{
+			name: "route rule unknown upstream",
+			yaml: "routes:\n  r:\n    rules:\n      - match: ['*']\n        upstream: nope\nlisteners: {a: {type: http, listen: '127.0.0.1:1'}}\n",
+			want: `conduit.yaml:5: routes.r.rules.0.upstream: unknown upstream "nope"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse("conduit.yaml", []byte(tt.yaml), Settings{})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %q", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestKeyErrorWithoutFile(t *testing.T) {
+	c := &Config{Listeners: map[string]*Listener{"http": {Type: TypeHTTP, Listen: "127.0.0.1:1", Upstream: "corp"}}}
+	err := c.Validate()
+	if err == nil || err.Error() != `listeners.http.upstream: unknown upstream "corp"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+// Package config loads conduit's YAML configuration file.
+//
+// A configuration declares any number of named upstreams (outbound dialers),
+// routes (policies that pick an upstream per destination host), and
+// listeners (HTTP, SOCKS5 or transparent proxy), each bound to an upstream or
+// a route.  Global settings mirror the command-line flags.
+//
+// Errors are reported against the offending key, with its line number when
+// it came from a file.
+package config
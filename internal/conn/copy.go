@@ -6,45 +6,211 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/errgroup"
+
+	"github.com/die-net/conduit/internal/metrics"
+	"github.com/die-net/conduit/internal/session"
 )
 
+// Side identifies one end of a tunnel.
+type Side uint8
+
+const (
+	// SideNone means neither side; a tunnel that never ended by EOF or
+	// error, such as one whose ctx was canceled first, has no ClosedFirst.
+	SideNone Side = iota
+	// SideClient is the left side passed to CopyBidirectional.
+	SideClient
+	// SideUpstream is the right side passed to CopyBidirectional.
+	SideUpstream
+)
+
+// String returns "client", "upstream", or "" for SideNone.
+func (s Side) String() string {
+	switch s {
+	case SideClient:
+		return "client"
+	case SideUpstream:
+		return "upstream"
+	default:
+		return ""
+	}
+}
+
+// Stats describes a tunnel run by CopyBidirectional.
+type Stats struct {
+	// BytesUp and BytesDown are the bytes copied from the client to the
+	// upstream and from the upstream to the client.
+	BytesUp, BytesDown int64
+	// TimeToFirstByte is the time from the start of the tunnel until the
+	// first byte arrived from the upstream, or 0 if none did.
+	TimeToFirstByte time.Duration
+	// Duration is how long the tunnel ran.
+	Duration time.Duration
+	// ClosedFirst is the side whose read ended first, by EOF or error.
+	ClosedFirst Side
+}
+
 // CopyBidirectional proxies bytes between left and right until one side
 // returns an error or ctx is canceled.  Connections are gracefully shut
 // down via TCP half-close (CloseWrite) where possible or normal Close
 // otherwise.
 //
-// It intentionally avoids setting deadlines so io.Copy can use Go's zero-copy
-// fast path when available.
+// It intentionally avoids setting deadlines or wrapping either side so
+// io.Copy can use Go's zero-copy fast path when available.  Only the first
+// read from right is done separately, to time the first byte.
 //
 // When ctx is canceled, both connections are closed to unblock any pending
-// copies.
-func CopyBidirectional(ctx context.Context, left, right io.ReadWriteCloser) error {
+// copies.  If idleTimeout is positive, they are also closed, and
+// ErrIdleTimeout returned, once no data has moved in either direction for
+// that long.  That is detected by periodically polling the kernel's byte
+// counts for TCP sockets on Linux, so that the fast path is kept, and by
+// counting reads otherwise.
+//
+// left is the client side and right the upstream side, as far as metrics
+// and Stats are concerned.  Bytes are added to metrics.TunnelBytes every
+// tunnelBytesInterval while the tunnel runs, and the rest once it ends.  If
+// ctx carries a session.Session, the tunnel is counted against its listener
+// and its byte counts and tunnel stats are updated.
+func CopyBidirectional(ctx context.Context, left, right io.ReadWriteCloser, idleTimeout time.Duration) (Stats, error) {
+	var listener string
+	sess := session.FromContext(ctx)
+	if sess != nil {
+		listener = sess.Listener
+	}
+	active := metrics.ActiveTunnels.WithLabelValues(listener)
+	active.Inc()
+	defer active.Dec()
+
+	var (
+		stats       Stats
+		closedFirst atomic.Uint32
+	)
+	start := time.Now()
+	closed := func(side Side) {
+		closedFirst.CompareAndSwap(uint32(SideNone), uint32(side))
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
 	g, gctx := errgroup.WithContext(ctx)
 	context.AfterFunc(gctx, func() {
 		_ = left.Close()
 		_ = right.Close()
 	})
 
+	// Meter the tunnel while it runs, for metrics, the session's live byte
+	// counts and idle detection.
+	up, leftSrc := newMeter(left)
+	down, rightSrc := newMeter(right)
+	upBytes := &byteCounter{c: metrics.TunnelBytes.WithLabelValues(listener, metrics.Upstream)}
+	downBytes := &byteCounter{c: metrics.TunnelBytes.WithLabelValues(listener, metrics.Downstream)}
+	go reportBytes(gctx, tunnelBytesInterval, func() {
+		upBytes.report(up.count())
+		downBytes.report(down.count())
+	})
+	if sess != nil {
+		sess.StartTunnel(func() (int64, int64) {
+			return int64(up.count()), int64(down.count()) //nolint:gosec // Counts fit in an int64.
+		})
+	}
+	if idleTimeout > 0 {
+		total := func() uint64 { return up.count() + down.count() }
+		go watchIdle(gctx, idleTimeout, total, func() { cancel(ErrIdleTimeout) })
+	}
+
 	g.Go(func() error {
-		return copyClose(left, right)
+		n, err := copyClose(left, rightSrc, func() {
+			stats.TimeToFirstByte = time.Since(start)
+		})
+		closed(SideUpstream)
+		stats.BytesDown = n
+		downBytes.report(uint64(n)) //nolint:gosec // n is never negative.
+		return err
 	})
 
 	g.Go(func() error {
-		return copyClose(right, left)
+		n, err := copyClose(right, leftSrc, nil)
+		closed(SideClient)
+		stats.BytesUp = n
+		upBytes.report(uint64(n)) //nolint:gosec // n is never negative.
+		return err
 	})
 
-	if err := g.Wait(); err != nil {
-		return fmt.Errorf("copy: %w", err)
+	err := g.Wait()
+	if errors.Is(context.Cause(ctx), ErrIdleTimeout) {
+		err = ErrIdleTimeout
+	}
+	stats.Duration = time.Since(start)
+	if ctx.Err() == nil {
+		stats.ClosedFirst = Side(closedFirst.Load())
+	}
+	if sess != nil {
+		sess.EndTunnel(stats.BytesUp, stats.BytesDown, stats.TimeToFirstByte, stats.ClosedFirst.String())
+	}
+	if err != nil {
+		return stats, fmt.Errorf("copy: %w", err)
+	}
+	return stats, nil
+}
+
+// tunnelBytesInterval is how often a running tunnel's bytes are added to
+// metrics.TunnelBytes.  Tests shorten it.
+var tunnelBytesInterval = 10 * time.Second
+
+// reportBytes calls report every interval until ctx is done.
+func reportBytes(ctx context.Context, interval time.Duration, report func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report()
+		}
+	}
+}
+
+// byteCounter adds one direction of a tunnel to a counter as its byte count
+// grows.
+type byteCounter struct {
+	mu       sync.Mutex
+	c        interface{ Add(float64) }
+	reported uint64
+}
+
+// report adds whatever of total hasn't been added yet.
+func (b *byteCounter) report(total uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if total > b.reported {
+		b.c.Add(float64(total - b.reported))
+		b.reported = total
 	}
-	return nil
 }
 
 // copyClose does an io.Copy to dst from src, then CloseWrite (graceful TCP
-// half-close) or Close dst.
-func copyClose(dst, src io.ReadWriteCloser) error {
-	_, err := io.Copy(dst, src)
+// half-close) or Close dst.  It returns the number of bytes copied.
+//
+// If firstByte isn't nil, it is called when the first byte is read from src.
+func copyClose(dst io.WriteCloser, src io.Reader, firstByte func()) (int64, error) {
+	var n int64
+	var err error
+	done := false
+	if firstByte != nil {
+		n, done, err = copyFirst(dst, src, firstByte)
+	}
+	if !done {
+		var m int64
+		m, err = io.Copy(dst, src)
+		n += m
+	}
 
 	// We double-close in some cases, so ignore this error.
 	if err != nil && errors.Is(err, net.ErrClosed) {
@@ -54,11 +220,43 @@ func copyClose(dst, src io.ReadWriteCloser) error {
 	// Gracefully shut dst down with CloseWrite() if available.
 	if dcw, ok := dst.(interface{ CloseWrite() error }); ok {
 		_ = dcw.CloseWrite()
-		return err
+		return n, err
 	}
 
 	// Otherwise, Close() will have to do, even though it
 	// immediately breaks receive.
 	_ = dst.Close()
-	return err
+	return n, err
+}
+
+// copyFirst copies the first chunk read from src to dst, calling firstByte
+// when it arrives.  It uses a plain Read rather than wrapping src, so that
+// the io.Copy of the rest can still use the zero-copy fast path.  done
+// reports whether src has ended or either side failed, in which case there
+// is nothing left to copy.
+func copyFirst(dst io.Writer, src io.Reader, firstByte func()) (n int64, done bool, err error) {
+	buf := make([]byte, 4096)
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			firstByte()
+			nw, werr := dst.Write(buf[:nr])
+			if werr == nil && nw < nr {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return int64(nw), true, werr
+			}
+			n = int64(nw)
+		}
+		if rerr != nil {
+			if errors.Is(rerr, io.EOF) {
+				rerr = nil
+			}
+			return n, true, rerr
+		}
+		if nr > 0 {
+			return n, false, nil
+		}
+	}
 }
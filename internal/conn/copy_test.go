@@ -0,0 +1,238 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/die-net/conduit/internal/metrics"
+	"github.com/die-net/conduit/internal/session"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return a, b
+}
+
+func TestCopyBidirectionalStats(t *testing.T) {
+	client, left := tcpPair(t)
+	right, upstream := tcpPair(t)
+
+	sess := session.New("test", "test", "client")
+	ctx := session.NewContext(context.Background(), sess)
+
+	type result struct {
+		stats Stats
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stats, err := CopyBidirectional(ctx, left, right, 0)
+		done <- result{stats, err}
+	}()
+
+	// The client sends its request and half-closes; the upstream answers
+	// only once it has seen EOF, so the client always closes first.
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.(*net.TCPConn).CloseWrite()
+
+	req, err := io.ReadAll(upstream)
+	if err != nil || string(req) != "hello" {
+		t.Fatalf("upstream read %q, %v", req, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := upstream.Write([]byte("world!")); err != nil {
+		t.Fatal(err)
+	}
+	_ = upstream.Close()
+
+	resp, err := io.ReadAll(client)
+	if err != nil || string(resp) != "world!" {
+		t.Fatalf("client read %q, %v", resp, err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("CopyBidirectional: %v", res.err)
+	}
+	st := res.stats
+	if st.BytesUp != 5 || st.BytesDown != 6 {
+		t.Errorf("BytesUp=%d BytesDown=%d, want 5 and 6", st.BytesUp, st.BytesDown)
+	}
+	if st.ClosedFirst != SideClient {
+		t.Errorf("ClosedFirst=%v, want client", st.ClosedFirst)
+	}
+	if st.TimeToFirstByte < 10*time.Millisecond || st.TimeToFirstByte > st.Duration {
+		t.Errorf("TimeToFirstByte=%v, Duration=%v", st.TimeToFirstByte, st.Duration)
+	}
+	if sess.BytesUp.Load() != 5 || sess.BytesDown.Load() != 6 {
+		t.Errorf("session bytes up=%d down=%d, want 5 and 6", sess.BytesUp.Load(), sess.BytesDown.Load())
+	}
+}
+
+func TestCopyBidirectionalNoResponse(t *testing.T) {
+	client, left := tcpPair(t)
+	right, upstream := tcpPair(t)
+
+	done := make(chan Stats, 1)
+	go func() {
+		stats, _ := CopyBidirectional(context.Background(), left, right, 0)
+		done <- stats
+	}()
+
+	// The upstream hangs up without sending anything.
+	_ = upstream.Close()
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+
+	st := <-done
+	if st.ClosedFirst != SideUpstream {
+		t.Errorf("ClosedFirst=%v, want upstream", st.ClosedFirst)
+	}
+	if st.TimeToFirstByte != 0 || st.BytesDown != 0 {
+		t.Errorf("TimeToFirstByte=%v BytesDown=%d, want 0", st.TimeToFirstByte, st.BytesDown)
+	}
+}
+
+func TestCopyBidirectionalIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name  string
+		right func(t *testing.T) (io.ReadWriteCloser, net.Conn)
+	}{
+		{name: "tcp", right: func(t *testing.T) (io.ReadWriteCloser, net.Conn) {
+			return tcpPair(t)
+		}},
+		{name: "pipe", right: func(*testing.T) (io.ReadWriteCloser, net.Conn) {
+			return net.Pipe()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const idle = 100 * time.Millisecond
+
+			client, left := tcpPair(t)
+			right, upstream := tt.right(t)
+			defer upstream.Close()
+			go func() { _, _ = io.Copy(io.Discard, upstream) }()
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := CopyBidirectional(context.Background(), left, right, idle)
+				done <- err
+			}()
+
+			// Keep the tunnel busy for several idle periods.
+			for range 10 {
+				if _, err := client.Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(idle / 4)
+				select {
+				case err := <-done:
+					t.Fatalf("tunnel closed while busy: %v", err)
+				default:
+				}
+			}
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, ErrIdleTimeout) {
+					t.Fatalf("err=%v, want ErrIdleTimeout", err)
+				}
+			case <-time.After(5 * idle):
+				t.Fatal("idle tunnel wasn't closed")
+			}
+		})
+	}
+}
+
+func TestWatchIdleTinyTimeout(t *testing.T) {
+	// Timeouts too short to divide into ticks expire on the first one
+	// rather than panicking.
+	expired := make(chan struct{})
+	go watchIdle(context.Background(), time.Nanosecond, func() uint64 { return 0 }, func() { close(expired) })
+
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("idle watch didn't expire")
+	}
+}
+
+func TestCopyBidirectionalBytesMetric(t *testing.T) {
+	old := tunnelBytesInterval
+	tunnelBytesInterval = 10 * time.Millisecond
+	t.Cleanup(func() { tunnelBytesInterval = old })
+
+	counter := metrics.TunnelBytes.WithLabelValues("bytes-metric", metrics.Upstream)
+	base := testutil.ToFloat64(counter)
+	counted := func() float64 { return testutil.ToFloat64(counter) - base }
+
+	client, left := tcpPair(t)
+	right, upstream := tcpPair(t)
+	ctx := session.NewContext(context.Background(), session.New("bytes-metric", "test", "client"))
+	go func() { _, _ = CopyBidirectional(ctx, left, right, 0) }()
+
+	// Bytes are counted while the tunnel is still open.
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(upstream, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for counted() != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream bytes = %v, want 5", counted())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The rest are counted, once, when it ends.
+	if _, err := client.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	_ = upstream.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for counted() != 8 {
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream bytes = %v, want 8", counted())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
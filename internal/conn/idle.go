@@ -0,0 +1,39 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrIdleTimeout is returned by CopyBidirectional when it closes a tunnel
+// that has been idle for too long.
+var ErrIdleTimeout = errors.New("tunnel idle timeout")
+
+// minIdleTick is the shortest interval at which watchIdle checks, however
+// small the timeout.
+const minIdleTick = time.Millisecond
+
+// watchIdle calls expire if total doesn't change for timeout, checking four
+// times per timeout (but no more often than minIdleTick), until ctx is done.
+func watchIdle(ctx context.Context, timeout time.Duration, total func() uint64, expire func()) {
+	ticker := time.NewTicker(max(timeout/4, minIdleTick))
+	defer ticker.Stop()
+
+	last, lastChange := total(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := total(); n != last {
+				last, lastChange = n, now
+				continue
+			}
+			if now.Sub(lastChange) >= timeout {
+				expire()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package conn
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// meter counts the bytes read from one side of a tunnel while it runs,
+// without defeating the zero-copy fast path.  Sockets whose received byte
+// count the kernel can report are read directly and polled; other sources,
+// which couldn't use the fast path anyway, are read through a counting
+// wrapper.
+type meter struct {
+	n    atomic.Uint64
+	rx   func() uint64
+	base uint64
+}
+
+// newMeter returns a meter for src, and the reader to copy from in its
+// place.
+func newMeter(src io.Reader) (*meter, io.Reader) {
+	if rx, ok := receivedBytes(src); ok {
+		return &meter{rx: rx, base: rx()}, src
+	}
+	m := &meter{}
+	return m, &meterReader{r: src, n: &m.n}
+}
+
+// count returns the number of bytes read so far.
+func (m *meter) count() uint64 {
+	if m.rx == nil {
+		return m.n.Load()
+	}
+	if n := m.rx(); n > m.base {
+		return n - m.base
+	}
+	return 0
+}
+
+type meterReader struct {
+	r io.Reader
+	n *atomic.Uint64
+}
+
+func (r *meterReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n.Add(uint64(n)) //nolint:gosec // n is never negative.
+	return n, err
+}
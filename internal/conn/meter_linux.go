@@ -0,0 +1,70 @@
+//go:build linux
+
+package conn
+
+import (
+	"io"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// receivedBytes returns a function reporting the number of bytes the kernel
+// has received on r, if r is a TCP socket, using TCP_INFO.  The count
+// excludes what is still waiting to be read, so that a baseline taken before
+// copying starts doesn't include data that arrived early.
+//
+// Kernels before 4.1 return a TCP_INFO too short to include the count,
+// which would leave it at 0 however much data flows, so the tunnel would
+// look idle.  It reports false on those, so that reads are counted instead.
+func receivedBytes(r io.Reader) (func() uint64, bool) {
+	tc, ok := r.(*net.TCPConn)
+	if !ok {
+		return nil, false
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+
+	rx := func() (n uint64, ok bool) {
+		_ = rc.Control(func(fd uintptr) {
+			n, ok = tcpBytesReceived(fd)
+			if !ok {
+				return
+			}
+			if queued, err := unix.IoctlGetInt(int(fd), unix.SIOCINQ); err == nil && queued > 0 && uint64(queued) <= n {
+				n -= uint64(queued)
+			}
+		})
+		return n, ok
+	}
+	if _, ok := rx(); !ok {
+		return nil, false
+	}
+	return func() uint64 {
+		n, _ := rx()
+		return n
+	}, true
+}
+
+// tcpBytesReceived returns the tcpi_bytes_received field of fd's TCP_INFO,
+// if the kernel includes it.
+func tcpBytesReceived(fd uintptr) (uint64, bool) {
+	var info unix.TCPInfo
+	sz := uint32(unsafe.Sizeof(info))
+	_, _, e := unix.Syscall6(
+		unix.SYS_GETSOCKOPT,
+		fd,
+		uintptr(unix.IPPROTO_TCP),
+		uintptr(unix.TCP_INFO),
+		uintptr(unsafe.Pointer(&info)), //nolint:gosec // unsafe is needed for syscalls.
+		uintptr(unsafe.Pointer(&sz)),   //nolint:gosec // unsafe is needed for syscalls.
+		0,
+	)
+	if e != 0 || uintptr(sz) < unsafe.Offsetof(info.Bytes_received)+unsafe.Sizeof(info.Bytes_received) {
+		return 0, false
+	}
+	return info.Bytes_received, true
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package conn
+
+import (
+	"io"
+	"testing"
+)
+
+// The kernel's count of received bytes moves as data arrives, so that a
+// busy tunnel doesn't look idle.
+func TestReceivedBytes(t *testing.T) {
+	a, b := tcpPair(t)
+
+	rx, ok := receivedBytes(b)
+	if !ok {
+		t.Skip("TCP_INFO has no received byte count")
+	}
+	base := rx()
+
+	msg := []byte("hello")
+	if _, err := a.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(b, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	if n := rx() - base; n != uint64(len(msg)) {
+		t.Errorf("received %d bytes, want %d", n, len(msg))
+	}
+}
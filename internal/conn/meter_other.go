@@ -0,0 +1,11 @@
+//go:build !linux
+
+package conn
+
+import "io"
+
+// receivedBytes reports false, since only Linux's zero-copy fast path needs
+// sockets to be read unwrapped.
+func receivedBytes(io.Reader) (func() uint64, bool) {
+	return nil, false
+}
@@ -0,0 +1,77 @@
+package conn
+
+import (
+	"context"
+	"sync"
+)
+
+// Tracker counts connections being served, so that shutdown can wait for
+// them to finish.
+//
+// A nil *Tracker is valid and tracks nothing.
+type Tracker struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // Closed when n drops to 0, if anyone is waiting.
+}
+
+// Add records the start of a connection.  The returned function records its
+// end; calling it more than once has no further effect.
+func (t *Tracker) Add() (done func()) {
+	if t == nil {
+		return func() {}
+	}
+
+	t.mu.Lock()
+	t.n++
+	t.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.n--
+			if t.n == 0 && t.idle != nil {
+				close(t.idle)
+				t.idle = nil
+			}
+		})
+	}
+}
+
+// Len returns the number of active connections.
+func (t *Tracker) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.n
+}
+
+// Wait blocks until there are no active connections, or ctx is done, in
+// which case it returns ctx.Err().
+func (t *Tracker) Wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	if t.n == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
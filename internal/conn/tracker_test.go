@@ -0,0 +1,57 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	var tr Tracker
+	if err := tr.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait with no connections: %v", err)
+	}
+
+	done1 := tr.Add()
+	done2 := tr.Add()
+	if n := tr.Len(); n != 2 {
+		t.Fatalf("Len=%d, want 2", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tr.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait with active connections: %v", err)
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- tr.Wait(context.Background()) }()
+
+	done1()
+	done1() // No further effect.
+	if n := tr.Len(); n != 1 {
+		t.Fatalf("Len=%d, want 1", n)
+	}
+	done2()
+
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait didn't return after the last connection finished")
+	}
+}
+
+func TestTrackerNil(t *testing.T) {
+	var tr *Tracker
+	tr.Add()()
+	if n := tr.Len(); n != 0 {
+		t.Fatalf("Len=%d, want 0", n)
+	}
+	if err := tr.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,7 +2,10 @@ package dialer
 
 import (
 	"net"
+	"net/netip"
 	"time"
+
+	"github.com/die-net/conduit/internal/tlsconfig"
 )
 
 // Config controls timeouts and TCP keepalive settings used by outbound dialers.
@@ -20,4 +23,28 @@ type Config struct {
 	// SSHKnownHostsPath is the path to the known_hosts file for SSH host key
 	// verification. Empty string disables host key checking.
 	SSHKnownHostsPath string
+	// TLS configures the TLS connection to an https:// or socks5+tls://
+	// upstream proxy. Query parameters on the upstream URL override these
+	// settings.
+	TLS tlsconfig.Options
+	// HTTP2 enables HTTP/2 to an https:// upstream proxy, multiplexing
+	// CONNECT tunnels as streams over a shared connection.
+	HTTP2 bool
+	// Resolver, if set, resolves hostnames for direct dials (including to
+	// upstream proxies) instead of the system resolver.
+	Resolver *net.Resolver
+	// PublicOnly makes direct dialers refuse destinations that aren't
+	// public addresses, other than those within PublicExceptions.  New
+	// doesn't apply it to the connection to an upstream proxy, which is
+	// trusted.
+	PublicOnly       bool
+	PublicExceptions []netip.Prefix
+	// Mark, if nonzero, is set as SO_MARK on every socket dialed directly,
+	// including those to upstream proxies, so that firewall rules can keep
+	// them from being redirected back to a transparent proxy.  It's only
+	// supported on Linux.
+	Mark uint32
+	// ProxyAuth, if set, authenticates to an http:// or https:// upstream
+	// proxy instead of the username and password from its URL.
+	ProxyAuth ProxyAuthenticator
 }
@@ -2,25 +2,148 @@ package dialer
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/die-net/conduit/internal/acl"
 )
 
 type directDialer struct {
 	dialer         net.Dialer
 	defaultNetwork string
 	keepAlive      net.KeepAliveConfig
+	mark           uint32
+
+	publicOnly bool
+	exceptions []netip.Prefix
+	checkACL   bool
 }
 
+var errMarkUnsupported = errors.New("outbound mark is only supported on Linux")
+
 // NewDirectDialer returns a Dialer that dials destination addresses directly.
+//
+// With cfg.PublicOnly, it resolves hostnames itself and refuses them if any
+// of their addresses isn't public, and then checks the address each
+// connection is actually made to (in net.Dialer.Control), so that a DNS
+// answer that changes in between can't get around it.
+//
+// With cfg.Mark, it sets SO_MARK on each socket.
+//
+// If the dial's context is from acl.NewContext, the address each connection
+// is made to is checked against the ACL's IP rules the same way.
 func NewDirectDialer(cfg Config) (ContextDialer, error) {
+	return newDirectDialer(cfg, true)
+}
+
+// newProxyServerDialer returns a direct dialer for connecting to a proxy
+// server.  It ignores ACLs in dial contexts, which apply to the proxy's
+// destinations rather than the proxy itself.
+func newProxyServerDialer(cfg Config) (ContextDialer, error) {
+	return newDirectDialer(cfg, false)
+}
+
+func newDirectDialer(cfg Config, checkACL bool) (ContextDialer, error) {
+	if cfg.Mark != 0 && !markSupported {
+		return nil, errMarkUnsupported
+	}
 	dd := &directDialer{
-		dialer:         net.Dialer{Timeout: cfg.DialTimeout},
+		dialer:         net.Dialer{Timeout: cfg.DialTimeout, Resolver: cfg.Resolver},
 		defaultNetwork: defaultNetwork(),
 		keepAlive:      cfg.KeepAlive,
+		mark:           cfg.Mark,
+		publicOnly:     cfg.PublicOnly,
+		exceptions:     cfg.PublicExceptions,
+		checkACL:       checkACL,
+	}
+	if dd.publicOnly || dd.mark != 0 || dd.checkACL {
+		dd.dialer.ControlContext = dd.control
 	}
 	return dd, nil
 }
 
+// MarkControl returns a net.Dialer Control function that sets SO_MARK to
+// mark on each socket, or nil if mark is 0.
+func MarkControl(mark uint32) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(_, _ string, c syscall.RawConn) error {
+		return setMark(c, mark)
+	}
+}
+
+// control marks each socket, if configured, and refuses to connect to an
+// address that isn't public, if configured, or that the ACL in ctx denies.
+func (f *directDialer) control(ctx context.Context, network, address string, c syscall.RawConn) error {
+	if f.mark != 0 {
+		if err := setMark(c, f.mark); err != nil {
+			return err
+		}
+	}
+	if f.publicOnly {
+		if err := f.controlPublic(network, address, c); err != nil {
+			return err
+		}
+	}
+	if f.checkACL {
+		if ap, err := netip.ParseAddrPort(address); err == nil {
+			return acl.CheckConnect(ctx, ap.Addr())
+		}
+	}
+	return nil
+}
+
+// controlPublic refuses to connect to an address that isn't public.
+func (f *directDialer) controlPublic(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrNotPublic, address)
+	}
+	return checkPublic(ap.Addr(), f.exceptions)
+}
+
+// checkHost resolves host and returns an error if any of its addresses
+// isn't public.
+func (f *directDialer) checkHost(ctx context.Context, network, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return checkPublic(addr, f.exceptions)
+	}
+
+	if f.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.dialer.Timeout)
+		defer cancel()
+	}
+	addrs, err := f.dialer.Resolver.LookupNetIP(ctx, ipNetwork(network), host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := checkPublic(addr, f.exceptions); err != nil {
+			return fmt.Errorf("%s: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// ipNetwork returns the network to resolve a host in for dialing it over
+// network: "ip4" or "ip6" for a network restricted to one IP family, or
+// else "ip".
+func ipNetwork(network string) string {
+	switch network {
+	case "tcp4", "udp4":
+		return "ip4"
+	case "tcp6", "udp6":
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
 // DialContext does DNS lookups and TCP connect() and returns a plain
 // net.Conn to the destination.  For TCP connections it will also:
 //   - normalize network "tcp" to "tcp4" or "tcp6" when only one IP family is
@@ -28,6 +151,7 @@ func NewDirectDialer(cfg Config) (ContextDialer, error) {
 //   - enforce fully-qualified DNS lookups by appending a trailing '.' to
 //     hostnames, avoiding unnecessary DNS lookups for the DNS search path.
 //   - apply the configured TCP keepalive
+//   - refuse non-public destinations, if configured
 func (f *directDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	// Don't bother doing DNS lookups for protocols we don't support.
 	if network == "tcp" {
@@ -38,7 +162,13 @@ func (f *directDialer) DialContext(ctx context.Context, network, address string)
 	// hostnames, disabling search-path.
 	if host, port, err := net.SplitHostPort(address); err == nil && host != "" && port != "" {
 		if net.ParseIP(host) == nil && host[len(host)-1:] != "." {
-			address = net.JoinHostPort(host+".", port)
+			host += "."
+			address = net.JoinHostPort(host, port)
+		}
+		if f.publicOnly {
+			if err := f.checkHost(ctx, network, host); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -0,0 +1,47 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/die-net/conduit/internal/acl"
+	"github.com/die-net/conduit/internal/testutil"
+)
+
+// An ACL's IP rules are checked on the address actually connected to, in
+// case DNS gives a different answer than when the ACL was checked, but not
+// when connecting to a proxy server.
+func TestDirectDialerACL(t *testing.T) {
+	t.Parallel()
+
+	ln, stop := testutil.StartEchoTCPServer(t.Context(), t)
+	t.Cleanup(stop)
+	addr := ln.Addr().String()
+
+	a := &acl.ACL{
+		Rules:   []acl.Rule{{Action: acl.Deny, IPs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}},
+		Default: acl.Allow,
+	}
+	ctx := acl.NewContext(context.Background(), a, acl.Request{Target: addr})
+
+	d, err := NewDirectDialer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(ctx, "tcp", addr); !errors.Is(err, acl.ErrDenied) {
+		t.Fatalf("DialContext(%s) err = %v, want ErrDenied", addr, err)
+	}
+
+	d, err = newProxyServerDialer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testutil.AssertEcho(t, c, c, []byte("hello"))
+}
@@ -0,0 +1,34 @@
+package dialer
+
+import (
+	"context"
+	"net"
+
+	"github.com/die-net/conduit/internal/hosts"
+)
+
+// HostsDialer is a ContextDialer that applies host overrides to each
+// destination address before dialing it with another dialer, so that the
+// overrides apply before routing and DNS.
+//
+// It deliberately has no Unwrap method: a dialer that bypasses it (such as
+// the HTTP proxy's forwarding of non-CONNECT requests as-is) would ignore
+// the overrides.
+type HostsDialer struct {
+	hosts hosts.Map
+	d     ContextDialer
+}
+
+// NewHostsDialer returns a dialer that applies m to addresses before
+// dialing them with d, or d itself if m is empty.
+func NewHostsDialer(m hosts.Map, d ContextDialer) ContextDialer {
+	if len(m) == 0 {
+		return d
+	}
+	return &HostsDialer{hosts: m, d: d}
+}
+
+// DialContext dials the rewritten address via the wrapped dialer.
+func (h *HostsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return h.d.DialContext(ctx, network, h.hosts.Rewrite(address))
+}
@@ -0,0 +1,270 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// newHTTP2Transport returns an http.Transport that only speaks HTTP/2 over
+// TLS, for sending CONNECT requests to an HTTPS proxy as streams over a
+// shared connection.
+//
+// The Transport handles pooling: streams are multiplexed over one long-lived
+// connection per proxy, a new connection is opened if the proxy's stream
+// limit is reached, and dead connections are detected via pings and
+// replaced.
+//
+// Connections are made by dialHTTP2TLS, so that a proxy that doesn't speak
+// HTTP/2 is reported as such.
+func newHTTP2Transport(f *HTTPProxyDialer) *http.Transport {
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+
+	return &http.Transport{
+		DialTLSContext: f.dialHTTP2TLS,
+		Protocols:      &protocols,
+		HTTP2: &http.HTTP2Config{
+			SendPingTimeout: 30 * time.Second,
+			PingTimeout:     15 * time.Second,
+		},
+	}
+}
+
+// errNoHTTP2 is returned when an https:// proxy configured for HTTP/2 doesn't
+// negotiate it.
+var errNoHTTP2 = errors.New("proxy did not negotiate h2")
+
+// dialHTTP2TLS connects to the proxy and performs the TLS handshake,
+// offering both HTTP/2 and HTTP/1.1 via ALPN so that a proxy only speaking
+// HTTP/1.1 completes the handshake and can be reported with errNoHTTP2,
+// rather than as a TLS alert.
+func (f *HTTPProxyDialer) dialHTTP2TLS(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := f.direct.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := f.tlsConfig.Clone()
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+	tc := tls.Client(c, cfg)
+
+	hctx := ctx
+	if f.cfg.NegotiationTimeout > 0 {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithTimeout(ctx, f.cfg.NegotiationTimeout)
+		defer cancel()
+	}
+	if err := tc.HandshakeContext(hctx); err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	if tc.ConnectionState().NegotiatedProtocol != "h2" {
+		_ = tc.Close()
+		return nil, errNoHTTP2
+	}
+	return tc, nil
+}
+
+// dialHTTP2 opens a CONNECT stream to address over the shared HTTP/2
+// connection to the proxy, answering any 407 challenges with new streams.
+func (f *HTTPProxyDialer) dialHTTP2(ctx context.Context, address string) (net.Conn, error) {
+	var challenge *http.Response
+	for round := 1; ; round++ {
+		c, resp, err := f.dialHTTP2Stream(ctx, address, challenge, round < MaxAuthRounds)
+		if c != nil || err != nil {
+			return c, err
+		}
+		challenge = resp
+	}
+}
+
+// dialHTTP2Stream sends one CONNECT request, authorized in response to
+// challenge if non-nil. If the proxy responds 407 and retry is set, the
+// response is returned (with its body closed) so that it can be answered.
+func (f *HTTPProxyDialer) dialHTTP2Stream(ctx context.Context, address string, challenge *http.Response, retry bool) (net.Conn, *http.Response, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: f.proxyURL.Host},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	ok, err := f.authorize(req, challenge)
+	if err != nil {
+		return nil, nil, err
+	}
+	if challenge != nil && !ok {
+		return nil, nil, fmt.Errorf("http2 proxy connect failed: %s", challenge.Status)
+	}
+
+	pr, pw := io.Pipe()
+
+	// The stream lives as long as its request context, so it can't be ctx.
+	// Instead, cancel the stream if ctx is canceled or NegotiationTimeout
+	// expires before the proxy responds.
+	sctx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		cancel(context.Cause(ctx))
+	})
+	var timer *time.Timer
+	if f.cfg.NegotiationTimeout > 0 {
+		timer = time.AfterFunc(f.cfg.NegotiationTimeout, func() {
+			cancel(errNegotiationTimeout)
+		})
+	}
+
+	c := &http2StreamConn{pw: pw, cancel: cancel}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.localAddr = info.Conn.LocalAddr()
+			c.remoteAddr = info.Conn.RemoteAddr()
+		},
+	}
+
+	req.Body = pr
+	req = req.WithContext(httptrace.WithClientTrace(sctx, trace))
+
+	resp, err := f.h2.RoundTrip(req)
+	stopped := stop()
+	if timer != nil {
+		stopped = timer.Stop() && stopped
+	}
+	if err == nil && !stopped {
+		// We raced with cancellation, which tears down the stream.
+		_ = resp.Body.Close()
+		err = sctx.Err()
+	}
+	if err != nil {
+		if sctx.Err() != nil {
+			err = context.Cause(sctx)
+		}
+		cancel(nil)
+		_ = pw.Close()
+		return nil, nil, fmt.Errorf("http2 proxy connect: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		_ = resp.Body.Close()
+		cancel(nil)
+		_ = pw.Close()
+		if resp.StatusCode == http.StatusProxyAuthRequired && f.auth != nil && retry {
+			return nil, resp, nil
+		}
+		return nil, nil, fmt.Errorf("http2 proxy connect failed: %s", resp.Status)
+	}
+
+	c.body = resp.Body
+	return c, nil, nil
+}
+
+// http2StreamConn adapts an HTTP/2 CONNECT stream to a net.Conn.
+//
+// Writes are sent as DATA frames on the request body, and reads come from
+// the response body.
+type http2StreamConn struct {
+	body       io.ReadCloser
+	pw         *io.PipeWriter
+	cancel     context.CancelCauseFunc
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	mu                    sync.Mutex
+	readTimer, writeTimer *time.Timer
+	expired               atomic.Bool
+}
+
+var errNegotiationTimeout = errors.New("negotiation timeout")
+
+func (c *http2StreamConn) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *http2StreamConn) Write(p []byte) (int, error) {
+	n, err := c.pw.Write(p)
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the stream by ending the request body.
+func (c *http2StreamConn) CloseWrite() error {
+	return c.pw.Close()
+}
+
+// Close resets the stream. The shared connection to the proxy stays open.
+func (c *http2StreamConn) Close() error {
+	c.setTimer(&c.readTimer, time.Time{})
+	c.setTimer(&c.writeTimer, time.Time{})
+	_ = c.pw.Close()
+	err := c.body.Close()
+	c.cancel(nil)
+	return err
+}
+
+func (c *http2StreamConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *http2StreamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// SetDeadline sets the read and write deadlines.
+//
+// A blocked stream can't be unblocked without resetting it, so once either
+// deadline passes the stream is reset, and all reads and writes fail with
+// os.ErrDeadlineExceeded from then on.  Extending or clearing a deadline
+// before it passes leaves the stream usable.
+func (c *http2StreamConn) SetDeadline(t time.Time) error {
+	c.setTimer(&c.readTimer, t)
+	c.setTimer(&c.writeTimer, t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline, as described for SetDeadline.
+func (c *http2StreamConn) SetReadDeadline(t time.Time) error {
+	c.setTimer(&c.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline, as described for SetDeadline.
+func (c *http2StreamConn) SetWriteDeadline(t time.Time) error {
+	c.setTimer(&c.writeTimer, t)
+	return nil
+}
+
+// setTimer replaces *timer with one that expires the stream at t, or with
+// none if t is zero.
+func (c *http2StreamConn) setTimer(timer **time.Timer, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() && !c.expired.Load() {
+		*timer = time.AfterFunc(time.Until(t), c.expire)
+	}
+}
+
+// expire resets the stream when a deadline passes.
+func (c *http2StreamConn) expire() {
+	c.expired.Store(true)
+	_ = c.pw.CloseWithError(os.ErrDeadlineExceeded)
+	c.cancel(os.ErrDeadlineExceeded)
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
@@ -17,15 +16,23 @@ import (
 // HTTPProxyDialer dials outbound TCP connections via an HTTP or HTTPS proxy
 // using the HTTP CONNECT method.
 type HTTPProxyDialer struct {
-	cfg      Config
-	proxyURL *url.URL
-	auth     string
-	direct   ContextDialer
+	cfg       Config
+	proxyURL  *url.URL
+	auth      ProxyAuthenticator
+	direct    ContextDialer
+	tlsConfig *tls.Config
+	h2        *http.Transport
 }
 
 // NewHTTPProxyDialer constructs an HTTP CONNECT dialer for proxyURL.
 //
-// If username is non-empty, Proxy-Authorization is set using HTTP Basic auth.
+// If cfg.ProxyAuth is set, it authenticates to the proxy.  Otherwise, if
+// username is non-empty, Basic or Digest auth is used, as the proxy requests.
+//
+// For https:// proxies, cfg.TLS configures client certificates, trusted CAs,
+// SPKI pins and the SNI name used for the connection to the proxy. If
+// cfg.HTTP2 is set, HTTP/2 is negotiated with the proxy via ALPN and CONNECT
+// tunnels are multiplexed as streams over a shared connection.
 func NewHTTPProxyDialer(cfg Config, proxyURL *url.URL, username, password string) (ContextDialer, error) {
 	if proxyURL == nil {
 		return nil, errors.New("http proxy dialer: missing proxy url")
@@ -37,22 +44,37 @@ func NewHTTPProxyDialer(cfg Config, proxyURL *url.URL, username, password string
 		return nil, fmt.Errorf("http proxy dialer: unsupported scheme: %q", proxyURL.Scheme)
 	}
 
-	direct, err := NewDirectDialer(cfg)
+	direct, err := newProxyServerDialer(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	auth := ""
-	if username != "" {
-		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	var tlsConfig *tls.Config
+	if proxyURL.Scheme == "https" {
+		tlsConfig, err = cfg.TLS.ClientConfig(proxyURL.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("http proxy dialer: %w", err)
+		}
+	} else if !cfg.TLS.IsZero() || cfg.HTTP2 {
+		return nil, errors.New("http proxy dialer: tls and http2 options require an https proxy")
+	}
+
+	auth := cfg.ProxyAuth
+	if auth == nil && username != "" {
+		auth = NewPasswordAuthenticator(username, password)
 	}
 
-	return &HTTPProxyDialer{
-		cfg:      cfg,
-		proxyURL: proxyURL,
-		auth:     auth,
-		direct:   direct,
-	}, nil
+	f := &HTTPProxyDialer{
+		cfg:       cfg,
+		proxyURL:  proxyURL,
+		auth:      auth,
+		direct:    direct,
+		tlsConfig: tlsConfig,
+	}
+	if cfg.HTTP2 {
+		f.h2 = newHTTP2Transport(f)
+	}
+	return f, nil
 }
 
 // ProxyAddr returns the proxy host:port.
@@ -65,16 +87,58 @@ func (f *HTTPProxyDialer) ProxyURL() *url.URL {
 	return f.proxyURL
 }
 
+// Authenticator returns the ProxyAuthenticator used with the proxy, or nil
+// if none is configured.
+func (f *HTTPProxyDialer) Authenticator() ProxyAuthenticator {
+	return f.auth
+}
+
+// Close closes the idle HTTP/2 connections to the proxy, if any, so it
+// should be called once the tunnels through them have ended.
+func (f *HTTPProxyDialer) Close() error {
+	if f.h2 != nil {
+		f.h2.CloseIdleConnections()
+	}
+	return nil
+}
+
 // Direct returns the underlying direct dialer used to reach the proxy.
 func (f *HTTPProxyDialer) Direct() ContextDialer {
 	return f.direct
 }
 
+// DialProxy connects to the proxy itself, performing the TLS handshake for
+// HTTPS proxies. The returned connection is ready for HTTP requests.
+func (f *HTTPProxyDialer) DialProxy(ctx context.Context, network string) (net.Conn, error) {
+	c, err := f.direct.DialContext(ctx, network, f.proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy: %w", err)
+	}
+
+	if f.tlsConfig == nil {
+		return c, nil
+	}
+
+	tlsConn := tls.Client(c, f.tlsConfig)
+	if f.cfg.NegotiationTimeout > 0 {
+		_ = tlsConn.SetDeadline(time.Now().Add(f.cfg.NegotiationTimeout))
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = tlsConn.Close()
+		return nil, fmt.Errorf("http proxy connect tls handshake: %w", err)
+	}
+	if f.cfg.NegotiationTimeout > 0 {
+		_ = tlsConn.SetDeadline(time.Time{})
+	}
+	return tlsConn, nil
+}
+
 // DialContext establishes a TCP connection to address via the configured
 // HTTP/HTTPS proxy, returned as a net.Conn.
 //
 // For HTTPS proxies, this performs a TLS handshake to the proxy before sending
-// CONNECT.
+// CONNECT.  With HTTP2 enabled, CONNECT is instead sent as a new stream on a
+// shared HTTP/2 connection to the proxy, which is established if needed.
 //
 // CONNECT negotiation is performed synchronously before returning.
 //
@@ -85,57 +149,95 @@ func (f *HTTPProxyDialer) DialContext(ctx context.Context, network, address stri
 		return nil, fmt.Errorf("http proxy dial %s %s: unsupported network", network, address)
 	}
 
-	c, err := f.direct.DialContext(ctx, network, f.proxyURL.Host)
+	if f.h2 != nil {
+		return f.dialHTTP2(ctx, address)
+	}
+
+	c, err := f.DialProxy(ctx, network)
 	if err != nil {
-		return nil, fmt.Errorf("http proxy: %w", err)
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+
+	req := newConnectRequest(address)
+	if _, err := f.authorize(req, nil); err != nil {
+		_ = c.Close()
+		return nil, err
 	}
 
-	if strings.EqualFold(f.proxyURL.Scheme, "https") {
-		hostname := f.proxyURL.Hostname()
-		tlsConn := tls.Client(c, &tls.Config{MinVersion: tls.VersionTLS12, ServerName: hostname})
+	for round := 1; ; round++ {
 		if f.cfg.NegotiationTimeout > 0 {
-			_ = tlsConn.SetDeadline(time.Now().Add(f.cfg.NegotiationTimeout))
+			_ = c.SetDeadline(time.Now().Add(f.cfg.NegotiationTimeout))
+		}
+
+		if err := req.Write(c); err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("http proxy connect write: %w", err)
+		}
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("http proxy connect read: %w", err)
+		}
+
+		if resp.StatusCode == http.StatusProxyAuthRequired && round < MaxAuthRounds {
+			next := newConnectRequest(address)
+			ok, err := f.authorize(next, resp)
+			if err != nil {
+				_ = resp.Body.Close()
+				_ = c.Close()
+				return nil, err
+			}
+			if ok {
+				req = next
+				// Retry on the same connection if the proxy keeps it
+				// open and the body is small enough to drain, else on a
+				// new one.
+				if DrainChallenge(resp) && !resp.Close && br.Buffered() == 0 {
+					continue
+				}
+				_ = c.Close()
+				if c, err = f.DialProxy(ctx, network); err != nil {
+					return nil, err
+				}
+				br = bufio.NewReader(c)
+				continue
+			}
 		}
-		if err := tlsConn.HandshakeContext(ctx); err != nil {
-			_ = tlsConn.Close()
-			return nil, fmt.Errorf("http proxy connect tls handshake: %w", err)
+
+		_ = resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			_ = c.Close()
+			return nil, fmt.Errorf("http proxy connect failed: %s", resp.Status)
 		}
-		c = tlsConn
+		break
+	}
+
+	if f.cfg.NegotiationTimeout > 0 {
+		_ = c.SetDeadline(time.Time{})
 	}
+	return c, nil
+}
 
-	req := &http.Request{
+func newConnectRequest(address string) *http.Request {
+	return &http.Request{
 		Method: http.MethodConnect,
 		URL:    &url.URL{Opaque: address},
 		Host:   address,
 		Header: make(http.Header),
 	}
-	if f.auth != "" {
-		req.Header.Set("Proxy-Authorization", f.auth)
-	}
-
-	if f.cfg.NegotiationTimeout > 0 {
-		_ = c.SetDeadline(time.Now().Add(f.cfg.NegotiationTimeout))
-	}
+}
 
-	if err := req.Write(c); err != nil {
-		_ = c.Close()
-		return nil, fmt.Errorf("http proxy connect write: %w", err)
+// authorize sets Proxy-Authorization on req, given the proxy's challenge to
+// the previous attempt, if any.  It reports whether a header was set.
+func (f *HTTPProxyDialer) authorize(req *http.Request, challenge *http.Response) (bool, error) {
+	if f.auth == nil {
+		return false, nil
 	}
-
-	br := bufio.NewReader(c)
-	resp, err := http.ReadResponse(br, req)
+	ok, err := SetProxyAuthorization(f.auth, req, challenge)
 	if err != nil {
-		_ = c.Close()
-		return nil, fmt.Errorf("http proxy connect read: %w", err)
-	}
-	_ = resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		_ = c.Close()
-		return nil, fmt.Errorf("http proxy connect failed: %s", resp.Status)
-	}
-
-	if f.cfg.NegotiationTimeout > 0 {
-		_ = c.SetDeadline(time.Time{})
+		return false, fmt.Errorf("http proxy auth: %w", err)
 	}
-	return c, nil
+	return ok, nil
 }
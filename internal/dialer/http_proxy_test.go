@@ -3,15 +3,21 @@ package dialer
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/die-net/conduit/internal/testutil"
+	"github.com/die-net/conduit/internal/tlsconfig"
 )
 
 func TestHTTPProxyDialerDialSuccess(t *testing.T) {
@@ -146,3 +152,395 @@ func TestHTTPProxyDialerDialNon2xx(t *testing.T) {
 
 	waitUp()
 }
+
+func TestHTTPProxyDialerTLS(t *testing.T) {
+	t.Parallel()
+
+	certs := testutil.NewTLSCerts(t)
+
+	tests := []struct {
+		name          string
+		requireClient bool
+		opts          tlsconfig.Options
+		wantSNI       string
+		wantErr       bool
+	}{
+		{
+			name:    "private ca",
+			opts:    tlsconfig.Options{CAFile: certs.CAFile},
+			wantSNI: "",
+		},
+		{
+			name:          "mutual tls",
+			requireClient: true,
+			opts:          tlsconfig.Options{CAFile: certs.CAFile, CertFile: certs.ClientCertFile, KeyFile: certs.ClientKeyFile},
+		},
+		{
+			name:          "mutual tls missing client cert",
+			requireClient: true,
+			opts:          tlsconfig.Options{CAFile: certs.CAFile},
+			wantErr:       true,
+		},
+		{
+			name:    "system roots reject private ca",
+			wantErr: true,
+		},
+		{
+			name: "pin matches ca",
+			opts: tlsconfig.Options{CAFile: certs.CAFile, Pins: []string{tlsconfig.SPKIPin(certs.CA)}},
+		},
+		{
+			name:    "pin mismatch",
+			opts:    tlsconfig.Options{CAFile: certs.CAFile, Pins: []string{"sha256//" + tlsconfig.SPKIPin(certs.Client.Leaf)}},
+			wantErr: true,
+		},
+		{
+			name:    "sni override",
+			opts:    tlsconfig.Options{CAFile: certs.CAFile, ServerName: "localhost"},
+			wantSNI: "localhost",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			gotSNI := make(chan string, 1)
+			serverCfg := certs.ServerConfig(tt.requireClient)
+			serverCfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				gotSNI <- hello.ServerName
+				return nil, nil
+			}
+
+			upLn, waitUp := testutil.StartAcceptServer(ctx, t, func(c net.Conn) {
+				tc := tls.Server(c, serverCfg)
+				br := bufio.NewReader(tc)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				_ = req.Body.Close()
+				_, _ = io.WriteString(tc, "HTTP/1.1 200 Connection Established\r\n\r\n")
+			})
+
+			proxyURL, err := url.Parse("https://" + upLn.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := NewHTTPProxyDialer(Config{DialTimeout: 2 * time.Second, NegotiationTimeout: 2 * time.Second, TLS: tt.opts}, proxyURL, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := d.DialContext(ctx, "tcp", "127.0.0.1:1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err=%v wantErr=%v", err, tt.wantErr)
+			}
+			if conn != nil {
+				_ = conn.Close()
+			}
+			waitUp()
+
+			if sni := <-gotSNI; sni != tt.wantSNI {
+				t.Fatalf("got SNI %q want %q", sni, tt.wantSNI)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyDialerHTTP2(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	certs := testutil.NewTLSCerts(t)
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	var newConns atomic.Int32
+	var gotAuth atomic.Value
+	srv := &http.Server{
+		ReadHeaderTimeout: 2 * time.Second,
+		TLSConfig:         certs.ServerConfig(false),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				newConns.Add(1)
+			}
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect || r.ProtoMajor != 2 {
+				http.Error(w, "expected HTTP/2 CONNECT", http.StatusBadRequest)
+				return
+			}
+			gotAuth.Store(r.Header.Get("Proxy-Authorization"))
+
+			d := net.Dialer{}
+			dst, err := d.DialContext(r.Context(), "tcp", r.Host)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer dst.Close()
+
+			w.WriteHeader(http.StatusOK)
+			_ = http.NewResponseController(w).Flush()
+
+			go func() {
+				_, _ = io.Copy(dst, r.Body)
+				_ = dst.(*net.TCPConn).CloseWrite()
+			}()
+			buf := make([]byte, 1024)
+			for {
+				n, err := dst.Read(buf)
+				if n > 0 {
+					_, _ = w.Write(buf[:n])
+					_ = http.NewResponseController(w).Flush()
+				}
+				if err != nil {
+					return
+				}
+			}
+		}),
+	}
+
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	defer srv.Close()
+
+	d, err := New(Config{
+		DialTimeout:        2 * time.Second,
+		NegotiationTimeout: 2 * time.Second,
+		TLS:                tlsconfig.Options{CAFile: certs.CAFile},
+	}, "https://user:pass@"+ln.Addr().String()+"?h2=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		conn, err := d.DialContext(ctx, "tcp", echoLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutil.AssertEcho(t, conn, conn, []byte("hello"))
+		_ = conn.Close()
+	}
+
+	if n := newConns.Load(); n != 1 {
+		t.Fatalf("expected streams to share 1 connection, got %d", n)
+	}
+	exp := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	if got := gotAuth.Load(); got != exp {
+		t.Fatalf("expected %q got %q", exp, got)
+	}
+
+	// Deadlines cleared before they pass leave the stream usable, and ones
+	// that pass reset it.
+	conn, err := d.DialContext(ctx, "tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEcho(t, conn, conn, []byte("hello"))
+
+	conn, err = d.DialContext(ctx, "tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	// A non-2xx response to CONNECT is an error.
+	if _, err := d.DialContext(ctx, "tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestHTTPProxyDialerHTTP2NotNegotiated(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	certs := testutil.NewTLSCerts(t)
+
+	// An HTTPS proxy that only speaks HTTP/1.1.
+	srv := &http.Server{
+		ReadHeaderTimeout: 2 * time.Second,
+		TLSConfig:         certs.ServerConfig(false),
+		TLSNextProto:      map[string]func(*http.Server, *tls.Conn, http.Handler){},
+		Handler:           http.NotFoundHandler(),
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	defer srv.Close()
+
+	d, err := New(Config{
+		DialTimeout:        2 * time.Second,
+		NegotiationTimeout: 2 * time.Second,
+		TLS:                tlsconfig.Options{CAFile: certs.CAFile},
+	}, "https://"+ln.Addr().String()+"?h2=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(ctx, "tcp", "127.0.0.1:1"); !errors.Is(err, errNoHTTP2) {
+		t.Fatalf("expected %v, got %v", errNoHTTP2, err)
+	}
+}
+
+func TestHTTPProxyDialerDigestAuth(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepAlive bool
+	}{
+		{name: "same connection", keepAlive: true},
+		{name: "new connection", keepAlive: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			const nonce = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+			var conns, challenges atomic.Int32
+
+			upLn, waitUp := testutil.StartAcceptServer(ctx, t, func(c net.Conn) {
+				conns.Add(1)
+				br := bufio.NewReader(c)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					_ = req.Body.Close()
+
+					if validDigest(req, nonce, "user", "pass") {
+						_, _ = io.WriteString(c, "HTTP/1.1 200 Connection Established\r\n\r\n")
+						return
+					}
+
+					challenges.Add(1)
+					conn := ""
+					if !tt.keepAlive {
+						conn = "Connection: close\r\n"
+					}
+					_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+conn+
+						`Proxy-Authenticate: Basic realm="proxy", Digest realm="proxy", qop="auth", algorithm=SHA-256, nonce="`+nonce+`"`+"\r\n"+
+						"Content-Length: 6\r\n\r\ndenied")
+					if !tt.keepAlive {
+						return
+					}
+				}
+			})
+
+			proxyURL, err := url.Parse("http://" + upLn.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := NewHTTPProxyDialer(Config{DialTimeout: 2 * time.Second, NegotiationTimeout: 2 * time.Second}, proxyURL, "user", "pass")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for range 2 {
+				conn, err := d.DialContext(ctx, "tcp", "127.0.0.1:1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = conn.Close()
+			}
+			waitUp()
+
+			// The first dial is challenged once; the second reuses the
+			// challenge preemptively.
+			if n := challenges.Load(); n != 1 {
+				t.Errorf("expected 1 challenge, got %d", n)
+			}
+			wantConns := int32(2)
+			if !tt.keepAlive {
+				wantConns = 3
+			}
+			if n := conns.Load(); n != wantConns {
+				t.Errorf("expected %d connections, got %d", wantConns, n)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyDialerAuthRejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var challenges atomic.Int32
+	upLn, waitUp := testutil.StartAcceptServer(ctx, t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			_ = req.Body.Close()
+			challenges.Add(1)
+			_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Digest realm=\"proxy\", nonce=\"abc\"\r\nContent-Length: 0\r\n\r\n")
+		}
+	})
+
+	proxyURL, err := url.Parse("http://" + upLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewHTTPProxyDialer(Config{DialTimeout: 2 * time.Second, NegotiationTimeout: 2 * time.Second}, proxyURL, "user", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.DialContext(ctx, "tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("expected error")
+	}
+	waitUp()
+
+	// Basic preemptively, then Digest once; the same nonce isn't retried.
+	if n := challenges.Load(); n != 2 {
+		t.Fatalf("expected 2 challenges, got %d", n)
+	}
+}
+
+// validDigest reports whether req carries a correct Digest
+// Proxy-Authorization for nonce, username and password.
+func validDigest(req *http.Request, nonce, username, password string) bool {
+	cs := parseChallenges(req.Header.Values("Proxy-Authorization"))
+	if len(cs) != 1 || cs[0].scheme != "Digest" {
+		return false
+	}
+	p := cs[0].params
+	if p["nonce"] != nonce || p["username"] != username || p["uri"] != req.Host {
+		return false
+	}
+	d, ok := newDigestChallenge(p)
+	if !ok {
+		return false
+	}
+	return p["response"] == d.response(username, password, req.Method, p["uri"], p["nc"], p["cnonce"])
+}
@@ -0,0 +1,118 @@
+package dialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/die-net/conduit/internal/metrics"
+)
+
+// Instrumented is a ContextDialer that records the latency and errors of
+// each dial in metrics, labeled with the upstream's name, and keeps track of
+// the most recent outcomes as a passive health check.
+type Instrumented struct {
+	name string
+	d    ContextDialer
+
+	mu     sync.Mutex
+	status DialStatus
+}
+
+// DialStatus describes an upstream's most recent dials.
+type DialStatus struct {
+	// LastSuccess is when a dial last succeeded.
+	LastSuccess time.Time
+	// LastFailure is when a dial last failed, other than by being
+	// canceled, and Error is how.
+	LastFailure time.Time
+	Error       string
+}
+
+// NewInstrumented wraps d, recording its dials against the upstream name.
+func NewInstrumented(name string, d ContextDialer) *Instrumented {
+	return &Instrumented{name: name, d: d}
+}
+
+// DialContext dials address via the wrapped dialer.
+func (i *Instrumented) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	c, err := i.d.DialContext(ctx, network, address)
+	metrics.DialDuration.WithLabelValues(i.name).Observe(time.Since(start).Seconds())
+	now := time.Now()
+	if err == nil {
+		i.mu.Lock()
+		i.status.LastSuccess = now
+		i.mu.Unlock()
+		return c, nil
+	}
+
+	class := metrics.ErrorClass(err)
+	metrics.DialErrors.WithLabelValues(i.name, class).Inc()
+	if class != "canceled" {
+		i.mu.Lock()
+		i.status.LastFailure = now
+		i.status.Error = err.Error()
+		i.mu.Unlock()
+	}
+	return c, err
+}
+
+// Status returns the outcomes of the most recent dials.
+func (i *Instrumented) Status() DialStatus {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.status
+}
+
+// Name returns the upstream name.
+func (i *Instrumented) Name() string {
+	return i.name
+}
+
+// Unwrap returns the wrapped dialer.
+func (i *Instrumented) Unwrap() ContextDialer {
+	return i.d
+}
+
+// Unwrap returns the dialer underneath any wrappers (such as Instrumented)
+// around d.
+func Unwrap(d ContextDialer) ContextDialer {
+	for {
+		u, ok := d.(interface{ Unwrap() ContextDialer })
+		if !ok {
+			return d
+		}
+		d = u.Unwrap()
+	}
+}
+
+// Close closes the wrapped dialer, if it holds connections that can be
+// closed, such as to an SSH server or an HTTP/2 proxy.
+func (i *Instrumented) Close() error {
+	if c, ok := i.d.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// UpstreamName returns the name of the upstream d would use to dial address:
+// that of the Instrumented dialer it is, or that a Router would select
+// (after any host overrides).  It returns "" for unnamed dialers.
+func UpstreamName(d ContextDialer, address string) string {
+	for {
+		switch v := d.(type) {
+		case *Instrumented:
+			return v.name
+		case *Router:
+			d = v.Select(address)
+		case *HostsDialer:
+			address = v.hosts.Rewrite(address)
+			d = v.d
+		default:
+			return ""
+		}
+	}
+}
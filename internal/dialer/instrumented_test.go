@@ -0,0 +1,51 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/die-net/conduit/internal/metrics"
+)
+
+type errDialer struct{ err error }
+
+func (d errDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, d.err
+}
+
+func TestInstrumented(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+	d := NewInstrumented("test-instrumented", errDialer{err: refused})
+
+	for range 2 {
+		if _, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:1"); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("err=%v, want ECONNREFUSED", err)
+		}
+	}
+
+	if n := testutil.ToFloat64(metrics.DialErrors.WithLabelValues("test-instrumented", "refused")); n != 2 {
+		t.Fatalf("dial errors=%v, want 2", n)
+	}
+	if n := testutil.CollectAndCount(metrics.DialDuration, "conduit_dial_duration_seconds"); n < 1 {
+		t.Fatalf("dial duration series=%d, want at least 1", n)
+	}
+
+	if st := d.Status(); st.LastFailure.IsZero() || !st.LastSuccess.IsZero() || st.Error != refused.Error() {
+		t.Fatalf("Status=%+v", st)
+	}
+
+	canceled := NewInstrumented("test-instrumented", errDialer{err: context.Canceled})
+	_, _ = canceled.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	if st := canceled.Status(); !st.LastFailure.IsZero() {
+		t.Fatalf("canceled dial recorded as a failure: %+v", st)
+	}
+
+	if got := Unwrap(d); got != (errDialer{err: refused}) {
+		t.Fatalf("Unwrap=%#v", got)
+	}
+}
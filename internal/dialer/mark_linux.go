@@ -0,0 +1,24 @@
+//go:build linux
+
+package dialer
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// markSupported is true if setMark is implemented.
+const markSupported = true
+
+// setMark sets SO_MARK on c, so that firewall rules and policy routing can
+// recognize its traffic.
+func setMark(c syscall.RawConn, mark uint32) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
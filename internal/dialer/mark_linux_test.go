@@ -0,0 +1,51 @@
+//go:build linux
+
+package dialer
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/die-net/conduit/internal/testutil"
+)
+
+func TestDirectDialerMark(t *testing.T) {
+	t.Parallel()
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(t.Context(), t)
+	defer echoStop()
+
+	d, err := NewDirectDialer(Config{Mark: 0x2a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(t.Context(), "tcp", echoLn.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("SO_MARK needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rc, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	if cerr := rc.Control(func(fd uintptr) {
+		mark, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != 0x2a {
+		t.Errorf("SO_MARK = %#x, want 0x2a", mark)
+	}
+}
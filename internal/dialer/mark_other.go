@@ -0,0 +1,15 @@
+//go:build !linux
+
+package dialer
+
+import (
+	"syscall"
+)
+
+// markSupported is true if setMark is implemented.
+const markSupported = false
+
+// setMark is not supported on this platform.
+func setMark(_ syscall.RawConn, _ uint32) error {
+	return errMarkUnsupported
+}
@@ -0,0 +1,378 @@
+package dialer
+
+import (
+	"crypto/md5" //nolint:gosec // Required by HTTP Digest authentication (RFC 7616).
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ProxyAuthenticator computes Proxy-Authorization headers for requests to an
+// HTTP proxy.
+//
+// Authorize is first called with a nil challenge, to get a header to send
+// preemptively. If the proxy responds 407 Proxy Authentication Required, it
+// is called again with that response (whose Request field is the request
+// that was rejected), and the request is retried with the returned header.
+// Multi-round schemes can keep going as long as the proxy keeps challenging,
+// up to MaxAuthRounds.  Retries are sent on the same connection when the
+// proxy allows it.
+//
+// Returning "" sends the request without Proxy-Authorization, or, when
+// answering a challenge, gives up and reports the 407 to the caller.
+//
+// Implementations must be safe for concurrent use.
+type ProxyAuthenticator interface {
+	Authorize(req *http.Request, challenge *http.Response) (string, error)
+}
+
+// MaxAuthRounds bounds how many times a request is retried in response to
+// 407 challenges.
+const MaxAuthRounds = 4
+
+// maxDrainBytes is how much of a 407 response body DrainChallenge reads to
+// keep the connection usable for a retry.
+const maxDrainBytes = 64 << 10
+
+// SetProxyAuthorization sets Proxy-Authorization on req as auth computes it,
+// given the proxy's challenge to the previous attempt, if any.  It reports
+// whether a header was set, which when answering a challenge means the
+// request is worth retrying.
+func SetProxyAuthorization(auth ProxyAuthenticator, req *http.Request, challenge *http.Response) (bool, error) {
+	authz, err := auth.Authorize(req, challenge)
+	if err != nil || authz == "" {
+		return false, err
+	}
+	req.Header.Set("Proxy-Authorization", authz)
+	return true, nil
+}
+
+// DrainChallenge reads and closes the body of a 407 response, so that its
+// connection can be reused for the retry.  It reports whether the whole body
+// was read.
+func DrainChallenge(resp *http.Response) bool {
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainBytes+1))
+	_ = resp.Body.Close()
+	return err == nil && n <= maxDrainBytes
+}
+
+// passwordAuthenticator answers Basic and Digest challenges with a username
+// and password.
+//
+// Basic credentials are sent preemptively until the proxy asks for Digest.
+// After that, the most recent Digest challenge is reused preemptively (with
+// an incrementing nonce count) so that later requests usually succeed in a
+// single round.
+type passwordAuthenticator struct {
+	username, password string
+	basic              string
+
+	mu     sync.Mutex
+	digest *digestChallenge
+	nc     uint32
+}
+
+// NewPasswordAuthenticator returns a ProxyAuthenticator that supports the
+// Basic and Digest (MD5 and SHA-256, with or without qop=auth) schemes.
+func NewPasswordAuthenticator(username, password string) ProxyAuthenticator {
+	return &passwordAuthenticator{
+		username: username,
+		password: password,
+		basic:    "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)),
+	}
+}
+
+func (a *passwordAuthenticator) Authorize(req *http.Request, challenge *http.Response) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if challenge == nil {
+		if a.digest == nil {
+			return a.basic, nil
+		}
+		return a.digestAuthorization(req)
+	}
+
+	var sent string
+	if challenge.Request != nil {
+		sent = challenge.Request.Header.Get("Proxy-Authorization")
+	}
+
+	var basicOffered bool
+	for _, c := range parseChallenges(challenge.Header.Values("Proxy-Authenticate")) {
+		switch strings.ToLower(c.scheme) {
+		case "digest":
+			dc, ok := newDigestChallenge(c.params)
+			if !ok {
+				continue
+			}
+			// Resending to the same nonce would just be rejected again,
+			// unless the proxy says the nonce was merely stale.
+			if a.digest != nil && a.digest.nonce == dc.nonce && !dc.stale && strings.HasPrefix(sent, "Digest ") {
+				return "", nil
+			}
+			a.digest = dc
+			a.nc = 0
+			return a.digestAuthorization(req)
+		case "basic":
+			basicOffered = true
+		}
+	}
+
+	if basicOffered && sent != a.basic {
+		a.digest = nil
+		return a.basic, nil
+	}
+	return "", nil
+}
+
+// digestAuthorization returns a Digest response to a.digest for req.  The
+// caller must hold a.mu.
+func (a *passwordAuthenticator) digestAuthorization(req *http.Request) (string, error) {
+	d := a.digest
+	a.nc++
+
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(b[:])
+	nc := fmt.Sprintf("%08x", a.nc)
+	uri := digestURI(req)
+
+	response := d.response(a.username, a.password, req.Method, uri, nc, cnonce)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `Digest username=%s, realm=%s, nonce=%s, uri=%s, response=%s`,
+		quote(a.username), quote(d.realm), quote(d.nonce), quote(uri), quote(response))
+	if d.algorithm != "" {
+		fmt.Fprintf(&sb, ", algorithm=%s", d.algorithm)
+	}
+	if d.qop {
+		fmt.Fprintf(&sb, ", qop=auth, nc=%s, cnonce=%s", nc, quote(cnonce))
+	}
+	if d.opaque != "" {
+		fmt.Fprintf(&sb, ", opaque=%s", quote(d.opaque))
+	}
+	return sb.String(), nil
+}
+
+// response computes the request-digest (RFC 7616 section 3.4.1).
+func (d *digestChallenge) response(username, password, method, uri, nc, cnonce string) string {
+	ha1 := d.hash(username + ":" + d.realm + ":" + password)
+	if d.sess {
+		ha1 = d.hash(ha1 + ":" + d.nonce + ":" + cnonce)
+	}
+	ha2 := d.hash(method + ":" + uri)
+
+	if d.qop {
+		return d.hash(ha1 + ":" + d.nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+	}
+	return d.hash(ha1 + ":" + d.nonce + ":" + ha2)
+}
+
+// digestURI returns the request-target req will be sent with: the authority
+// for CONNECT, otherwise the absolute URI used for requests via a proxy.
+func digestURI(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return req.Host
+	}
+	return req.URL.Scheme + "://" + req.URL.Host + req.URL.RequestURI()
+}
+
+// digestChallenge is a parsed Digest challenge (RFC 7616).
+type digestChallenge struct {
+	realm, nonce, opaque string
+	algorithm            string // As sent by the proxy; "" implies MD5.
+	hash                 func(string) string
+	sess                 bool
+	qop                  bool
+	stale                bool
+}
+
+// newDigestChallenge parses the parameters of a Digest challenge, returning
+// false if it requires an unsupported algorithm or qop.
+func newDigestChallenge(params map[string]string) (*digestChallenge, bool) {
+	d := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		algorithm: params["algorithm"],
+		stale:     strings.EqualFold(params["stale"], "true"),
+	}
+	if d.nonce == "" {
+		return nil, false
+	}
+
+	alg := strings.ToUpper(d.algorithm)
+	if base, ok := strings.CutSuffix(alg, "-SESS"); ok {
+		d.sess = true
+		alg = base
+	}
+	switch alg {
+	case "", "MD5":
+		d.hash = hashHex(md5.New)
+	case "SHA-256":
+		d.hash = hashHex(sha256.New)
+	default:
+		return nil, false
+	}
+
+	if qop, ok := params["qop"]; ok {
+		for _, q := range strings.Split(qop, ",") {
+			if strings.EqualFold(strings.TrimSpace(q), "auth") {
+				d.qop = true
+			}
+		}
+		if !d.qop {
+			// Only auth-int was offered, which would need the body.
+			return nil, false
+		}
+	}
+	return d, true
+}
+
+func hashHex(newHash func() hash.Hash) func(string) string {
+	return func(s string) string {
+		h := newHash()
+		_, _ = h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// authChallenge is one challenge from a Proxy-Authenticate header. A
+// token68 value (as used by Negotiate and NTLM) is stored in params under "".
+type authChallenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenges parses Proxy-Authenticate header values, each of which may
+// hold several comma-separated challenges (RFC 9110 section 11.6.1).
+func parseChallenges(values []string) []authChallenge {
+	var out []authChallenge
+	for _, v := range values {
+		p := challengeParser{s: v}
+		for {
+			p.skip(", \t")
+			scheme := p.token()
+			if scheme == "" {
+				break
+			}
+			c := authChallenge{scheme: scheme, params: make(map[string]string)}
+			p.skip(" \t")
+			if t, ok := p.token68(); ok {
+				c.params[""] = t
+			} else {
+				p.params(c.params)
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+type challengeParser struct {
+	s   string
+	pos int
+}
+
+func (p *challengeParser) skip(chars string) {
+	for p.pos < len(p.s) && strings.IndexByte(chars, p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *challengeParser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *challengeParser) token() string {
+	start := p.pos
+	for p.pos < len(p.s) && isTokenChar(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// token68 consumes a token68 value if one is next, leaving the position
+// unchanged otherwise.
+func (p *challengeParser) token68() (string, bool) {
+	start := p.pos
+	for p.pos < len(p.s) && (isAlnum(p.s[p.pos]) || strings.IndexByte("-._~+/", p.s[p.pos]) >= 0) {
+		p.pos++
+	}
+	for p.peek() == '=' {
+		p.pos++
+	}
+	end := p.pos
+	p.skip(" \t")
+	if end > start && (p.pos == len(p.s) || p.peek() == ',') {
+		return p.s[start:end], true
+	}
+	p.pos = start
+	return "", false
+}
+
+// params consumes comma-separated auth-params into m, stopping before the
+// start of the next challenge.
+func (p *challengeParser) params(m map[string]string) {
+	for {
+		p.skip(", \t")
+		start := p.pos
+		name := p.token()
+		p.skip(" \t")
+		if name == "" || p.peek() != '=' {
+			// Either the end or the next challenge's scheme.
+			p.pos = start
+			return
+		}
+		p.pos++
+		p.skip(" \t")
+		m[strings.ToLower(name)] = p.value()
+	}
+}
+
+func (p *challengeParser) value() string {
+	if p.peek() != '"' {
+		return p.token()
+	}
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '"':
+			return sb.String()
+		case c == '\\' && p.pos < len(p.s):
+			sb.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func isTokenChar(c byte) bool {
+	return isAlnum(c) || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
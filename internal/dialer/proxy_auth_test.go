@@ -0,0 +1,88 @@
+package dialer
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []authChallenge
+	}{
+		{
+			name:   "basic",
+			values: []string{`Basic realm="proxy"`},
+			want:   []authChallenge{{scheme: "Basic", params: map[string]string{"realm": "proxy"}}},
+		},
+		{
+			name:   "multiple challenges in one header",
+			values: []string{`Digest realm="a, b", qop="auth,auth-int", nonce=abc, Basic realm="x\"y"`},
+			want: []authChallenge{
+				{scheme: "Digest", params: map[string]string{"realm": "a, b", "qop": "auth,auth-int", "nonce": "abc"}},
+				{scheme: "Basic", params: map[string]string{"realm": `x"y`}},
+			},
+		},
+		{
+			name:   "token68 and bare scheme",
+			values: []string{"NTLM TlRMTVNTUAACAAAA==", "Negotiate"},
+			want: []authChallenge{
+				{scheme: "NTLM", params: map[string]string{"": "TlRMTVNTUAACAAAA=="}},
+				{scheme: "Negotiate", params: map[string]string{}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseChallenges(tt.values)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDigestResponse uses the examples from RFC 7616 section 3.9.1.
+func TestDigestResponse(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{algorithm: "MD5", want: "8ca523f5e9506fed4657c9700eebdbec"},
+		{algorithm: "SHA-256", want: "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			d, ok := newDigestChallenge(map[string]string{
+				"realm":     "http-auth@example.org",
+				"qop":       "auth, auth-int",
+				"algorithm": tt.algorithm,
+				"nonce":     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+				"opaque":    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+			})
+			if !ok {
+				t.Fatal("challenge not supported")
+			}
+			got := d.response("Mufasa", "Circle of Life", http.MethodGet, "/dir/index.html", "00000001", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+			if got != tt.want {
+				t.Fatalf("got %s want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDigestChallengeUnsupported(t *testing.T) {
+	for _, params := range []map[string]string{
+		{"nonce": "n", "algorithm": "SHA-512-256"},
+		{"nonce": "n", "qop": "auth-int"},
+		{"realm": "missing nonce"},
+	} {
+		if _, ok := newDigestChallenge(params); ok {
+			t.Errorf("expected %v to be unsupported", params)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package dialer
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// ErrNotPublic is returned (wrapped) by a direct dialer with
+// Config.PublicOnly set, for destinations that aren't public.
+var ErrNotPublic = errors.New("destination address is not public")
+
+// specialPrefixes are special-purpose ranges (RFC 6890 and its updates)
+// that aren't covered by the netip.Addr predicates used in isPublic.
+var specialPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "This network"
+	netip.MustParsePrefix("100.64.0.0/10"),   // Shared address space (CGNAT)
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // TEST-NET-1
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // TEST-NET-3
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // Local-use IPv4/IPv6 translation
+	netip.MustParsePrefix("100::/64"),        // Discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation
+	netip.MustParsePrefix("fec0::/10"),       // Deprecated site-local
+}
+
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour   = netip.MustParsePrefix("2002::/16")
+)
+
+// isPublic reports whether addr is a public unicast address: not loopback,
+// link-local (including the 169.254.169.254 metadata service), private
+// (RFC 1918 or ULA), multicast, or otherwise special-purpose.  IPv6
+// addresses that embed an IPv4 address (IPv4-mapped, NAT64 and 6to4) are
+// judged by that.
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	switch {
+	case nat64Prefix.Contains(addr):
+		b := addr.As16()
+		return isPublic(netip.AddrFrom4([4]byte(b[12:16])))
+	case sixToFour.Contains(addr):
+		b := addr.As16()
+		return isPublic(netip.AddrFrom4([4]byte(b[2:6])))
+	}
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	return !slices.ContainsFunc(specialPrefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// checkPublic returns an error wrapping ErrNotPublic if addr isn't public
+// and isn't within one of exceptions.
+func checkPublic(addr netip.Addr, exceptions []netip.Prefix) error {
+	addr = addr.Unmap().WithZone("")
+	if isPublic(addr) || slices.ContainsFunc(exceptions, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrNotPublic, addr)
+}
@@ -0,0 +1,129 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/die-net/conduit/internal/testutil"
+)
+
+func TestIsPublic(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"::ffff:8.8.8.8", true},
+		{"64:ff9b::808:808", true},
+
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1%eth0", false},
+		{"fd00:ec2::254", false},
+		{"100.64.0.1", false},
+		{"192.0.2.1", false},
+		{"198.18.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"2001:db8::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"2002:7f00:1::", false},
+		{"fec0::1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublic(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublic(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDirectDialerPublicOnly(t *testing.T) {
+	t.Parallel()
+
+	ln, stop := testutil.StartEchoTCPServer(t.Context(), t)
+	t.Cleanup(stop)
+	addr := ln.Addr().String()
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		address    string
+		exceptions []netip.Prefix
+		wantErr    bool
+	}{
+		{name: "loopback address", address: addr, wantErr: true},
+		{name: "IPv4-mapped loopback", address: net.JoinHostPort("::ffff:127.0.0.1", port), wantErr: true},
+		{name: "excepted address", address: addr, exceptions: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			d, err := NewDirectDialer(Config{PublicOnly: true, PublicExceptions: tt.exceptions})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := d.DialContext(context.Background(), "tcp", tt.address)
+			if tt.wantErr {
+				if !errors.Is(err, ErrNotPublic) {
+					t.Fatalf("DialContext(%s) err = %v, want ErrNotPublic", tt.address, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			testutil.AssertEcho(t, c, c, []byte("hello"))
+		})
+	}
+}
+
+// The address actually connected to is checked too, in case DNS gives a
+// different answer than when the hostname was checked.
+func TestDirectDialerPublicOnlyControl(t *testing.T) {
+	t.Parallel()
+
+	dd := &directDialer{publicOnly: true}
+	if err := dd.controlPublic("tcp4", "127.0.0.1:80", nil); !errors.Is(err, ErrNotPublic) {
+		t.Errorf("controlPublic(127.0.0.1:80) = %v, want ErrNotPublic", err)
+	}
+	if err := dd.controlPublic("tcp6", "[2606:4700:4700::1111]:443", nil); err != nil {
+		t.Errorf("controlPublic(public) = %v", err)
+	}
+}
+
+func TestIPNetwork(t *testing.T) {
+	t.Parallel()
+
+	for network, want := range map[string]string{
+		"tcp":  "ip",
+		"tcp4": "ip4",
+		"tcp6": "ip6",
+		"udp":  "ip",
+		"udp4": "ip4",
+		"udp6": "ip6",
+	} {
+		if got := ipNetwork(network); got != want {
+			t.Errorf("ipNetwork(%q) = %q, want %q", network, got, want)
+		}
+	}
+}
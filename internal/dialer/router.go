@@ -0,0 +1,55 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/die-net/conduit/internal/hostmatch"
+)
+
+// Route sends connections whose destination host matches Match via Dialer.
+type Route struct {
+	Match  hostmatch.List
+	Dialer ContextDialer
+}
+
+// Router is a ContextDialer that picks an upstream for each connection by
+// its destination host.
+//
+// Routes are checked in order, and the first whose patterns match is used.
+// If none match, the default dialer is used.  Only the host as given is
+// matched, so an IP prefix pattern won't match a hostname that resolves into
+// it.
+type Router struct {
+	routes []Route
+	def    ContextDialer
+}
+
+// NewRouter returns a Router over routes, falling back to def.
+func NewRouter(routes []Route, def ContextDialer) *Router {
+	return &Router{routes: routes, def: def}
+}
+
+// Select returns the dialer that would be used for address.
+func (r *Router) Select(address string) ContextDialer {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	for _, rt := range r.routes {
+		if rt.Match.Match(host) {
+			return rt.Dialer
+		}
+	}
+	return r.def
+}
+
+// DialContext dials address via the dialer selected for it.
+func (r *Router) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d := r.Select(address)
+	if d == nil {
+		return nil, fmt.Errorf("router dial %s %s: no route", network, address)
+	}
+	return d.DialContext(ctx, network, address)
+}
@@ -0,0 +1,95 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/die-net/conduit/internal/hostmatch"
+	"github.com/die-net/conduit/internal/hosts"
+)
+
+// namedDialer fails every dial with its name, so tests can tell which
+// dialer was selected.
+type namedDialer string
+
+func (d namedDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, errors.New(string(d))
+}
+
+func TestRouter(t *testing.T) {
+	corp, err := hostmatch.ParseList([]string{".corp.example", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lab, err := hostmatch.ParseList([]string{"*.lab.corp.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter([]Route{
+		{Match: corp, Dialer: namedDialer("corp")},
+		{Match: lab, Dialer: namedDialer("lab")},
+	}, namedDialer("default"))
+
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{address: "www.corp.example:443", want: "corp"},
+		{address: "host.lab.corp.example:22", want: "corp"}, // First match wins.
+		{address: "10.1.2.3:80", want: "corp"},
+		{address: "[2001:db8::1]:80", want: "default"},
+		{address: "example.com:443", want: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			_, err := r.DialContext(context.Background(), "tcp", tt.address)
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("expected dial via %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	if _, err := NewRouter(nil, nil).DialContext(context.Background(), "tcp", "example.com:80"); err == nil {
+		t.Fatal("expected error with no default")
+	}
+}
+
+// addressDialer fails every dial with the address it was asked for.
+type addressDialer struct{}
+
+func (addressDialer) DialContext(_ context.Context, _, address string) (net.Conn, error) {
+	return nil, errors.New(address)
+}
+
+func TestHostsDialer(t *testing.T) {
+	o, err := hosts.NewOverride([]string{"*.prod.example"}, "staging.example:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging, err := hostmatch.ParseList([]string{"staging.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewHostsDialer(hosts.Map{o}, addressDialer{})
+	if _, err := d.DialContext(context.Background(), "tcp", "api.prod.example:443"); err == nil || err.Error() != "staging.example:8443" {
+		t.Errorf("expected rewritten dial, got %v", err)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "example.com:443"); err == nil || err.Error() != "example.com:443" {
+		t.Errorf("expected unchanged dial, got %v", err)
+	}
+
+	// Routing sees the rewritten host.
+	r := NewRouter([]Route{{Match: staging, Dialer: NewInstrumented("staging", addressDialer{})}}, NewInstrumented("default", addressDialer{}))
+	if name := UpstreamName(NewHostsDialer(hosts.Map{o}, r), "api.prod.example:443"); name != "staging" {
+		t.Errorf("UpstreamName = %q, want staging", name)
+	}
+
+	if NewHostsDialer(nil, r) != ContextDialer(r) {
+		t.Error("expected no wrapper without overrides")
+	}
+}
@@ -2,8 +2,10 @@ package dialer
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"time"
@@ -11,30 +13,53 @@ import (
 	"github.com/die-net/conduit/internal/socks5"
 )
 
-// SOCKS5ProxyDialer dials outbound TCP connections via an upstream SOCKS5
-// proxy.
+// SOCKS5ProxyDialer dials outbound TCP connections, and UDP associations,
+// via an upstream SOCKS5 proxy, optionally wrapped in TLS.
 type SOCKS5ProxyDialer struct {
 	cfg       Config
 	proxyAddr string
 	username  string
 	password  string
 	direct    ContextDialer
+	tlsConfig *tls.Config
 }
 
 // NewSOCKS5ProxyDialer constructs a SOCKS5 CONNECT dialer for proxyAddr.
 //
 // If username is non-empty, username/password negotiation is used.
 func NewSOCKS5ProxyDialer(cfg Config, proxyAddr, username, password string) (ContextDialer, error) {
+	if !cfg.TLS.IsZero() {
+		return nil, errors.New("socks5 proxy dialer: tls options require a socks5+tls proxy")
+	}
+	return newSOCKS5ProxyDialer(cfg, proxyAddr, username, password, nil)
+}
+
+// NewSOCKS5TLSProxyDialer is like NewSOCKS5ProxyDialer, but performs a TLS
+// handshake with the proxy (configured by cfg.TLS) before SOCKS5
+// negotiation, so credentials and destinations aren't sent in clear text.
+func NewSOCKS5TLSProxyDialer(cfg Config, proxyAddr, username, password string) (ContextDialer, error) {
+	host, _, err := net.SplitHostPort(proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy dialer: %w", err)
+	}
+	tlsConfig, err := cfg.TLS.ClientConfig(host)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy dialer: %w", err)
+	}
+	return newSOCKS5ProxyDialer(cfg, proxyAddr, username, password, tlsConfig)
+}
+
+func newSOCKS5ProxyDialer(cfg Config, proxyAddr, username, password string, tlsConfig *tls.Config) (ContextDialer, error) {
 	if proxyAddr == "" {
 		return nil, errors.New("socks5 proxy dialer: missing proxy address")
 	}
 
-	direct, err := NewDirectDialer(cfg)
+	direct, err := newProxyServerDialer(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SOCKS5ProxyDialer{cfg: cfg, proxyAddr: proxyAddr, username: username, password: password, direct: direct}, nil
+	return &SOCKS5ProxyDialer{cfg: cfg, proxyAddr: proxyAddr, username: username, password: password, direct: direct, tlsConfig: tlsConfig}, nil
 }
 
 // DialContext establishes a TCP connection to address via the configured SOCKS5
@@ -43,17 +68,26 @@ func NewSOCKS5ProxyDialer(cfg Config, proxyAddr, username, password string) (Con
 // Canceling ctx closes the proxy connection during negotiation so callers don't
 // hang waiting for a proxy response.
 //
-// SOCKS5 negotiation and CONNECT are performed synchronously before
-// returning.
+// The TLS handshake (for TLS proxies), SOCKS5 negotiation and CONNECT are
+// performed synchronously before returning.
 //
-// If NegotiationTimeout is set, a deadline is applied during SOCKS5
+// If NegotiationTimeout is set, a deadline is applied during TLS and SOCKS5
 // negotiation and cleared before returning.
+//
+// For a "udp" network, a UDP ASSOCIATE request is made instead of CONNECT,
+// and the returned net.Conn sends and receives datagrams to address through
+// the proxy's UDP relay.
 func (f *SOCKS5ProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	if !strings.HasPrefix(network, "tcp") {
+	udp := strings.HasPrefix(network, "udp")
+	if !udp && !strings.HasPrefix(network, "tcp") {
 		return nil, fmt.Errorf("socks5 proxy dial %s %s: unsupported network", network, address)
 	}
+	proxyNetwork := network
+	if udp {
+		proxyNetwork = "tcp"
+	}
 
-	c, err := f.direct.DialContext(ctx, network, f.proxyAddr)
+	c, err := f.direct.DialContext(ctx, proxyNetwork, f.proxyAddr)
 	if err != nil {
 		return nil, fmt.Errorf("socks5 proxy: %w", err)
 	}
@@ -71,10 +105,22 @@ func (f *SOCKS5ProxyDialer) DialContext(ctx context.Context, network, address st
 		_ = c.SetDeadline(deadline)
 	}
 
+	if f.tlsConfig != nil {
+		tlsConn := tls.Client(c, f.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = tlsConn.Close()
+			return nil, fmt.Errorf("socks5 proxy tls handshake: %w", err)
+		}
+		c = tlsConn
+	}
+
 	var auth socks5.Auth
 	if f.username != "" {
 		auth = socks5.Auth{Username: f.username, Password: f.password}
 	}
+	if udp {
+		return f.associate(ctx, c, auth, address)
+	}
 	if err := socks5.ClientDial(c, auth, address); err != nil {
 		_ = c.Close()
 		return nil, fmt.Errorf("socks5 proxy connect: %w", err)
@@ -85,3 +131,76 @@ func (f *SOCKS5ProxyDialer) DialContext(ctx context.Context, network, address st
 	}
 	return c, nil
 }
+
+// associate negotiates a UDP association over c, and returns a connection
+// to the proxy's UDP relay that carries datagrams to and from address.
+func (f *SOCKS5ProxyDialer) associate(ctx context.Context, c net.Conn, auth socks5.Auth, address string) (net.Conn, error) {
+	err := socks5.ClientNegotiate(c, auth)
+	var relay string
+	if err == nil {
+		relay, err = socks5.ClientUDPAssociate(c)
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("socks5 proxy udp associate: %w", err)
+	}
+
+	pc, err := f.direct.DialContext(ctx, "udp", relay)
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("socks5 proxy udp relay: %w", err)
+	}
+	_ = c.SetDeadline(time.Time{})
+	return newSOCKS5UDPConn(c, pc, address), nil
+}
+
+// socks5UDPConn sends datagrams to address through a SOCKS5 UDP relay, and
+// receives the datagrams relayed back.  The association lasts as long as
+// ctrl, the connection it was requested on, so closing either closes both.
+type socks5UDPConn struct {
+	net.Conn // To the relay.
+	ctrl     net.Conn
+	address  string
+	buf      []byte
+}
+
+func newSOCKS5UDPConn(ctrl, relay net.Conn, address string) *socks5UDPConn {
+	c := &socks5UDPConn{Conn: relay, ctrl: ctrl, address: address, buf: make([]byte, 64<<10)}
+	go func() {
+		// The proxy ends the association by closing ctrl.
+		_, _ = io.Copy(io.Discard, ctrl)
+		_ = relay.Close()
+	}()
+	return c
+}
+
+// Read reads the next datagram relayed from address.  Datagrams that can't
+// be parsed are dropped.
+func (c *socks5UDPConn) Read(p []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		if data, err := socks5.UnpackDatagram(c.buf[:n]); err == nil {
+			return copy(p, data), nil
+		}
+	}
+}
+
+// Write sends p as one datagram to address.
+func (c *socks5UDPConn) Write(p []byte) (int, error) {
+	b, err := socks5.PackDatagram(c.address, p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socks5UDPConn) Close() error {
+	_ = c.ctrl.Close()
+	return c.Conn.Close()
+}
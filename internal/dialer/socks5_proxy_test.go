@@ -83,6 +83,60 @@ func TestSOCKS5ProxyDialerDialSuccess(t *testing.T) {
 	}
 }
 
+func TestSOCKS5ProxyDialerUDP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	upLn, waitUp := testutil.StartAcceptServer(ctx, t, func(c net.Conn) {
+		if err := socks5.ServerNegotiateNoAuth(c); err != nil {
+			return
+		}
+		req, err := socks5.ServerReadRequest(c)
+		if err != nil || req.Cmd != socks5.CmdUDP {
+			return
+		}
+
+		// The relay echoes each datagram back, header and all.
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		if err := socks5.WriteSuccessReply(c, relay.LocalAddr()); err != nil {
+			return
+		}
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, addr, err := relay.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, _ = relay.WriteTo(buf[:n], addr)
+			}
+		}()
+
+		// The association lasts until the client closes c.
+		_, _ = io.Copy(io.Discard, c)
+	})
+
+	f, err := NewSOCKS5ProxyDialer(Config{DialTimeout: 2 * time.Second}, upLn.Addr().String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := f.DialContext(ctx, "udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	testutil.AssertEcho(t, conn, conn, []byte("hello"))
+
+	_ = conn.Close()
+	_ = upLn.Close()
+	waitUp()
+}
+
 func TestSOCKS5ProxyDialerDialContextCancel(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
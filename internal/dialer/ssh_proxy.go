@@ -43,7 +43,7 @@ func NewSSHProxyDialer(cfg Config, sshAddr, username, password string) (ContextD
 		return nil, fmt.Errorf("ssh dialer: %w", err)
 	}
 
-	direct, err := NewDirectDialer(cfg)
+	direct, err := newProxyServerDialer(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,7 @@
+// Package dnsserver answers DNS queries from clients, over UDP and TCP, by
+// forwarding them to a resolver.Exchanger.
+//
+// With an Exchanger that reaches its DNS server through an upstream proxy,
+// hosts using the transparent proxy can resolve names from the same
+// network as the tunnel instead of leaking queries locally.
+package dnsserver
@@ -0,0 +1,97 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/die-net/conduit/internal/metrics"
+	"github.com/die-net/conduit/internal/resolver"
+)
+
+// queryTimeout bounds how long a query is forwarded for.  Clients
+// typically give up and retry well before then.
+const queryTimeout = 10 * time.Second
+
+// Server is a DNS forwarder.  It implements dns.Handler.
+type Server struct {
+	ex      atomic.Pointer[exchanger]
+	Verbose bool
+}
+
+// exchanger boxes a resolver.Exchanger, so that it can be swapped
+// atomically.
+type exchanger struct {
+	resolver.Exchanger
+}
+
+// NewServer constructs a Server that forwards queries with ex.
+func NewServer(ex resolver.Exchanger, verbose bool) *Server {
+	s := &Server{Verbose: verbose}
+	s.SetExchanger(ex)
+	return s
+}
+
+// SetExchanger replaces the Exchanger used for new queries.
+func (s *Server) SetExchanger(ex resolver.Exchanger) {
+	s.ex.Store(&exchanger{ex})
+}
+
+// Serve answers queries received on pc and on connections accepted from
+// ln, until ctx is done or either fails.  Either may be nil.  Both are
+// closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, pc net.PacketConn, ln net.Listener) error {
+	g, ctx := errgroup.WithContext(ctx)
+	serve := func(srv *dns.Server) {
+		g.Go(func() error {
+			err := srv.ActivateAndServe()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("dns serve %s: %w", srv.Net, err)
+		})
+	}
+	if pc != nil {
+		context.AfterFunc(ctx, func() { _ = pc.Close() })
+		serve(&dns.Server{PacketConn: pc, Net: "udp", Handler: s})
+	}
+	if ln != nil {
+		context.AfterFunc(ctx, func() { _ = ln.Close() })
+		serve(&dns.Server{Listener: ln, Net: "tcp", Handler: s})
+	}
+	return g.Wait()
+}
+
+// ServeDNS forwards q and writes the response, or SERVFAIL if it can't be
+// forwarded.
+func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	r, err := s.ex.Load().Exchange(ctx, q)
+	if err != nil {
+		if s.Verbose {
+			slog.Info("dns forward error", "client", w.RemoteAddr().String(), "name", q.Question[0].Name, "error", err)
+		}
+		r = new(dns.Msg)
+		r.SetRcode(q, dns.RcodeServerFailure)
+	}
+	r.Id = q.Id
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := q.IsEdns0(); opt != nil {
+			size = max(size, int(opt.UDPSize()))
+		}
+		r.Truncate(size)
+	}
+
+	metrics.DNSQueries.WithLabelValues(dns.RcodeToString[r.Rcode]).Inc()
+	_ = w.WriteMsg(r)
+}
@@ -0,0 +1,112 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fixedExchanger answers A queries with n copies of addr.
+type fixedExchanger struct {
+	addr net.IP
+	n    int
+}
+
+func (e fixedExchanger) Exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Id = 1 // The server should restore the client's.
+	for range e.n {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   e.addr,
+		})
+	}
+	return r, nil
+}
+
+type failingExchanger struct{}
+
+func (failingExchanger) Exchange(context.Context, *dns.Msg) (*dns.Msg, error) {
+	return nil, errors.New("unreachable")
+}
+
+// startServer serves s on loopback UDP and TCP, returning their addresses.
+func startServer(t *testing.T, s *Server) (udpAddr, tcpAddr string) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, pc, ln) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return pc.LocalAddr().String(), ln.Addr().String()
+}
+
+func query(t *testing.T, network, addr, name string) *dns.Msg {
+	t.Helper()
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	c := &dns.Client{Net: network}
+	r, _, err := c.ExchangeContext(t.Context(), m, addr)
+	if err != nil {
+		t.Fatalf("%s query: %v", network, err)
+	}
+	if r.Id != m.Id {
+		t.Errorf("%s response ID = %d, want %d", network, r.Id, m.Id)
+	}
+	return r
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(fixedExchanger{addr: net.IPv4(192, 0, 2, 1), n: 1}, false)
+	udpAddr, tcpAddr := startServer(t, s)
+
+	for _, tc := range []struct{ network, addr string }{{"udp", udpAddr}, {"tcp", tcpAddr}} {
+		r := query(t, tc.network, tc.addr, "example.com.")
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Fatalf("%s response = %v", tc.network, r)
+		}
+		if a := r.Answer[0].(*dns.A).A.String(); a != "192.0.2.1" {
+			t.Errorf("%s answer = %s, want 192.0.2.1", tc.network, a)
+		}
+	}
+
+	s.SetExchanger(failingExchanger{})
+	for _, tc := range []struct{ network, addr string }{{"udp", udpAddr}, {"tcp", tcpAddr}} {
+		if r := query(t, tc.network, tc.addr, "example.com."); r.Rcode != dns.RcodeServerFailure {
+			t.Errorf("%s rcode = %s, want SERVFAIL", tc.network, dns.RcodeToString[r.Rcode])
+		}
+	}
+}
+
+func TestServerTruncatesUDP(t *testing.T) {
+	// 100 A records don't fit in a 512-byte UDP response.
+	s := NewServer(fixedExchanger{addr: net.IPv4(192, 0, 2, 1), n: 100}, false)
+	udpAddr, tcpAddr := startServer(t, s)
+
+	r := query(t, "udp", udpAddr, "example.com.")
+	if !r.Truncated || len(r.Answer) == 100 {
+		t.Errorf("udp response truncated = %v with %d answers, want truncated", r.Truncated, len(r.Answer))
+	}
+	r = query(t, "tcp", tcpAddr, "example.com.")
+	if r.Truncated || len(r.Answer) != 100 {
+		t.Errorf("tcp response truncated = %v with %d answers, want all 100", r.Truncated, len(r.Answer))
+	}
+}
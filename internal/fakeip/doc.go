@@ -0,0 +1,8 @@
+// Package fakeip hands out addresses from reserved ranges in place of the
+// real addresses of hostnames, and maps them back to the hostnames.
+//
+// A transparent proxy only learns the address a client connected to.  If
+// the client looked up that address with an Exchanger from this package,
+// the proxy can recover the hostname, and so route the connection by name
+// and have an upstream proxy resolve it remotely.
+package fakeip
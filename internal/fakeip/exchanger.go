@@ -0,0 +1,66 @@
+package fakeip
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/die-net/conduit/internal/hostmatch"
+	"github.com/die-net/conduit/internal/resolver"
+)
+
+// ttl is the TTL of fake answers.  It's short so that clients don't keep
+// using an address after its mapping has been reused, or after a restart.
+const ttl = 1
+
+// Exchanger answers A and AAAA queries with addresses from a Pool, and
+// passes other queries, and those for excluded names, to another
+// Exchanger.
+type Exchanger struct {
+	pool    *Pool
+	next    resolver.Exchanger
+	exclude hostmatch.List
+}
+
+// NewExchanger returns an Exchanger answering from pool, and forwarding to
+// next queries it doesn't answer and those for names matching exclude.
+func NewExchanger(pool *Pool, next resolver.Exchanger, exclude hostmatch.List) *Exchanger {
+	return &Exchanger{pool: pool, next: next, exclude: exclude}
+}
+
+// Exchange implements resolver.Exchanger.
+func (e *Exchanger) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return e.next.Exchange(ctx, m)
+	}
+	q := m.Question[0]
+	name := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+	if q.Qclass != dns.ClassINET || name == "" || e.exclude.Match(name) {
+		return e.next.Exchange(ctx, m)
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.RecursionAvailable = true
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		// Without a range for the address family, the answer is empty.
+		addr, ok := e.pool.Addr(name, q.Qtype == dns.TypeAAAA)
+		if !ok {
+			break
+		}
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		if addr.Is4() {
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+		} else {
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+		}
+	case dns.TypeHTTPS, dns.TypeSVCB:
+		// These carry address hints that would bypass the fake addresses,
+		// so the answer is empty.
+	default:
+		return e.next.Exchange(ctx, m)
+	}
+	return r, nil
+}
@@ -0,0 +1,71 @@
+package fakeip
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/die-net/conduit/internal/hostmatch"
+)
+
+// forwardedExchanger answers every query with an empty NXDOMAIN, so that
+// forwarded queries can be told apart.
+type forwardedExchanger struct{}
+
+func (forwardedExchanger) Exchange(_ context.Context, m *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetRcode(m, dns.RcodeNameError)
+	return r, nil
+}
+
+func TestExchanger(t *testing.T) {
+	pool, err := NewPool([]netip.Prefix{netip.MustParsePrefix("198.18.0.0/15")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude, err := hostmatch.ParseList([]string{"*.corp.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExchanger(pool, forwardedExchanger{}, exclude)
+
+	for _, tc := range []struct {
+		name      string
+		qtype     uint16
+		forwarded bool
+		want      string // The answer's address, if any.
+	}{
+		{name: "www.example.com.", qtype: dns.TypeA, want: "198.18.0.1"},
+		{name: "WWW.example.com.", qtype: dns.TypeA, want: "198.18.0.1"},
+		{name: "www.example.com.", qtype: dns.TypeAAAA},
+		{name: "www.example.com.", qtype: dns.TypeHTTPS},
+		{name: "www.example.com.", qtype: dns.TypeMX, forwarded: true},
+		{name: "git.corp.example.", qtype: dns.TypeA, forwarded: true},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		r, err := ex.Exchange(t.Context(), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if forwarded := r.Rcode == dns.RcodeNameError; forwarded != tc.forwarded {
+			t.Errorf("%s %s: forwarded = %v, want %v", tc.name, dns.TypeToString[tc.qtype], forwarded, tc.forwarded)
+			continue
+		}
+		var got string
+		if len(r.Answer) == 1 {
+			if a, ok := r.Answer[0].(*dns.A); ok {
+				got = a.A.String()
+			}
+		}
+		if got != tc.want || (tc.want == "" && len(r.Answer) != 0) {
+			t.Errorf("%s %s: answer = %v, want %q", tc.name, dns.TypeToString[tc.qtype], r.Answer, tc.want)
+		}
+	}
+
+	if name, _ := pool.Name(netip.MustParseAddr("198.18.0.1")); name != "www.example.com" {
+		t.Errorf("pool maps 198.18.0.1 to %q, want www.example.com", name)
+	}
+}
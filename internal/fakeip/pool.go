@@ -0,0 +1,143 @@
+package fakeip
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// maxEntries is the most hostnames each range maps at once.  Beyond that,
+// the least recently used mapping's address is reused.
+const maxEntries = 1 << 16
+
+// Pool maps hostnames to addresses from up to one IPv4 and one IPv6 range,
+// and back.  It is safe for concurrent use.
+type Pool struct {
+	mu     sync.Mutex
+	v4, v6 *block
+}
+
+// block allocates addresses from one range.
+type block struct {
+	prefix netip.Prefix
+	next   netip.Addr // The lowest address not yet handed out.
+	n, max int
+	lru    list.List // Of *entry, most recently used first.
+	byName map[string]*list.Element
+	byAddr map[netip.Addr]*list.Element
+}
+
+type entry struct {
+	name string
+	addr netip.Addr
+}
+
+// NewPool returns a Pool handing out addresses from prefixes, which must
+// include at most one IPv4 and one IPv6 prefix.  Each prefix's first and
+// last addresses aren't used.
+func NewPool(prefixes []netip.Prefix) (*Pool, error) {
+	p := &Pool{}
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		hostBits := prefix.Addr().BitLen() - prefix.Bits()
+		if hostBits < 2 {
+			return nil, fmt.Errorf("fake IP range %s: too small", prefix)
+		}
+		b := &block{
+			prefix: prefix,
+			next:   prefix.Addr().Next(),
+			max:    maxEntries,
+			byName: make(map[string]*list.Element),
+			byAddr: make(map[netip.Addr]*list.Element),
+		}
+		if hostBits < 17 {
+			b.max = 1<<hostBits - 2
+		}
+
+		dst := &p.v4
+		if prefix.Addr().Is6() {
+			dst = &p.v6
+		}
+		if *dst != nil {
+			return nil, fmt.Errorf("fake IP range %s: more than one per address family", prefix)
+		}
+		*dst = b
+	}
+	if p.v4 == nil && p.v6 == nil {
+		return nil, errors.New("no fake IP ranges")
+	}
+	return p, nil
+}
+
+// Addr returns the address for name from the IPv6 range if v6 is set, and
+// otherwise the IPv4 range.  It returns false if there's no such range.
+func (p *Pool) Addr(name string, v6 bool) (netip.Addr, bool) {
+	b := p.v4
+	if v6 {
+		b = p.v6
+	}
+	if b == nil {
+		return netip.Addr{}, false
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e := b.byName[name]; e != nil {
+		b.lru.MoveToFront(e)
+		return e.Value.(*entry).addr, true
+	}
+
+	var addr netip.Addr
+	if b.n < b.max {
+		addr = b.next
+		b.next = b.next.Next()
+		b.n++
+	} else {
+		old := b.lru.Remove(b.lru.Back()).(*entry)
+		delete(b.byName, old.name)
+		delete(b.byAddr, old.addr)
+		addr = old.addr
+	}
+	e := b.lru.PushFront(&entry{name: name, addr: addr})
+	b.byName[name] = e
+	b.byAddr[addr] = e
+	return addr, true
+}
+
+// Contains reports whether addr is in one of p's ranges.
+func (p *Pool) Contains(addr netip.Addr) bool {
+	return p.block(addr) != nil
+}
+
+// Name returns the hostname that addr was handed out for.  It returns
+// false if addr isn't currently mapped.
+func (p *Pool) Name(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	b := p.block(addr)
+	if b == nil {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := b.byAddr[addr]
+	if e == nil {
+		return "", false
+	}
+	b.lru.MoveToFront(e)
+	return e.Value.(*entry).name, true
+}
+
+func (p *Pool) block(addr netip.Addr) *block {
+	addr = addr.Unmap()
+	for _, b := range []*block{p.v4, p.v6} {
+		if b != nil && b.prefix.Contains(addr) {
+			return b
+		}
+	}
+	return nil
+}
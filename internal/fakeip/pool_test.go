@@ -0,0 +1,88 @@
+package fakeip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	p, err := NewPool([]netip.Prefix{netip.MustParsePrefix("198.18.0.0/15"), netip.MustParsePrefix("fd00:fa4e::/64")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		v6   bool
+		want string
+	}{
+		{name: "a.example", want: "198.18.0.1"},
+		{name: "b.example.", want: "198.18.0.2"},
+		{name: "A.Example", want: "198.18.0.1"},
+		{name: "a.example", v6: true, want: "fd00:fa4e::1"},
+	} {
+		addr, ok := p.Addr(tc.name, tc.v6)
+		if !ok || addr.String() != tc.want {
+			t.Errorf("Addr(%q, %v) = %v, %v, want %s", tc.name, tc.v6, addr, ok, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		addr string
+		want string
+		ok   bool
+	}{
+		{addr: "198.18.0.2", want: "b.example", ok: true},
+		{addr: "::ffff:198.18.0.1", want: "a.example", ok: true},
+		{addr: "fd00:fa4e::1", want: "a.example", ok: true},
+		{addr: "198.18.0.3"},
+		{addr: "192.0.2.1"},
+	} {
+		name, ok := p.Name(netip.MustParseAddr(tc.addr))
+		if name != tc.want || ok != tc.ok {
+			t.Errorf("Name(%s) = %q, %v, want %q, %v", tc.addr, name, ok, tc.want, tc.ok)
+		}
+	}
+
+	if !p.Contains(netip.MustParseAddr("198.19.255.255")) || p.Contains(netip.MustParseAddr("198.20.0.1")) {
+		t.Error("Contains doesn't match the IPv4 range")
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	// A /30 has two usable addresses.
+	p, err := NewPool([]netip.Prefix{netip.MustParsePrefix("198.18.0.0/30")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := p.Addr("a.example", false)
+	b, _ := p.Addr("b.example", false)
+	if _, ok := p.Name(a); !ok { // Makes b the least recently used.
+		t.Fatal("a.example not mapped")
+	}
+	c, _ := p.Addr("c.example", false)
+	if c != b {
+		t.Errorf("c.example got %s, want b.example's %s", c, b)
+	}
+	if name, _ := p.Name(c); name != "c.example" {
+		t.Errorf("Name(%s) = %q, want c.example", c, name)
+	}
+	if name, _ := p.Name(a); name != "a.example" {
+		t.Errorf("Name(%s) = %q, want a.example", a, name)
+	}
+	if _, ok := p.Addr("a.example", true); ok {
+		t.Error("Addr returned an IPv6 address without an IPv6 range")
+	}
+}
+
+func TestNewPoolErrors(t *testing.T) {
+	for _, prefixes := range [][]string{nil, {"198.18.0.0/31"}, {"198.18.0.0/16", "10.0.0.0/8"}, {"fd00::/64", "fd01::/64"}} {
+		var ps []netip.Prefix
+		for _, s := range prefixes {
+			ps = append(ps, netip.MustParsePrefix(s))
+		}
+		if _, err := NewPool(ps); err == nil {
+			t.Errorf("NewPool(%q) succeeded", prefixes)
+		}
+	}
+}
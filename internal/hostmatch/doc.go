@@ -0,0 +1,6 @@
+// Package hostmatch matches destination hosts against the patterns used in
+// conduit's configuration: hostname globs and IP prefixes.
+//
+// The same pattern syntax is used for routing rules, ACLs and host
+// overrides, so it lives here rather than in any one of them.
+package hostmatch
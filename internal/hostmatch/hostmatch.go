@@ -0,0 +1,157 @@
+package hostmatch
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"path"
+	"strings"
+)
+
+// Pattern matches a host (a hostname or IP literal, without a port).
+//
+// Supported forms are:
+//   - "*", which matches any host
+//   - an IP address or CIDR prefix, such as "10.1.2.3" or "10.0.0.0/8",
+//     which matches IP literals within it
+//   - ".example.com", which matches example.com and all of its subdomains
+//   - a hostname glob, such as "example.com" or "*.example.com", where "*"
+//     matches any run of characters (including dots) and "?" any one
+//
+// Hostname matching is case-insensitive and ignores a trailing dot.
+type Pattern struct {
+	raw    string
+	prefix netip.Prefix
+	glob   string
+	suffix string
+}
+
+// Parse parses a single pattern.
+func Parse(s string) (Pattern, error) {
+	p := Pattern{raw: s}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return p, errors.New("empty pattern")
+	}
+
+	if pfx, err := netip.ParsePrefix(s); err == nil {
+		p.prefix = pfx.Masked()
+		return p, nil
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		addr = addr.Unmap()
+		p.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		return p, nil
+	}
+	if strings.Contains(s, "/") {
+		return p, fmt.Errorf("invalid CIDR prefix %q", s)
+	}
+
+	s = normalize(s)
+	if s == "" || s == "." {
+		return p, fmt.Errorf("invalid pattern %q", p.raw)
+	}
+	if suffix, ok := strings.CutPrefix(s, "."); ok {
+		p.suffix = suffix
+		return p, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return p, fmt.Errorf("invalid pattern %q: %w", p.raw, err)
+	}
+	p.glob = s
+	return p, nil
+}
+
+// String returns the pattern as it was given to Parse.
+func (p Pattern) String() string {
+	return p.raw
+}
+
+// IsPrefix reports whether p is an IP address or prefix pattern.
+func (p Pattern) IsPrefix() bool {
+	return p.prefix.IsValid()
+}
+
+// Prefix returns the prefix of an IP pattern, or the zero Prefix for a
+// hostname pattern.
+func (p Pattern) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Match reports whether host matches p. IP patterns only match IP literals;
+// see MatchAddr for matching resolved addresses.
+func (p Pattern) Match(host string) bool {
+	if p.prefix.IsValid() {
+		addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+		if err != nil {
+			return false
+		}
+		return p.MatchAddr(addr)
+	}
+
+	host = normalize(host)
+	if p.suffix != "" {
+		return host == p.suffix || strings.HasSuffix(host, "."+p.suffix)
+	}
+	ok, _ := path.Match(p.glob, host)
+	return ok
+}
+
+// MatchAddr reports whether addr is within an IP pattern. Hostname patterns
+// never match.
+func (p Pattern) MatchAddr(addr netip.Addr) bool {
+	return p.prefix.IsValid() && p.prefix.Contains(addr.Unmap().WithZone(""))
+}
+
+// List is a set of patterns that matches if any of its patterns does.
+type List []Pattern
+
+// ParseList parses each of ss as a Pattern.
+func ParseList(ss []string) (List, error) {
+	l := make(List, 0, len(ss))
+	for _, s := range ss {
+		p, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, p)
+	}
+	return l, nil
+}
+
+// ParsePrefixes parses each of ss as an IP address or CIDR prefix.
+func ParsePrefixes(ss []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range ss {
+		p, err := Parse(s)
+		if err != nil || !p.IsPrefix() {
+			return nil, fmt.Errorf("invalid IP address or CIDR prefix %q", s)
+		}
+		prefixes = append(prefixes, p.Prefix())
+	}
+	return prefixes, nil
+}
+
+// Match reports whether host matches any pattern in l.
+func (l List) Match(host string) bool {
+	for _, p := range l {
+		if p.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchAddr reports whether addr matches any IP pattern in l.
+func (l List) MatchAddr(addr netip.Addr) bool {
+	for _, p := range l {
+		if p.MatchAddr(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
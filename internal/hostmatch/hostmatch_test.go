@@ -0,0 +1,70 @@
+package hostmatch
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "*", host: "example.com", want: true},
+		{pattern: "*", host: "10.0.0.1", want: true},
+		{pattern: "example.com", host: "example.com", want: true},
+		{pattern: "example.com", host: "EXAMPLE.com.", want: true},
+		{pattern: "example.com", host: "www.example.com", want: false},
+		{pattern: "*.example.com", host: "www.example.com", want: true},
+		{pattern: "*.example.com", host: "a.b.example.com", want: true},
+		{pattern: "*.example.com", host: "example.com", want: false},
+		{pattern: ".example.com", host: "example.com", want: true},
+		{pattern: ".example.com", host: "a.example.com", want: true},
+		{pattern: ".example.com", host: "badexample.com", want: false},
+		{pattern: "host?.corp", host: "host1.corp", want: true},
+		{pattern: "10.0.0.0/8", host: "10.1.2.3", want: true},
+		{pattern: "10.0.0.0/8", host: "11.1.2.3", want: false},
+		{pattern: "10.0.0.0/8", host: "ten.example.com", want: false},
+		{pattern: "10.1.2.3", host: "10.1.2.3", want: true},
+		{pattern: "10.0.0.0/8", host: "::ffff:10.1.2.3", want: true},
+		{pattern: "fd00::/8", host: "[fd00::1]", want: true},
+		{pattern: "::1", host: "::1", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.host, func(t *testing.T) {
+			p, err := Parse(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Match(tt.host); got != tt.want {
+				t.Fatalf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{"", " ", "10.0.0.0/33", "example.com/8", "[a-", "."} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q): expected error", s)
+		}
+	}
+}
+
+func TestListMatchAddr(t *testing.T) {
+	l, err := ParseList([]string{"*.example.com", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.MatchAddr(netip.MustParseAddr("192.168.1.1")) {
+		t.Error("expected 192.168.1.1 to match")
+	}
+	if l.MatchAddr(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("expected 10.0.0.1 not to match")
+	}
+	if !l.Match("www.example.com") || l.Match("example.org") {
+		t.Error("unexpected hostname match result")
+	}
+}
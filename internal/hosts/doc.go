@@ -0,0 +1,5 @@
+// Package hosts rewrites connection destinations using static overrides,
+// in the spirit of /etc/hosts: a destination host matching an override's
+// patterns is replaced by a pinned IP address, or redirected to another
+// hostname and optionally another port.
+package hosts
@@ -0,0 +1,133 @@
+package hosts
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/die-net/conduit/internal/hostmatch"
+)
+
+// Override sends connections to hosts matching Match to Host, and to Port
+// if it's set, instead.
+type Override struct {
+	Match hostmatch.List
+	// Host is an IP address or hostname.
+	Host string
+	// Port, if set, replaces the destination port.
+	Port string
+}
+
+// NewOverride returns an Override from hostmatch patterns and a target of
+// the form "host", "ip", "host:port" or "[ip]:port".
+func NewOverride(patterns []string, to string) (Override, error) {
+	if len(patterns) == 0 {
+		return Override{}, errors.New("no patterns to match")
+	}
+	match, err := hostmatch.ParseList(patterns)
+	if err != nil {
+		return Override{}, err
+	}
+	host, port, err := ParseTarget(to)
+	if err != nil {
+		return Override{}, err
+	}
+	return Override{Match: match, Host: host, Port: port}, nil
+}
+
+// ParseTarget parses the target of an override: a hostname or IP address,
+// optionally with a port.
+func ParseTarget(s string) (host, port string, err error) {
+	if s == "" {
+		return "", "", errors.New("missing target")
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.String(), "", nil
+	}
+	host = s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			return "", "", fmt.Errorf("invalid port in target %q", s)
+		}
+		host, port = h, p
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.String(), port, nil
+	}
+	if host == "" || strings.ContainsAny(host, " \t/[]") {
+		return "", "", fmt.Errorf("invalid target %q", s)
+	}
+	return strings.ToLower(strings.TrimSuffix(host, ".")), port, nil
+}
+
+// Map is a list of overrides.  The first one that matches a host applies.
+type Map []Override
+
+// Rewrite returns address (a host:port) as rewritten by the first override
+// matching its host, or unchanged if there's none.
+func (m Map) Rewrite(address string) string {
+	if len(m) == 0 {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	for _, o := range m {
+		if o.Match.Match(host) {
+			if o.Port != "" {
+				port = o.Port
+			}
+			return net.JoinHostPort(o.Host, port)
+		}
+	}
+	return address
+}
+
+// ParseFile reads overrides from a hosts file.  Each line gives a target
+// followed by the patterns it's used for, like /etc/hosts:
+//
+//	# Pin hosts to an address.
+//	10.1.2.3                  api.example.com *.api.example.com
+//	# Redirect hosts elsewhere, optionally to another port.
+//	staging.example.net:8443  .example.com
+//
+// Blank lines and text following "#" are ignored.
+func ParseFile(path string) (Map, error) {
+	f, err := os.Open(path) //nolint:gosec // The path is configured by the operator.
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(path, f)
+}
+
+// Parse reads overrides in the format of ParseFile from r, using name in
+// errors.
+func Parse(name string, r io.Reader) (Map, error) {
+	var m Map
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		o, err := NewOverride(fields[1:], fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		m = append(m, o)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,65 @@
+package hosts
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	t.Parallel()
+
+	m, err := Parse("test", strings.NewReader(`
+# Comment.
+10.1.2.3                  api.example.com   # Pinned.
+[2001:db8::1]:8443        v6.example.com
+staging.example.net:8443  *.svc.example.com
+Other.Example.NET.        .example.org
+192.0.2.1                 198.51.100.0/24
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"api.example.com:443", "10.1.2.3:443"},
+		{"API.example.com.:80", "10.1.2.3:80"},
+		{"v6.example.com:443", "[2001:db8::1]:8443"},
+		{"a.svc.example.com:443", "staging.example.net:8443"},
+		{"svc.example.com:443", "svc.example.com:443"},
+		{"example.org:25", "other.example.net:25"},
+		{"www.example.org:80", "other.example.net:80"},
+		{"198.51.100.7:22", "192.0.2.1:22"},
+		{"[2001:db8::2]:22", "[2001:db8::2]:22"},
+		{"unmatched.example:80", "unmatched.example:80"},
+		{"no-port", "no-port"},
+	}
+	for _, tt := range tests {
+		if got := m.Rewrite(tt.address); got != tt.want {
+			t.Errorf("Rewrite(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"no patterns", "10.1.2.3\n", "test:1: no patterns to match"},
+		{"bad port", "\nstaging.example:http api.example.com\n", `test:2: invalid port in target "staging.example:http"`},
+		{"bad pattern", "10.1.2.3 [a-\n", `test:1: invalid pattern "[a-"`},
+		{"bad target", "a/b api.example.com\n", `test:1: invalid target "a/b"`},
+	}
+	for _, tt := range tests {
+		_, err := Parse("test", strings.NewReader(tt.text))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+// Package logging sets up conduit's log/slog output: text or JSON records,
+// written to stderr or to a file that can be reopened after rotation.
+package logging
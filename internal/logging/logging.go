@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// NewHandler returns a slog.Handler writing records to w in format
+// (FormatText or FormatJSON).
+func NewHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case FormatText, "":
+		return slog.NewTextHandler(w, opts), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q (expected %s or %s)", format, FormatText, FormatJSON)
+	}
+}
+
+// File is a log file that can be reopened, so that logs keep going to the
+// named file after an external tool such as logrotate renames it.
+//
+// Writes are serialized, so File is safe for concurrent use.
+type File struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenFile opens path for appending, creating it if needed.
+func OpenFile(path string) (*File, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, f: f}, nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644) //nolint:gosec // Log files are meant to be readable.
+}
+
+// Write appends p to the file.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f.Write(p)
+}
+
+// Reopen closes the file and opens path again.  If opening fails, the
+// current file is kept.
+func (f *File) Reopen() error {
+	nf, err := openAppend(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	old := f.f
+	f.f = nf
+	f.mu.Unlock()
+
+	return old.Close()
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f.Close()
+}
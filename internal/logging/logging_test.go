@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, FormatJSON, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("access", "listener", "web", "bytes_up", 42)
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	if rec["msg"] != "access" || rec["listener"] != "web" || rec["bytes_up"] != float64(42) {
+		t.Fatalf("unexpected record %v", rec)
+	}
+
+	buf.Reset()
+	h, err = NewHandler(&buf, FormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("access", "listener", "web")
+	if !strings.Contains(buf.String(), "msg=access listener=web") {
+		t.Fatalf("unexpected text record %q", buf.String())
+	}
+
+	if _, err := NewHandler(&buf, "xml", slog.LevelInfo); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "conduit.log")
+
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate the way logrotate does: rename, then signal a reopen.
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("two\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("three\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{rotated: "one\ntwo\n", path: "three\n"} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package metrics defines conduit's Prometheus metrics and serves them.
+//
+// The other packages update the metrics directly where events happen, so
+// this package only depends on the Prometheus client library.
+package metrics
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// ErrorClass classifies a dial or I/O error into a small, fixed set of
+// label values: "canceled", "timeout", "dns", "refused", "unreachable",
+// "reset", "tls", or "other".
+func ErrorClass(err error) string {
+	var (
+		dnsErr  *net.DNSError
+		netErr  net.Error
+		recErr  tls.RecordHeaderError
+		alert   tls.AlertError
+		certErr *tls.CertificateVerificationError
+		unkAuth x509.UnknownAuthorityError
+		hostErr x509.HostnameError
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	case errors.As(err, &recErr), errors.As(err, &alert), errors.As(err, &certErr),
+		errors.As(err, &unkAuth), errors.As(err, &hostErr):
+		return "tls"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"canceled", fmt.Errorf("dial: %w", context.Canceled), "canceled"},
+		{"deadline", context.DeadlineExceeded, "timeout"},
+		{"net timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, "timeout"},
+		{"dns", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}}, "dns"},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "refused"},
+		{"unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, "unreachable"},
+		{"reset", fmt.Errorf("read: %w", syscall.ECONNRESET), "reset"},
+		{"eof", fmt.Errorf("handshake: %w", io.EOF), "reset"},
+		{"tls", fmt.Errorf("handshake: %w", tls.AlertError(40)), "tls"},
+		{"other", errors.New("proxy said no"), "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorClass(tt.err); got != tt.want {
+				t.Fatalf("ErrorClass(%v)=%q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
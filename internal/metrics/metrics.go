@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "conduit"
+
+// Directions for TunnelBytes, relative to the client.
+const (
+	// Upstream is data sent by the client towards its destination.
+	Upstream = "upstream"
+	// Downstream is data sent by the destination back to the client.
+	Downstream = "downstream"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	// AcceptedConnections counts connections accepted, by listener.
+	AcceptedConnections = newCounterVec("accepted_connections_total", "Connections accepted, by listener.", "listener")
+
+	// NegotiationFailures counts connections or requests that failed
+	// before a tunnel was set up, by listener and reason.
+	NegotiationFailures = newCounterVec("negotiation_failures_total", "Proxy protocol negotiations that failed, by listener and reason.", "listener", "reason")
+
+	// ACLDenials counts connections or requests refused by an ACL, by
+	// listener.
+	ACLDenials = newCounterVec("acl_denials_total", "Connections and requests denied by an ACL, by listener.", "listener")
+
+	// ActiveTunnels is the number of tunnels currently being proxied, by
+	// listener.
+	ActiveTunnels = newGaugeVec("active_tunnels", "Tunnels currently being proxied, by listener.", "listener")
+
+	// TunnelBytes counts bytes proxied through tunnels, by listener and
+	// direction (Upstream or Downstream).  Running tunnels are counted
+	// periodically, and the rest when each direction finishes.
+	TunnelBytes = newCounterVec("tunnel_bytes_total", "Bytes proxied through tunnels, by listener and direction.", "listener", "direction")
+
+	// DialDuration observes how long dials via each upstream took,
+	// including failed ones.
+	DialDuration = register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dial_duration_seconds",
+		Help:      "Time taken to dial a destination via an upstream, by upstream.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream"}))
+
+	// DialErrors counts failed dials, by upstream and ErrorClass.
+	DialErrors = newCounterVec("dial_errors_total", "Failed dials, by upstream and error class.", "upstream", "class")
+
+	// SSHReconnects counts SSH transports established to replace an
+	// earlier one, by server address.
+	SSHReconnects = newCounterVec("ssh_reconnects_total", "SSH transport connections re-established after the first, by server.", "server")
+
+	// SSHActiveChannels is the number of open direct-tcpip channels, by
+	// server address.
+	SSHActiveChannels = newGaugeVec("ssh_active_channels", "Open SSH direct-tcpip channels, by server.", "server")
+
+	// DNSCacheLookups counts queries answered by the DNS cache, by result:
+	// "hit", "stale" (answered while being refreshed), or "miss".
+	DNSCacheLookups = newCounterVec("dns_cache_lookups_total", "DNS cache lookups, by result (hit, stale or miss).", "result")
+
+	// DNSQueries counts queries answered by the --dns-listen forwarder, by
+	// response code (e.g. "NOERROR", "NXDOMAIN" or "SERVFAIL").
+	DNSQueries = newCounterVec("dns_queries_total", "DNS queries answered by the DNS forwarder, by response code.", "rcode")
+
+	// HTTPResponses counts responses to proxied (non-CONNECT) HTTP
+	// requests, by listener and status code.
+	HTTPResponses = newCounterVec("http_responses_total", "Responses to proxied non-CONNECT HTTP requests, by listener and status code.", "listener", "code")
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func register[C prometheus.Collector](c C) C {
+	registry.MustRegister(c)
+	return c
+}
+
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return register(prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Name: name, Help: help}, labels))
+}
+
+func newGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	return register(prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Name: name, Help: help}, labels))
+}
+
+// Handler returns an http.Handler that serves the metrics in the Prometheus
+// exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
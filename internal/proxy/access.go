@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/die-net/conduit/internal/acl"
+	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/metrics"
+	"github.com/die-net/conduit/internal/session"
+)
+
+var errProxyAuthRequired = errors.New("proxy authentication required")
+
+// recordTarget records target, and the upstream d would use for it, in the
+// session in ctx.
+func recordTarget(ctx context.Context, d dialer.ContextDialer, target string) {
+	if sess := session.FromContext(ctx); sess != nil {
+		sess.SetTarget(target)
+		sess.SetUpstream(dialer.UpstreamName(d, target))
+	}
+}
+
+// checkACL returns an error wrapping acl.ErrDenied if cfg's ACL doesn't let
+// the session in ctx connect to target.  Otherwise, it returns a context to
+// dial target with, so that the ACL is checked again on the address that's
+// connected to.
+func checkACL(ctx context.Context, cfg *Config, target string) (context.Context, error) {
+	req := acl.NewRequest(session.FromContext(ctx), target)
+	if err := cfg.ACL.Check(ctx, req); err != nil {
+		metrics.ACLDenials.WithLabelValues(cfg.Name).Inc()
+		return ctx, err
+	}
+	return acl.NewContext(ctx, cfg.ACL, req), nil
+}
+
+// dialTarget dials target over TCP for the session in ctx, if cfg's ACL lets
+// it.  Refusals by the ACL, whether of target or of the address it's
+// connected to, return an error wrapping acl.ErrDenied and are counted.
+func dialTarget(ctx context.Context, cfg *Config, target string) (net.Conn, error) {
+	dialCtx, err := checkACL(ctx, cfg, target)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cfg.Dialer.DialContext(dialCtx, "tcp", target)
+	if errors.Is(err, acl.ErrDenied) {
+		metrics.ACLDenials.WithLabelValues(cfg.Name).Inc()
+	}
+	return c, err
+}
+
+// isDenied reports whether err is a refusal by policy, which clients are
+// told about as such rather than as a failure to connect.
+func isDenied(err error) bool {
+	return errors.Is(err, acl.ErrDenied) || errors.Is(err, dialer.ErrNotPublic)
+}
+
+// requestTarget returns the host:port a non-CONNECT proxy request is for.
+func requestTarget(r *http.Request) string {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if r.URL.Scheme == "https" || r.Header.Get("X-Proxy-Scheme") == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// accessWriter records the status, size, and any proxying error of a
+// response for the access log.
+type accessWriter struct {
+	http.ResponseWriter
+	n      *atomic.Int64
+	status int
+	err    error
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, to flush
+// or hijack it.
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// checkPassword reports whether password is correct for username in users.
+func checkPassword(users map[string]string, username, password string) bool {
+	want, ok := users[username]
+	return subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1 && ok
+}
+
+// proxyAuthUser returns the username from r's Basic Proxy-Authorization
+// header, if it's valid for users.
+func proxyAuthUser(users map[string]string, r *http.Request) (string, bool) {
+	scheme, cred, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		return "", false
+	}
+	username, password, ok := strings.Cut(string(b), ":")
+	if !ok || !checkPassword(users, username, password) {
+		return "", false
+	}
+	return username, true
+}
@@ -1,10 +1,16 @@
 package proxy
 
 import (
+	"log/slog"
 	"net"
+	"net/netip"
 	"time"
 
+	"github.com/die-net/conduit/internal/acl"
+	"github.com/die-net/conduit/internal/conn"
 	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/fakeip"
+	"github.com/die-net/conduit/internal/session"
 )
 
 // Config configures conduit proxy listeners (HTTP and SOCKS5).
@@ -13,11 +19,58 @@ import (
 // keepalive settings for accepted connections, and the outbound Dialer used to
 // reach target destinations.
 type Config struct {
+	// Name identifies the listener in metrics.
+	Name string
+
 	NegotiationTimeout time.Duration
 	HTTPIdleTimeout    time.Duration
 	HTTPMaxIdleConns   int
 
+	// TunnelIdleTimeout, if positive, closes tunnels that have carried no
+	// data in either direction for that long.
+	TunnelIdleTimeout time.Duration
+
+	// UDPIdleTimeout is how long the transparent proxy keeps a UDP session
+	// without a datagram in either direction.
+	UDPIdleTimeout time.Duration
+
 	KeepAlive net.KeepAliveConfig
 
 	Dialer dialer.ContextDialer
+
+	// Users, if non-empty, maps usernames to passwords that clients must
+	// authenticate with: HTTP Basic proxy authentication for the HTTP proxy,
+	// or username/password authentication for SOCKS5.
+	Users map[string]string
+
+	// Tracker, if set, counts the connections (or, for the HTTP proxy,
+	// requests) being served, so that shutdown can wait for them.
+	Tracker *conn.Tracker
+
+	// ACL, if set, decides which destinations clients may connect to.
+	ACL *acl.ACL
+
+	// Registry, if set, lists the connections (or, for non-CONNECT HTTP
+	// proxying, requests) being served, and lets them be closed.
+	Registry *session.Registry
+
+	// FakeIP, if set, maps the addresses handed out by the fake-IP DNS
+	// server back to hostnames, so that the transparent proxy can dial
+	// connections to them by name.
+	FakeIP *fakeip.Pool
+
+	// Sniff, for the transparent proxy, dials connections by the hostname
+	// that the client sends in a TLS ClientHello or HTTP Host header,
+	// rather than by their original destination address.
+	Sniff bool
+
+	// Self holds the addresses conduit listens on, an unspecified address
+	// standing for all local ones.  The transparent proxy refuses
+	// connections to them, which could only have been redirected back to
+	// it in a loop.
+	Self []netip.AddrPort
+
+	// AccessLog, if set, receives a record for each connection (or, for
+	// non-CONNECT HTTP proxying, each request) when it ends.
+	AccessLog *slog.Logger
 }
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // Required by the WebSocket handshake (RFC 6455).
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/die-net/conduit/internal/conn"
+	"github.com/die-net/conduit/internal/metrics"
+)
+
+// handleConnectStream handles CONNECT on an HTTP/2 connection (RFC 9113
+// section 8.5), which can't be hijacked.  Instead, the request body and
+// response writer of the stream are used as the client side of the tunnel.
+//
+// Extended CONNECT (RFC 8441) for WebSockets is also supported, by
+// performing an HTTP/1.1 WebSocket upgrade with the origin server and then
+// tunneling the WebSocket frames as-is.  Go's HTTP/2 server only accepts
+// extended CONNECT if GODEBUG=http2xconnect=1 is in the environment when
+// the process starts: it reads the setting from there rather than from
+// //go:debug directives, which reject it as unknown.
+func (s *HTTPProxyServer) handleConnectStream(st *httpProxyState, w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var (
+		serverConn net.Conn
+		err        error
+	)
+	switch protocol := r.Header.Get(":protocol"); protocol {
+	case "":
+		target := r.Host
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "443")
+		}
+		recordTarget(ctx, st.cfg.Dialer, target)
+		serverConn, err = dialTarget(ctx, &st.cfg, target)
+	case "websocket":
+		serverConn, err = s.dialWebSocket(ctx, st, w.Header(), r)
+	default:
+		metrics.NegotiationFailures.WithLabelValues(st.cfg.Name, "unsupported_protocol").Inc()
+		err := fmt.Errorf("unsupported protocol %q", protocol)
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return err
+	}
+	if err != nil {
+		var se *statusError
+		if errors.As(err, &se) {
+			http.Error(w, se.Error(), se.code)
+			return err
+		}
+		if isDenied(err) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return err
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		_ = serverConn.Close()
+		return err
+	}
+
+	_, err = conn.CopyBidirectional(ctx, &streamConn{body: r.Body, w: w, rc: rc}, serverConn, st.cfg.TunnelIdleTimeout)
+	return err
+}
+
+// streamConn adapts an HTTP/2 request body and response writer to an
+// io.ReadWriteCloser, for use as the client side of a tunnel.
+//
+// HTTP/2 handlers can't end the response stream without returning, so there
+// is no CloseWrite: once the destination is done sending, Close stops
+// reading the request body, which ends the tunnel.
+type streamConn struct {
+	body   io.ReadCloser
+	w      io.Writer
+	rc     *http.ResponseController
+	closed atomic.Bool
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if err != nil && c.closed.Load() {
+		// Reading after our own Close isn't an error worth reporting.
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write writes p to the response stream and flushes it to the client.
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// Close stops reading the request body. The response stream is ended when
+// the handler returns.
+func (c *streamConn) Close() error {
+	c.closed.Store(true)
+	return c.body.Close()
+}
+
+// webSocketGUID is appended to Sec-WebSocket-Key to compute
+// Sec-WebSocket-Accept (RFC 6455 section 1.3).
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// statusError is a handshake failure reported by the origin, which is passed
+// on to the client with the same status code.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("origin responded %d %s", e.code, http.StatusText(e.code))
+}
+
+// dialWebSocket connects to the origin of an RFC 8441 extended CONNECT
+// request and performs an HTTP/1.1 WebSocket upgrade, returning the
+// connection ready to carry WebSocket frames. Headers from the origin's
+// response that the client needs (subprotocol and extensions) are added to
+// respHeader.
+//
+// HTTP/2 doesn't pass the request's :scheme on to handlers, so, as with
+// non-CONNECT requests, the X-Proxy-Scheme header can select "http" (ws://)
+// or "https" (wss://). Otherwise port 80 implies ws:// and anything else
+// wss://.
+func (s *HTTPProxyServer) dialWebSocket(ctx context.Context, st *httpProxyState, respHeader http.Header, r *http.Request) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, ""
+	}
+
+	scheme := r.Header.Get("X-Proxy-Scheme")
+	switch {
+	case scheme != "":
+	case port == "80":
+		scheme = "http"
+	default:
+		scheme = "https"
+	}
+	if port == "" {
+		port = "443"
+		if scheme == "http" {
+			port = "80"
+		}
+	}
+
+	target := net.JoinHostPort(host, port)
+	recordTarget(ctx, st.cfg.Dialer, target)
+	c, err := dialTarget(ctx, &st.cfg, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.cfg.NegotiationTimeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(st.cfg.NegotiationTimeout))
+	}
+
+	if scheme == "https" {
+		tlsConn := tls.Client(c, &tls.Config{MinVersion: tls.VersionTLS12, ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("websocket tls handshake: %w", err)
+		}
+		c = tlsConn
+	}
+
+	var nonce [16]byte
+	_, _ = rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Host:       r.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header, len(r.Header)+3),
+	}
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, ":") || k == "X-Proxy-Scheme" || k == "Proxy-Authorization" {
+			continue
+		}
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", key)
+
+	if err := req.Write(c); err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("websocket upgrade write: %w", err)
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("websocket upgrade read: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = c.Close()
+		return nil, &statusError{code: resp.StatusCode}
+	}
+
+	sum := sha1.Sum([]byte(key + webSocketGUID)) //nolint:gosec // Required by RFC 6455.
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		_ = c.Close()
+		return nil, fmt.Errorf("websocket upgrade: invalid Sec-WebSocket-Accept from %s", r.Host)
+	}
+
+	for _, k := range []string{"Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions"} {
+		for _, v := range resp.Header.Values(k) {
+			respHeader.Add(k, v)
+		}
+	}
+
+	if st.cfg.NegotiationTimeout > 0 {
+		_ = c.SetDeadline(time.Time{})
+	}
+
+	return &bufferedConn{Conn: c, r: br}, nil
+}
+
+// bufferedConn is a net.Conn whose reads are served from r first, for when a
+// bufio.Reader may have read ahead of a handshake.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection if supported.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -4,27 +4,46 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/die-net/conduit/internal/acl"
 	"github.com/die-net/conduit/internal/conn"
 	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/metrics"
+	"github.com/die-net/conduit/internal/session"
 )
 
 // HTTPProxyServer serves an HTTP forward proxy.
 //
 // It supports:
 // - HTTP CONNECT tunneling (via connection hijacking + bidirectional copy)
+// - HTTP/2 CONNECT and extended CONNECT tunneling (via the request stream)
 // - non-CONNECT proxying (via httputil.ReverseProxy)
+//
+// HTTP/2 is accepted over TLS (when Serve is given a TLS listener that
+// offers "h2" via ALPN) and as cleartext HTTP/2 with prior knowledge (h2c).
 type HTTPProxyServer struct {
-	ctx    context.Context
-	dialer dialer.ContextDialer
-	srv    *http.Server
-	rp     *httputil.ReverseProxy
+	ctx   context.Context
+	srv   *http.Server
+	state atomic.Pointer[httpProxyState]
+}
+
+// httpProxyState is the configuration used for new requests, which SetConfig
+// replaces as a whole.
+type httpProxyState struct {
+	cfg Config
+	rp  *httputil.ReverseProxy
 }
 
 // NewHTTPProxyServer constructs an HTTP proxy server with the given config.
@@ -35,14 +54,27 @@ func NewHTTPProxyServer(ctx context.Context, cfg Config) *HTTPProxyServer {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	h := &HTTPProxyServer{ctx: ctx, dialer: cfg.Dialer, rp: newReverseProxy(cfg)}
+	h := &HTTPProxyServer{ctx: ctx}
+	h.SetConfig(cfg)
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
 	h.srv = &http.Server{
+		Protocols:         &protocols,
 		Handler:           http.HandlerFunc(h.handle),
 		ReadHeaderTimeout: cfg.NegotiationTimeout,
 		IdleTimeout:       cfg.HTTPIdleTimeout,
 		BaseContext: func(net.Listener) context.Context {
 			return h.ctx
 		},
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				metrics.AcceptedConnections.WithLabelValues(h.state.Load().cfg.Name).Inc()
+			}
+		},
 	}
 	return h
 }
@@ -57,24 +89,81 @@ func (s *HTTPProxyServer) Close() error {
 	return s.srv.Close()
 }
 
+// Shutdown stops accepting connections and waits until in-progress requests
+// are done or ctx is canceled, like http.Server.Shutdown.  Hijacked CONNECT
+// tunnels are left running.
+func (s *HTTPProxyServer) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// SetConfig replaces the dialer, users, and timeouts used for new requests.
+// Requests and tunnels already in progress are unaffected, as are the
+// http.Server's own timeouts, which are fixed when s is constructed.
+func (s *HTTPProxyServer) SetConfig(cfg Config) {
+	old := s.state.Swap(&httpProxyState{cfg: cfg, rp: newReverseProxy(cfg)})
+	if old != nil {
+		closeIdleConnections(old.rp.Transport)
+	}
+}
+
 func (s *HTTPProxyServer) handle(w http.ResponseWriter, r *http.Request) {
+	st := s.state.Load()
+	defer st.cfg.Tracker.Add()()
+
+	sess := session.New(st.cfg.Name, "http", r.RemoteAddr)
+	ctx, cancel := context.WithCancel(session.NewContext(r.Context(), sess))
+	defer cancel()
+	defer st.cfg.Registry.Add(sess, cancel)()
+	r = r.WithContext(ctx)
+
+	if len(st.cfg.Users) > 0 {
+		user, ok := proxyAuthUser(st.cfg.Users, r)
+		if !ok {
+			metrics.NegotiationFailures.WithLabelValues(st.cfg.Name, "auth").Inc()
+			w.Header().Set("Proxy-Authenticate", `Basic realm="conduit"`)
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			sess.LogAccess(ctx, st.cfg.AccessLog, errProxyAuthRequired, slog.String("method", r.Method), slog.Int("status", http.StatusProxyAuthRequired))
+			return
+		}
+		sess.SetUser(user)
+	}
+
 	if strings.EqualFold(r.Method, http.MethodConnect) {
-		s.handleConnect(w, r)
+		err := s.handleConnect(st, w, r)
+		sess.LogAccess(ctx, st.cfg.AccessLog, err, slog.String("method", r.Method))
 		return
 	}
-	s.rp.ServeHTTP(w, r)
+
+	target := requestTarget(r)
+	recordTarget(ctx, st.cfg.Dialer, target)
+	dialCtx, err := checkACL(ctx, &st.cfg, target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		sess.LogAccess(ctx, st.cfg.AccessLog, err, slog.String("method", r.Method), slog.String("url", r.URL.String()), slog.Int("status", http.StatusForbidden))
+		return
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReader{ReadCloser: r.Body, n: &sess.BytesUp}
+	}
+	aw := &accessWriter{ResponseWriter: w, n: &sess.BytesDown}
+	st.rp.ServeHTTP(aw, r.WithContext(dialCtx))
+	sess.LogAccess(ctx, st.cfg.AccessLog, aw.err, slog.String("method", r.Method), slog.String("url", r.URL.String()), slog.Int("status", aw.status))
 }
 
-func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request) {
+func (s *HTTPProxyServer) handleConnect(st *httpProxyState, w http.ResponseWriter, r *http.Request) error {
+	if r.ProtoMajor == 2 {
+		return s.handleConnectStream(st, w, r)
+	}
+
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
-		return
+		return errors.New("hijacking not supported")
 	}
 	clientConn, brw, err := hj.Hijack()
 	if err != nil {
 		http.Error(w, "hijack failed", http.StatusInternalServerError)
-		return
+		return err
 	}
 	_ = brw.Flush()
 
@@ -84,19 +173,25 @@ func (s *HTTPProxyServer) handleConnect(w http.ResponseWriter, r *http.Request)
 	}
 
 	ctx := r.Context()
+	recordTarget(ctx, st.cfg.Dialer, target)
 
-	serverConn, err := s.dialer.DialContext(ctx, "tcp", target)
+	serverConn, err := dialTarget(ctx, &st.cfg, target)
 	if err != nil {
-		_, _ = writeError(brw, err, 502)
+		code := http.StatusBadGateway
+		if isDenied(err) {
+			code = http.StatusForbidden
+		}
+		_, _ = writeError(brw, err, code)
 		_ = brw.Flush()
 		_ = clientConn.Close()
-		return
+		return err
 	}
 
 	_, _ = brw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
 	_ = brw.Flush()
 
-	_ = conn.CopyBidirectional(ctx, clientConn, serverConn)
+	_, err = conn.CopyBidirectional(ctx, clientConn, serverConn, st.cfg.TunnelIdleTimeout)
+	return err
 }
 
 // writeError simulates http.Error() for use on a hijacked connection.
@@ -132,16 +227,35 @@ func newReverseProxy(cfg Config) *httputil.ReverseProxy {
 		r.Header["X-Forwarded-For"] = nil
 	}
 
+	responses := metrics.HTTPResponses.MustCurryWith(prometheus.Labels{"listener": cfg.Name})
+
+	modifyResponse := func(resp *http.Response) error {
+		responses.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+		return nil
+	}
+
 	errHandler := func(w http.ResponseWriter, _ *http.Request, err error) {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		if aw, ok := w.(*accessWriter); ok {
+			aw.err = err
+		}
+		code := http.StatusBadGateway
+		if isDenied(err) {
+			code = http.StatusForbidden
+		}
+		if errors.Is(err, acl.ErrDenied) {
+			metrics.ACLDenials.WithLabelValues(cfg.Name).Inc()
+		}
+		responses.WithLabelValues(strconv.Itoa(code)).Inc()
+		http.Error(w, err.Error(), code)
 	}
 
 	return &httputil.ReverseProxy{
-		Director:      director,
-		Transport:     newTransport(cfg),
-		FlushInterval: 10 * time.Millisecond, // Only buffer incomplete responses briefly
-		ErrorHandler:  errHandler,
-		BufferPool:    NewBufferPool(32768),
+		Director:       director,
+		Transport:      newTransport(cfg),
+		FlushInterval:  10 * time.Millisecond, // Only buffer incomplete responses briefly
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errHandler,
+		BufferPool:     NewBufferPool(32768),
 	}
 }
 
@@ -159,13 +273,32 @@ func newTransport(cfg Config) http.RoundTripper {
 		},
 	}
 
-	// For non-CONNECT HTTP proxying, prefer the standard library proxy support when the
-	// configured dialer is an HTTP proxy.
-	if up, ok := cfg.Dialer.(*dialer.HTTPProxyDialer); ok {
-		t.Proxy = http.ProxyURL(up.ProxyURL())
-		// When using Transport.Proxy, DialContext is used to connect to the proxy itself.
-		t.DialContext = up.Direct().DialContext
+	// For non-CONNECT HTTP proxying via an HTTP proxy, send http:// requests
+	// to the proxy as-is using the standard library's proxy support, but
+	// tunnel https:// requests with the dialer's CONNECT, which handles
+	// proxy authentication and HTTP/2 to the proxy.
+	up, ok := dialer.Unwrap(cfg.Dialer).(*dialer.HTTPProxyDialer)
+	if !ok {
+		return t
+	}
+
+	pt := t.Clone()
+	// When using Transport.Proxy, DialContext is used to connect to the
+	// proxy itself.  DialProxy already does any TLS handshake with the
+	// proxy (using the dialer's TLS settings), so present it to the
+	// Transport as a plain http:// proxy.  Credentials are handled by
+	// proxyAuthTransport rather than the Transport's Basic auth.
+	proxyURL := *up.ProxyURL()
+	proxyURL.Scheme = "http"
+	proxyURL.User = nil
+	pt.Proxy = http.ProxyURL(&proxyURL)
+	pt.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return up.DialProxy(ctx, network)
 	}
 
-	return t
+	var plain http.RoundTripper = pt
+	if auth := up.Authenticator(); auth != nil {
+		plain = &proxyAuthTransport{base: pt, auth: auth}
+	}
+	return &schemeTransport{plain: plain, tls: t}
 }
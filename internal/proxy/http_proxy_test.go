@@ -3,18 +3,27 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"crypto/sha1" //nolint:gosec // Required by the WebSocket handshake (RFC 6455).
+	"crypto/tls"
+	"encoding/base64"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"os/exec"
 	"strings"
 	"testing"
 	"time"
 
+	"golang.org/x/net/http2"
+
+	"github.com/die-net/conduit/internal/acl"
 	"github.com/die-net/conduit/internal/conn"
 	"github.com/die-net/conduit/internal/dialer"
 	"github.com/die-net/conduit/internal/testutil"
+	"github.com/die-net/conduit/internal/tlsconfig"
 )
 
 func TestHTTPProxyNonConnect(t *testing.T) {
@@ -214,6 +223,72 @@ func TestHTTPProxyConnectDirect(t *testing.T) {
 	testutil.AssertEcho(t, c, br, []byte("hello"))
 }
 
+func TestHTTPProxyACL(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	dr, err := dialer.NewDirectDialer(dialer.Config{DialTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deny the echo server's port.
+	_, port, _ := net.SplitHostPort(echoLn.Addr().String())
+	denied, err := acl.ParsePortRange(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	srv := NewHTTPProxyServer(ctx, Config{
+		Dialer:             dr,
+		NegotiationTimeout: 2 * time.Second,
+		ACL:                &acl.ACL{Rules: []acl.Rule{{Action: acl.Deny, Ports: []acl.PortRange{denied}}}},
+	})
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	d, err := dialer.New(dialer.Config{DialTimeout: 2 * time.Second, NegotiationTimeout: 2 * time.Second}, "http://"+ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(ctx, "tcp", echoLn.Addr().String()); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("CONNECT to denied port: err=%v, want 403", err)
+	}
+
+	proxyURL, _ := url.Parse("http://" + ln.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for _, tt := range []struct {
+		url  string
+		code int
+	}{
+		{url: upstream.URL, code: http.StatusOK},
+		{url: "http://" + echoLn.Addr().String() + "/", code: http.StatusForbidden},
+	} {
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Fatalf("GET %s: status=%d, want %d", tt.url, resp.StatusCode, tt.code)
+		}
+	}
+}
+
 func BenchmarkHTTPProxyDirect(b *testing.B) {
 	b.ReportAllocs()
 	b.SetBytes(1)
@@ -283,3 +358,286 @@ func BenchmarkHTTPProxyDirect(b *testing.B) {
 		}
 	})
 }
+
+func startHTTPProxy(t *testing.T, tlsCfg *tls.Config) net.Listener {
+	t.Helper()
+
+	dr, err := dialer.NewDirectDialer(dialer.Config{
+		DialTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		NegotiationTimeout: 2 * time.Second,
+		HTTPIdleTimeout:    1 * time.Second,
+		Dialer:             dr,
+	}
+
+	ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsCfg != nil {
+		tlsCfg.NextProtos = []string{"h2", "http/1.1"}
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+
+	srv := NewHTTPProxyServer(context.Background(), cfg)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		_ = ln.Close()
+	})
+
+	return ln
+}
+
+// h2cConnect sends a CONNECT request to the proxy at proxyAddr using
+// cleartext HTTP/2, returning the response and a writer for the request body.
+func h2cConnect(ctx context.Context, t *testing.T, proxyAddr, target string) (*http.Response, io.WriteCloser) {
+	t.Helper()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	tr := &http.Transport{Protocols: &protocols}
+	t.Cleanup(tr.CloseIdleConnections)
+
+	pr, pw := io.Pipe()
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "http", Host: proxyAddr},
+		Host:   target,
+		Header: make(http.Header),
+		Body:   pr,
+	}).WithContext(ctx)
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = pw.Close()
+		_ = resp.Body.Close()
+	})
+	return resp, pw
+}
+
+func TestHTTPProxyConnectHTTP2TLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	certs := testutil.NewTLSCerts(t)
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	ln := startHTTPProxy(t, certs.ServerConfig(false))
+
+	up, err := dialer.New(dialer.Config{
+		DialTimeout:        2 * time.Second,
+		NegotiationTimeout: 2 * time.Second,
+		TLS:                tlsconfig.Options{CAFile: certs.CAFile},
+	}, "https://"+ln.Addr().String()+"?h2=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := up.DialContext(ctx, "tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	testutil.AssertEcho(t, c, c, []byte("hello"))
+}
+
+func TestHTTPProxyConnectH2C(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	ln := startHTTPProxy(t, nil)
+
+	resp, w := h2cConnect(ctx, t, ln.Addr().String(), echoLn.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2 got %s", resp.Proto)
+	}
+
+	testutil.AssertEcho(t, w, resp.Body, []byte("hello"))
+
+	// Dial failures are reported with a status code rather than a tunnel.
+	resp, _ = h2cConnect(ctx, t, ln.Addr().String(), "127.0.0.1:1")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPProxyExtendedConnectWebSocket(t *testing.T) {
+	// Go's HTTP/2 server only reads http2xconnect from the environment as
+	// the process starts, so run the test again in one that has it.
+	godebug := os.Getenv("GODEBUG")
+	if !strings.Contains(godebug, "http2xconnect=1") {
+		if godebug != "" {
+			godebug += ","
+		}
+		cmd := exec.CommandContext(t.Context(), os.Args[0], "-test.run=^TestHTTPProxyExtendedConnectWebSocket$") //nolint:gosec // The test binary itself.
+		cmd.Env = append(os.Environ(), "GODEBUG="+godebug+"http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A minimal HTTP/1.1 WebSocket origin that echoes raw bytes after the
+	// upgrade.
+	gotPath := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath <- r.URL.RequestURI()
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-Websocket-Version") != "13" {
+			http.Error(w, "bad upgrade", http.StatusBadRequest)
+			return
+		}
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + webSocketGUID)) //nolint:gosec // Required by RFC 6455.
+
+		c, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Protocol: chat\r\nSec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+		_ = brw.Flush()
+
+		buf := make([]byte, 1024)
+		n, err := brw.Read(buf)
+		if err != nil {
+			return
+		}
+		_, _ = c.Write(buf[:n])
+	}))
+	defer origin.Close()
+
+	dr, err := dialer.NewDirectDialer(dialer.Config{DialTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewHTTPProxyServer(ctx, Config{NegotiationTimeout: 2 * time.Second, Dialer: dr})
+
+	// An HTTP/2 server in front of the proxy, and a client that sends the
+	// extended CONNECT through it.
+	front := httptest.NewUnstartedServer(http.HandlerFunc(srv.handle))
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	defer front.Close()
+
+	// net/http's client refuses the :protocol pseudo-header, so use
+	// x/net's.
+	tr := &http2.Transport{TLSClientConfig: front.Client().Transport.(*http.Transport).TLSClientConfig}
+	defer tr.CloseIdleConnections()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: strings.TrimPrefix(front.URL, "https://"), Path: "/chat"},
+		Host:   strings.TrimPrefix(origin.URL, "http://"),
+		Header: http.Header{
+			":protocol":              {"websocket"},
+			"Sec-Websocket-Version":  {"13"},
+			"Sec-Websocket-Protocol": {"chat"},
+			"X-Proxy-Scheme":         {"http"},
+		},
+		Body: pr,
+	}).WithContext(ctx)
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2 got %s", resp.Proto)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "chat" {
+		t.Fatalf("expected subprotocol %q got %q", "chat", got)
+	}
+	if got := <-gotPath; got != "/chat" {
+		t.Fatalf("expected path %q got %q", "/chat", got)
+	}
+
+	testutil.AssertEcho(t, pw, resp.Body, []byte("hello"))
+}
+
+func TestHTTPProxyAuth(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		userinfo string
+		wantErr  bool
+	}{
+		{name: "valid", userinfo: "alice:secret@"},
+		{name: "wrong password", userinfo: "alice:wrong@", wantErr: true},
+		{name: "no auth", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+			defer echoStop()
+
+			dr, err := dialer.NewDirectDialer(dialer.Config{DialTimeout: 2 * time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			srv := NewHTTPProxyServer(ctx, Config{
+				Dialer:             dr,
+				NegotiationTimeout: 2 * time.Second,
+				Users:              map[string]string{"alice": "secret"},
+			})
+			go func() { _ = srv.Serve(ln) }()
+			defer srv.Close()
+
+			d, err := dialer.New(dialer.Config{DialTimeout: 2 * time.Second, NegotiationTimeout: 2 * time.Second}, "http://"+tt.userinfo+ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := d.DialContext(ctx, "tcp", echoLn.Addr().String())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err=%v wantErr=%v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer c.Close()
+
+			testutil.AssertEcho(t, c, c, []byte("hello"))
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"errors"
+
+	"github.com/die-net/conduit/internal/metrics"
+	"github.com/die-net/conduit/internal/socks5"
+)
+
+// negotiationFailed records a failed negotiation with a client of the named
+// listener in metrics.
+func negotiationFailed(listener string, err error) {
+	metrics.NegotiationFailures.WithLabelValues(listener, negotiationReason(err)).Inc()
+}
+
+// negotiationReason classifies why negotiation with a client failed: "auth",
+// "no_acceptable_methods", "timeout", "reset", "tls", or "protocol".
+func negotiationReason(err error) string {
+	switch {
+	case errors.Is(err, socks5.ErrAuthFailed):
+		return "auth"
+	case errors.Is(err, socks5.ErrNoAcceptableMethods):
+		return "no_acceptable_methods"
+	}
+	switch class := metrics.ErrorClass(err); class {
+	case "timeout", "reset", "tls":
+		return class
+	default:
+		return "protocol"
+	}
+}
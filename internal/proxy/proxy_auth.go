@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/die-net/conduit/internal/dialer"
+)
+
+// proxyAuthTransport authenticates requests sent to an upstream HTTP proxy,
+// retrying them when the proxy responds 407 with a challenge that auth can
+// answer.
+//
+// Requests with a body can only be retried if GetBody is set.  Otherwise the
+// 407 is returned as-is, though schemes like Digest usually authorize later
+// requests preemptively.
+type proxyAuthTransport struct {
+	base http.RoundTripper
+	auth dialer.ProxyAuthenticator
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	if _, err := dialer.SetProxyAuthorization(t.auth, out, nil); err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	for round := 1; ; round++ {
+		resp, err := t.base.RoundTrip(out)
+		if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || round >= dialer.MaxAuthRounds {
+			return resp, err
+		}
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, nil
+		}
+
+		next := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if next.Body, err = req.GetBody(); err != nil {
+				return resp, nil
+			}
+		}
+		if ok, err := dialer.SetProxyAuthorization(t.auth, next, resp); err != nil || !ok {
+			closeBody(next)
+			return resp, nil
+		}
+
+		dialer.DrainChallenge(resp)
+		out = next
+	}
+}
+
+// CloseIdleConnections closes idle connections in the underlying transport.
+func (t *proxyAuthTransport) CloseIdleConnections() {
+	closeIdleConnections(t.base)
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
+
+// schemeTransport sends https:// requests via tls and everything else via
+// plain.
+type schemeTransport struct {
+	plain, tls http.RoundTripper
+}
+
+func (t *schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.tls.RoundTrip(req)
+	}
+	return t.plain.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections in both transports.
+func (t *schemeTransport) CloseIdleConnections() {
+	closeIdleConnections(t.plain)
+	closeIdleConnections(t.tls)
+}
+
+func closeIdleConnections(rt http.RoundTripper) {
+	if ci, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/die-net/conduit/internal/conn"
+	"github.com/die-net/conduit/internal/dialer"
+)
+
+// tokenAuth is a two-round authenticator: it sends "Test hello"
+// preemptively and answers a "Test round2" challenge with "Test answer2".
+type tokenAuth struct{}
+
+func (tokenAuth) Authorize(_ *http.Request, challenge *http.Response) (string, error) {
+	if challenge == nil {
+		return "Test hello", nil
+	}
+	if challenge.Header.Get("Proxy-Authenticate") == "Test round2" {
+		return "Test answer2", nil
+	}
+	return "", nil
+}
+
+func TestHTTPProxyNonConnectUpstreamAuth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The upstream "proxy" answers requests itself once authenticated.
+	var rounds atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rounds.Add(1)
+		switch r.Header.Get("Proxy-Authorization") {
+		case "Test hello":
+			w.Header().Set("Proxy-Authenticate", "Test round2")
+			http.Error(w, "round 2", http.StatusProxyAuthRequired)
+		case "Test answer2":
+			body, _ := io.ReadAll(r.Body)
+			_, _ = io.WriteString(w, r.Method+" "+r.URL.String()+" "+string(body))
+		default:
+			w.Header().Set("Proxy-Authenticate", "Test")
+			http.Error(w, "denied", http.StatusProxyAuthRequired)
+		}
+	}))
+	defer upstream.Close()
+
+	dr, err := dialer.New(dialer.Config{DialTimeout: 2 * time.Second, ProxyAuth: tokenAuth{}}, upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	srv := NewHTTPProxyServer(ctx, Config{NegotiationTimeout: 2 * time.Second, HTTPIdleTimeout: time.Second, Dialer: dr})
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	proxyURL, err := url.Parse("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://example.invalid/path", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The incoming request body can't be replayed, so the 407 is passed on.
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected 407 for unreplayable body, got %d", resp.StatusCode)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://example.invalid/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rounds.Store(0)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "GET http://example.invalid/path " {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	if n := rounds.Load(); n != 2 {
+		t.Fatalf("expected 2 rounds, got %d", n)
+	}
+}
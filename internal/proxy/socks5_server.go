@@ -3,20 +3,25 @@ package proxy
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/die-net/conduit/internal/conn"
+	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/metrics"
+	"github.com/die-net/conduit/internal/session"
 	"github.com/die-net/conduit/internal/socks5"
 )
 
 // SOCKS5Server serves a SOCKS5 proxy listener.
 //
-// It currently supports no-auth negotiation and the CONNECT command.
+// It supports no-auth or username/password negotiation (if Config.Users is
+// set) and the CONNECT command.
 type SOCKS5Server struct {
 	ctx     context.Context
-	cfg     Config
+	cfg     atomic.Pointer[Config]
 	Verbose bool
 }
 
@@ -25,7 +30,15 @@ func NewSOCKS5Server(ctx context.Context, cfg Config, verbose bool) *SOCKS5Serve
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	return &SOCKS5Server{ctx: ctx, cfg: cfg, Verbose: verbose}
+	s := &SOCKS5Server{ctx: ctx, Verbose: verbose}
+	s.SetConfig(cfg)
+	return s
+}
+
+// SetConfig replaces the dialer, users, and timeouts used for new
+// connections.  Connections already being served are unaffected.
+func (s *SOCKS5Server) SetConfig(cfg Config) {
+	s.cfg.Store(&cfg)
 }
 
 // Serve accepts connections from ln and serves SOCKS5.
@@ -37,42 +50,71 @@ func (s *SOCKS5Server) Serve(ln net.Listener) error {
 		if err != nil {
 			return fmt.Errorf("accept: %w", err)
 		}
+		cfg := s.cfg.Load()
+		metrics.AcceptedConnections.WithLabelValues(cfg.Name).Inc()
+		done := cfg.Tracker.Add()
 		go func() {
-			if err := s.handleConn(c); err != nil {
+			defer done()
+			if err := s.handleConn(cfg, c); err != nil {
 				if s.Verbose {
-					log.Printf("socks5: connection error: %v", err)
+					slog.Info("connection error", "listener", cfg.Name, "protocol", "socks5", "client", c.RemoteAddr().String(), "error", err)
 				}
 			}
 		}()
 	}
 }
 
-func (s *SOCKS5Server) handleConn(c net.Conn) error {
+func (s *SOCKS5Server) handleConn(cfg *Config, c net.Conn) (err error) {
 	defer c.Close()
-	ctx, cancel := context.WithCancel(s.ctx)
+	sess := session.New(cfg.Name, "socks5", c.RemoteAddr().String())
+	ctx, cancel := context.WithCancel(session.NewContext(s.ctx, sess))
 	defer cancel()
+	defer cfg.Registry.Add(sess, cancel)()
+	defer func() {
+		sess.LogAccess(ctx, cfg.AccessLog, err)
+	}()
+	// Closing the session via the registry interrupts negotiation, too.
+	stop := context.AfterFunc(ctx, func() { _ = c.Close() })
+	defer stop()
 
-	if s.cfg.NegotiationTimeout > 0 {
-		_ = c.SetDeadline(time.Now().Add(s.cfg.NegotiationTimeout))
+	if cfg.NegotiationTimeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(cfg.NegotiationTimeout))
 	}
 
-	if err := socks5.ServerNegotiateNoAuth(c); err != nil {
+	var verify func(username, password string) bool
+	if len(cfg.Users) > 0 {
+		verify = func(username, password string) bool {
+			return checkPassword(cfg.Users, username, password)
+		}
+	}
+	user, err := socks5.ServerNegotiateFunc(c, verify)
+	if err != nil {
+		negotiationFailed(cfg.Name, err)
 		return err
 	}
+	sess.SetUser(user)
 
 	req, err := socks5.ServerReadRequest(c)
 	if err != nil {
+		negotiationFailed(cfg.Name, err)
 		return err
 	}
 	if req.Cmd != socks5.CmdConnect {
+		metrics.NegotiationFailures.WithLabelValues(cfg.Name, "unsupported_command").Inc()
 		socks5.WriteCommandNotSupportedReply(c, req.Atyp)
 		return fmt.Errorf("unsupported command: %d", req.Cmd)
 	}
 
 	dst := req.Address()
+	sess.SetTarget(dst)
+	sess.SetUpstream(dialer.UpstreamName(cfg.Dialer, dst))
 
-	up, err := s.cfg.Dialer.DialContext(ctx, "tcp", dst)
+	up, err := dialTarget(ctx, cfg, dst)
 	if err != nil {
+		if isDenied(err) {
+			socks5.WriteNotAllowedReply(c, req.Atyp)
+			return err
+		}
 		socks5.WriteConnectionRefusedReply(c, req.Atyp)
 		return err
 	}
@@ -82,12 +124,12 @@ func (s *SOCKS5Server) handleConn(c net.Conn) error {
 		return err
 	}
 
-	if s.cfg.NegotiationTimeout > 0 {
+	if cfg.NegotiationTimeout > 0 {
 		_ = c.SetDeadline(time.Time{})
 	}
 
 	// Once we've finished the SOCKS5 handshake, switch to bidirectional proxying.
-	if err := conn.CopyBidirectional(ctx, c, up); err != nil {
+	if _, err := conn.CopyBidirectional(ctx, c, up, cfg.TunnelIdleTimeout); err != nil {
 		return fmt.Errorf("proxy: %w", err)
 	}
 	return nil
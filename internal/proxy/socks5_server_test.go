@@ -1,15 +1,30 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"log/slog"
 	"net"
+	"net/netip"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	txsocks5 "github.com/txthinking/socks5"
+
+	"github.com/die-net/conduit/internal/acl"
 	"github.com/die-net/conduit/internal/conn"
 	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/hosts"
+	"github.com/die-net/conduit/internal/metrics"
 	"github.com/die-net/conduit/internal/socks5"
 	"github.com/die-net/conduit/internal/testutil"
+	"github.com/die-net/conduit/internal/tlsconfig"
 )
 
 func TestSOCKS5ConnectDirect(t *testing.T) {
@@ -56,3 +71,381 @@ func TestSOCKS5ConnectDirect(t *testing.T) {
 
 	testutil.AssertEcho(t, c, c, []byte("hello"))
 }
+
+func TestSOCKS5ACL(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	dr, err := dialer.NewDirectDialer(dialer.Config{DialTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	srv := NewSOCKS5Server(context.Background(), Config{
+		Dialer:             dr,
+		NegotiationTimeout: 2 * time.Second,
+		ACL: &acl.ACL{Rules: []acl.Rule{
+			{Action: acl.Deny, IPs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+		}},
+	}, false)
+	go func() { _ = srv.Serve(ln) }()
+
+	d := net.Dialer{}
+	c, err := d.DialContext(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := socks5.ClientDial(c, socks5.Auth{}, echoLn.Addr().String()); err == nil {
+		t.Fatal("CONNECT to a denied address succeeded")
+	}
+}
+
+// staticResolver resolves hostnames from a map, for ACLs.
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	return r[host], nil
+}
+
+// A hostname that the ACL resolves to an allowed address is still denied
+// if it's connected to at a denied one.
+func TestSOCKS5ACLConnectedAddress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	direct, err := dialer.NewDirectDialer(dialer.Config{DialTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	override, err := hosts.NewOverride([]string{"rebind.test"}, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	const name = "socks-acl-connected"
+	srv := NewSOCKS5Server(context.Background(), Config{
+		Name:               name,
+		Dialer:             dialer.NewHostsDialer(hosts.Map{override}, direct),
+		NegotiationTimeout: 2 * time.Second,
+		ACL: &acl.ACL{
+			Rules:    []acl.Rule{{Action: acl.Deny, IPs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}},
+			Resolver: staticResolver{"rebind.test": {netip.MustParseAddr("192.0.2.1")}},
+		},
+	}, false)
+	go func() { _ = srv.Serve(ln) }()
+
+	d := net.Dialer{}
+	c, err := d.DialContext(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+
+	_, port, _ := net.SplitHostPort(echoLn.Addr().String())
+	p, _ := strconv.Atoi(port)
+	host := "rebind.test"
+	req := append([]byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}, host...)
+	req = append(req, byte(p>>8), byte(p))
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	// The negotiation reply, then the request's.
+	if reply[1] != 0 || reply[3] != txsocks5.RepNotAllowed {
+		t.Errorf("replies %v, want connection not allowed", reply)
+	}
+	if n := promtest.ToFloat64(metrics.ACLDenials.WithLabelValues(name)); n != 1 {
+		t.Errorf("ACL denials = %v, want 1", n)
+	}
+}
+
+func TestSOCKS5ConnectTLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	certs := testutil.NewTLSCerts(t)
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	dr, err := dialer.NewDirectDialer(dialer.Config{
+		DialTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		Dialer:             dr,
+		NegotiationTimeout: 2 * time.Second,
+	}
+
+	serverOpts := tlsconfig.Options{CertFile: certs.ServerCertFile, KeyFile: certs.ServerKeyFile, CAFile: certs.CAFile}
+	tlsCfg, err := serverOpts.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = tls.NewListener(ln, tlsCfg)
+	defer ln.Close()
+
+	srv := NewSOCKS5Server(context.Background(), cfg, false)
+	go func() { _ = srv.Serve(ln) }()
+
+	up, err := dialer.NewSOCKS5TLSProxyDialer(dialer.Config{
+		DialTimeout:        2 * time.Second,
+		NegotiationTimeout: 2 * time.Second,
+		TLS:                tlsconfig.Options{CAFile: certs.CAFile, CertFile: certs.ClientCertFile, KeyFile: certs.ClientKeyFile},
+	}, ln.Addr().String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := up.DialContext(ctx, "tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	testutil.AssertEcho(t, c, c, []byte("hello"))
+
+	// Without a client certificate, the listener rejects the handshake.
+	noCert, err := dialer.NewSOCKS5TLSProxyDialer(dialer.Config{
+		DialTimeout: 2 * time.Second,
+		TLS:         tlsconfig.Options{CAFile: certs.CAFile},
+	}, ln.Addr().String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := noCert.DialContext(ctx, "tcp", echoLn.Addr().String()); err == nil {
+		_ = c.Close()
+		t.Fatal("expected error without client certificate")
+	}
+}
+
+func TestSOCKS5ConnectAuth(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		auth    socks5.Auth
+		wantErr bool
+	}{
+		{name: "valid", auth: socks5.Auth{Username: "alice", Password: "secret"}},
+		{name: "wrong password", auth: socks5.Auth{Username: "alice", Password: "wrong"}, wantErr: true},
+		{name: "unknown user", auth: socks5.Auth{Username: "mallory", Password: "secret"}, wantErr: true},
+		{name: "no auth", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+			defer echoStop()
+
+			dr, err := dialer.NewDirectDialer(dialer.Config{DialTimeout: 2 * time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			srv := NewSOCKS5Server(ctx, Config{
+				Dialer:             dr,
+				NegotiationTimeout: 2 * time.Second,
+				Users:              map[string]string{"alice": "secret"},
+			}, false)
+			go func() { _ = srv.Serve(ln) }()
+
+			d, err := dialer.NewSOCKS5ProxyDialer(dialer.Config{DialTimeout: 2 * time.Second, NegotiationTimeout: 2 * time.Second}, ln.Addr().String(), tt.auth.Username, tt.auth.Password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := d.DialContext(ctx, "tcp", echoLn.Addr().String())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err=%v wantErr=%v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer c.Close()
+
+			testutil.AssertEcho(t, c, c, []byte("hello"))
+		})
+	}
+}
+
+func TestSOCKS5SetConfig(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	dr, err := dialer.NewDirectDialer(dialer.Config{DialTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := Config{Dialer: dr, NegotiationTimeout: 2 * time.Second, Users: map[string]string{"alice": "secret"}}
+	srv := NewSOCKS5Server(ctx, cfg, false)
+	go func() { _ = srv.Serve(ln) }()
+
+	dial := func(username, password string) (net.Conn, error) {
+		d, err := dialer.NewSOCKS5ProxyDialer(dialer.Config{DialTimeout: 2 * time.Second, NegotiationTimeout: 2 * time.Second}, ln.Addr().String(), username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.DialContext(ctx, "tcp", echoLn.Addr().String())
+	}
+
+	before, err := dial("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+
+	cfg.Users = map[string]string{"bob": "hunter2"}
+	srv.SetConfig(cfg)
+
+	if c, err := dial("alice", "secret"); err == nil {
+		c.Close()
+		t.Fatal("old credentials accepted after SetConfig")
+	}
+	after, err := dial("bob", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+
+	// Both the tunnel established before SetConfig and the new one work.
+	testutil.AssertEcho(t, before, before, []byte("before"))
+	testutil.AssertEcho(t, after, after, []byte("after"))
+}
+
+func TestSOCKS5AccessLog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	dr, err := dialer.NewDirectDialer(dialer.Config{DialTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := conn.ListenTCP("tcp", "127.0.0.1:0", net.KeepAliveConfig{Enable: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var (
+		mu  sync.Mutex
+		buf bytes.Buffer
+	)
+	logged := make(chan struct{}, 1)
+	h := slog.NewJSONHandler(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged <- struct{}{}
+		return buf.Write(p)
+	}), nil)
+
+	srv := NewSOCKS5Server(ctx, Config{
+		Name:               "lab",
+		Dialer:             dialer.NewInstrumented("direct", dr),
+		NegotiationTimeout: 2 * time.Second,
+		Users:              map[string]string{"alice": "secret"},
+		AccessLog:          slog.New(h),
+	}, false)
+	go func() { _ = srv.Serve(ln) }()
+
+	d, err := dialer.NewSOCKS5ProxyDialer(dialer.Config{DialTimeout: 2 * time.Second, NegotiationTimeout: 2 * time.Second}, ln.Addr().String(), "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(ctx, "tcp", echoLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEcho(t, c, c, []byte("hello"))
+	c.Close()
+
+	select {
+	case <-logged:
+	case <-ctx.Done():
+		t.Fatal("no access log record")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	for k, want := range map[string]any{
+		"msg":        "access",
+		"listener":   "lab",
+		"protocol":   "socks5",
+		"user":       "alice",
+		"target":     echoLn.Addr().String(),
+		"upstream":   "direct",
+		"bytes_up":   float64(5),
+		"bytes_down": float64(5),
+		"result":     "ok",
+	} {
+		if rec[k] != want {
+			t.Errorf("%s=%v, want %v", k, rec[k], want)
+		}
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,228 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/die-net/conduit/internal/metrics"
+)
+
+// staleTTL is the TTL given to records in a stale response, as RFC 8767
+// recommends.
+const staleTTL = 30
+
+// defaultCacheSize is the default maximum number of cached responses.
+const defaultCacheSize = 10000
+
+// CacheConfig configures a Cache.
+type CacheConfig struct {
+	// MinTTL and MaxTTL clamp how long responses are cached, which is
+	// otherwise the smallest TTL of their records (or, for NXDOMAIN and
+	// empty responses, that of the zone's SOA record, per RFC 2308).  A
+	// MaxTTL of 0 means no maximum.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// Stale is how long after a response expires it may still be returned,
+	// while it's refreshed in the background (RFC 8767).
+	Stale time.Duration
+	// Size is the maximum number of responses cached.  It defaults to
+	// 10000.
+	Size int
+}
+
+// Cache is an Exchanger that caches the responses of another, and sends
+// only one query at a time for each question.
+type Cache struct {
+	ex    Exchanger
+	cfg   CacheConfig
+	group singleflight.Group
+	now   func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func (k cacheKey) String() string {
+	return k.name + "/" + dns.TypeToString[k.qtype] + "/" + dns.ClassToString[k.qclass]
+}
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// NewCache returns a Cache in front of ex.
+func NewCache(ex Exchanger, cfg CacheConfig) *Cache {
+	if cfg.Size <= 0 {
+		cfg.Size = defaultCacheSize
+	}
+	return &Cache{ex: ex, cfg: cfg, now: time.Now, entries: make(map[cacheKey]*cacheEntry)}
+}
+
+// Exchange returns a cached response to m if there's a current one, or a
+// stale one while refreshing it.  Otherwise it sends m on, sharing the
+// response with concurrent queries for the same question.
+func (c *Cache) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return c.ex.Exchange(ctx, m)
+	}
+	q := m.Question[0]
+	key := cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+
+	now := c.now()
+	c.mu.Lock()
+	e := c.entries[key]
+	c.mu.Unlock()
+	if e != nil {
+		if now.Before(e.expires) {
+			metrics.DNSCacheLookups.WithLabelValues("hit").Inc()
+			return e.reply(m, now, false), nil
+		}
+		if now.Before(e.expires.Add(c.cfg.Stale)) {
+			metrics.DNSCacheLookups.WithLabelValues("stale").Inc()
+			c.group.DoChan(key.String(), func() (any, error) {
+				return c.fetch(key, m)
+			})
+			return e.reply(m, now, true), nil
+		}
+	}
+	metrics.DNSCacheLookups.WithLabelValues("miss").Inc()
+
+	ch := c.group.DoChan(key.String(), func() (any, error) {
+		return c.fetch(key, m)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		r := res.Val.(*dns.Msg).Copy()
+		r.Id = m.Id
+		r.Question = m.Question
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetch sends m on and caches the response if it can.  It isn't bound to
+// the context of any one query, since others may be waiting for it.
+func (c *Cache) fetch(key cacheKey, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	r, err := c.ex.Exchange(ctx, m.Copy())
+	if err != nil {
+		return nil, err
+	}
+	if ttl, ok := c.ttl(r); ok {
+		now := c.now()
+		c.store(key, &cacheEntry{msg: r, stored: now, expires: now.Add(ttl)})
+	}
+	return r, nil
+}
+
+// ttl returns how long r may be cached, if it may be.
+func (c *Cache) ttl(r *dns.Msg) (time.Duration, bool) {
+	if r.Truncated {
+		return 0, false
+	}
+
+	var secs uint32
+	var ok bool
+	switch {
+	case r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0:
+		secs, ok = minTTL(r.Answer)
+	case r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError:
+		for _, rr := range r.Ns {
+			if soa, isSOA := rr.(*dns.SOA); isSOA {
+				secs, ok = min(soa.Hdr.Ttl, soa.Minttl), true
+				break
+			}
+		}
+		if !ok && c.cfg.MinTTL > 0 {
+			return c.cfg.MinTTL, true
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+
+	ttl := max(time.Duration(secs)*time.Second, c.cfg.MinTTL)
+	if c.cfg.MaxTTL > 0 {
+		ttl = min(ttl, c.cfg.MaxTTL)
+	}
+	return ttl, ttl > 0
+}
+
+func minTTL(rrs []dns.RR) (uint32, bool) {
+	var secs uint32
+	ok := false
+	for _, rr := range rrs {
+		if !ok || rr.Header().Ttl < secs {
+			secs, ok = rr.Header().Ttl, true
+		}
+	}
+	return secs, ok
+}
+
+func (c *Cache) store(key cacheKey, e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.cfg.Size {
+		c.evict(e.stored)
+	}
+	c.entries[key] = e
+}
+
+// evict makes room for an entry, first by dropping those too old to be
+// served even stale, and otherwise an arbitrary one.  The caller must hold
+// c.mu.
+func (c *Cache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expires.Add(c.cfg.Stale)) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.cfg.Size {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
+
+// reply returns a copy of e's response as the answer to m, with its TTLs
+// reduced by the time it's been cached.
+func (e *cacheEntry) reply(m *dns.Msg, now time.Time, stale bool) *dns.Msg {
+	r := e.msg.Copy()
+	r.Id = m.Id
+	r.Question = m.Question
+	age := uint32(now.Sub(e.stored) / time.Second) //nolint:gosec // Entries don't live for 136 years.
+	for _, rrs := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			switch {
+			case h.Rrtype == dns.TypeOPT:
+			case stale:
+				h.Ttl = staleTTL
+			case h.Ttl > age:
+				h.Ttl -= age
+			default:
+				h.Ttl = 0
+			}
+		}
+	}
+	return r
+}
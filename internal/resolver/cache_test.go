@@ -0,0 +1,265 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingExchanger answers with answer, counting queries.  If release is
+// set, queries wait for it to be closed.
+type countingExchanger struct {
+	n       atomic.Int32
+	ttl     uint32
+	release chan struct{}
+}
+
+func (e *countingExchanger) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	e.n.Add(1)
+	if e.release != nil {
+		select {
+		case <-e.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	r := answer(m)
+	for _, rr := range r.Answer {
+		rr.Header().Ttl = e.ttl
+	}
+	if r.Rcode == dns.RcodeNameError {
+		r.Ns = append(r.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns.test.",
+			Mbox:   "hostmaster.test.",
+			Minttl: 30,
+		})
+	}
+	return r, nil
+}
+
+// fakeClock is a settable time source for a Cache.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+// cacheStep advances the clock, then queries, expecting the number of
+// upstream queries so far.
+type cacheStep struct {
+	after time.Duration
+	want  int32
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		ttl   uint32
+		cfg   CacheConfig
+		query string
+		steps []cacheStep
+	}{
+		{
+			name:  "honors TTL",
+			ttl:   60,
+			query: "example.test.",
+			steps: []cacheStep{{0, 1}, {30 * time.Second, 1}, {31 * time.Second, 2}},
+		},
+		{
+			name:  "min TTL",
+			ttl:   1,
+			cfg:   CacheConfig{MinTTL: 10 * time.Second},
+			query: "example.test.",
+			steps: []cacheStep{{0, 1}, {5 * time.Second, 1}, {6 * time.Second, 2}},
+		},
+		{
+			name:  "max TTL",
+			ttl:   3600,
+			cfg:   CacheConfig{MaxTTL: 10 * time.Second},
+			query: "example.test.",
+			steps: []cacheStep{{0, 1}, {5 * time.Second, 1}, {6 * time.Second, 2}},
+		},
+		{
+			name:  "zero TTL",
+			ttl:   0,
+			query: "example.test.",
+			steps: []cacheStep{{0, 1}, {0, 2}},
+		},
+		{
+			name:  "NXDOMAIN",
+			query: "missing.test.",
+			steps: []cacheStep{{0, 1}, {29 * time.Second, 1}, {2 * time.Second, 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ex := &countingExchanger{ttl: tt.ttl}
+			clock := &fakeClock{t: time.Unix(1e9, 0)}
+			c := NewCache(ex, tt.cfg)
+			c.now = clock.now
+			for i, step := range tt.steps {
+				clock.advance(step.after)
+				q := query(tt.query, dns.TypeA)
+				r, err := c.Exchange(t.Context(), q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Id != q.Id {
+					t.Errorf("step %d: response ID %d, want %d", i, r.Id, q.Id)
+				}
+				if n := ex.n.Load(); n != step.want {
+					t.Errorf("step %d: %d upstream queries, want %d", i, n, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheTTLDecreases(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{t: time.Unix(1e9, 0)}
+	c := NewCache(&countingExchanger{ttl: 60}, CacheConfig{})
+	c.now = clock.now
+	if _, err := c.Exchange(t.Context(), query("example.test.", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(20 * time.Second)
+	r, err := c.Exchange(t.Context(), query("EXAMPLE.test.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := r.Answer[0].Header().Ttl; ttl != 40 {
+		t.Errorf("TTL = %d, want 40", ttl)
+	}
+	if name := r.Question[0].Name; name != "EXAMPLE.test." {
+		t.Errorf("question name = %q, want the query's", name)
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	t.Parallel()
+
+	ex := &countingExchanger{ttl: 60}
+	clock := &fakeClock{t: time.Unix(1e9, 0)}
+	c := NewCache(ex, CacheConfig{Stale: time.Minute})
+	c.now = clock.now
+	if _, err := c.Exchange(t.Context(), query("example.test.", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold up the refresh, to see that the stale answer doesn't wait.
+	ex.release = make(chan struct{})
+	clock.advance(90 * time.Second)
+	r, err := c.Exchange(t.Context(), query("example.test.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := r.Answer[0].Header().Ttl; ttl != staleTTL {
+		t.Errorf("stale TTL = %d, want %d", ttl, staleTTL)
+	}
+	close(ex.release)
+
+	// Once refreshed, the answer is current again.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r, err = c.Exchange(t.Context(), query("example.test.", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Answer[0].Header().Ttl == 60 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale answer wasn't refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := ex.n.Load(); n != 2 {
+		t.Errorf("%d upstream queries, want 2", n)
+	}
+
+	// Past the stale period, queries wait for a fresh answer.
+	clock.advance(3 * time.Minute)
+	if _, err := c.Exchange(t.Context(), query("example.test.", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if n := ex.n.Load(); n != 3 {
+		t.Errorf("%d upstream queries, want 3", n)
+	}
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	t.Parallel()
+
+	ex := &countingExchanger{ttl: 60, release: make(chan struct{})}
+	c := NewCache(ex, CacheConfig{})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			q := query("example.test.", dns.TypeA)
+			r, err := c.Exchange(t.Context(), q)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r.Id != q.Id {
+				t.Errorf("response ID %d, want %d", r.Id, q.Id)
+			}
+		})
+	}
+	for ex.n.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(ex.release)
+	wg.Wait()
+
+	if n := ex.n.Load(); n != 1 {
+		t.Errorf("%d upstream queries, want 1", n)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	t.Parallel()
+
+	c := NewCache(&countingExchanger{ttl: 60}, CacheConfig{Size: 2})
+	for _, name := range []string{"a.example.test.", "b.example.test.", "c.example.test."} {
+		if _, err := c.Exchange(t.Context(), query(name, dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.mu.Lock()
+	n := len(c.entries)
+	c.mu.Unlock()
+	if n != 2 {
+		t.Errorf("%d entries cached, want 2", n)
+	}
+}
@@ -0,0 +1,8 @@
+// Package resolver resolves hostnames using a configured DNS server, over
+// plain UDP or TCP, DNS-over-TLS (RFC 7858) or DNS-over-HTTPS (RFC 8484),
+// instead of the system's.
+//
+// Queries are sent by an Exchanger, which a Cache can wrap.  NewResolver
+// adapts one to a *net.Resolver, so that it can be used by net.Dialer and
+// anything else that takes one.
+package resolver
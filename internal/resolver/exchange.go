@@ -0,0 +1,215 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultTimeout bounds a query whose context has no deadline.
+const defaultTimeout = 10 * time.Second
+
+// maxIdleConns is how many idle connections to a TCP or DNS-over-TLS server
+// are kept for reuse.
+const maxIdleConns = 4
+
+// udpExchanger queries a DNS server over UDP, and over TCP if the response
+// doesn't fit.
+type udpExchanger struct {
+	addr   string
+	dialer *net.Dialer // If nil, a default one.
+}
+
+// newUDPExchanger returns a udpExchanger for addr that makes its sockets
+// with direct, such as to mark them, if it's not nil.
+func newUDPExchanger(addr string, direct *net.Dialer) *udpExchanger {
+	e := &udpExchanger{addr: addr}
+	if direct != nil {
+		d := *direct
+		if d.Timeout == 0 {
+			d.Timeout = defaultTimeout
+		}
+		e.dialer = &d
+	}
+	return e
+}
+
+func (e *udpExchanger) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Net: "udp", Timeout: defaultTimeout, Dialer: e.dialer}
+	r, _, err := c.ExchangeContext(ctx, m, e.addr)
+	if err == nil && r.Truncated {
+		c.Net = "tcp"
+		r, _, err = c.ExchangeContext(ctx, m, e.addr)
+	}
+	return r, err
+}
+
+// streamExchanger queries a DNS server over TCP, or DNS-over-TLS if tls is
+// set, reusing connections.
+type streamExchanger struct {
+	addr   string
+	dialer ContextDialer
+	tls    *tls.Config
+
+	mu   sync.Mutex
+	idle []*dns.Conn
+}
+
+func newTCPExchanger(addr string, d ContextDialer) *streamExchanger {
+	return &streamExchanger{addr: addr, dialer: d}
+}
+
+func newTLSExchanger(addr string, d ContextDialer, cfg *tls.Config) *streamExchanger {
+	cfg = secureConfig(cfg).Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return &streamExchanger{addr: addr, dialer: d, tls: cfg}
+}
+
+func (e *streamExchanger) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	for {
+		c, reused, err := e.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		r, err := roundTrip(ctx, c, m)
+		if err == nil {
+			e.put(c)
+			return r, nil
+		}
+		_ = c.Close()
+		// The server may have closed an idle connection, so try again
+		// with another one, until a new one fails.
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// get returns an idle connection, and true, or else a new one.
+func (e *streamExchanger) get(ctx context.Context) (*dns.Conn, bool, error) {
+	e.mu.Lock()
+	if n := len(e.idle); n > 0 {
+		c := e.idle[n-1]
+		e.idle = e.idle[:n-1]
+		e.mu.Unlock()
+		return c, true, nil
+	}
+	e.mu.Unlock()
+
+	raw, err := e.dialer.DialContext(withBootstrap(ctx), "tcp", e.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	if e.tls == nil {
+		return &dns.Conn{Conn: raw}, false, nil
+	}
+	tc := tls.Client(raw, e.tls)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		_ = raw.Close()
+		return nil, false, fmt.Errorf("DNS-over-TLS handshake with %s: %w", e.addr, err)
+	}
+	return &dns.Conn{Conn: tc}, false, nil
+}
+
+func (e *streamExchanger) put(c *dns.Conn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.idle) >= maxIdleConns {
+		_ = c.Close()
+		return
+	}
+	e.idle = append(e.idle, c)
+}
+
+// roundTrip sends m on c and reads the response.
+func roundTrip(ctx context.Context, c *dns.Conn, m *dns.Msg) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	_ = c.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = c.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if err := c.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	r, err := c.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if r.Id != m.Id {
+		return nil, errIDMismatch
+	}
+	return r, nil
+}
+
+// httpsExchanger queries a DNS-over-HTTPS server.
+type httpsExchanger struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSExchanger(url string, d ContextDialer, cfg *tls.Config) *httpsExchanger {
+	return &httpsExchanger{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return d.DialContext(withBootstrap(ctx), network, address)
+				},
+				TLSClientConfig:     secureConfig(cfg),
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: maxIdleConns,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			Timeout: defaultTimeout,
+		},
+	}
+}
+
+func (e *httpsExchanger) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 asks for an ID of 0, to make responses cacheable.
+	q := m.Copy()
+	q.Id = 0
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server %s: %s", e.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, fmt.Errorf("DNS-over-HTTPS server %s: %w", e.url, err)
+	}
+	r.Id = m.Id
+	return r, nil
+}
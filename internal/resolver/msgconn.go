@@ -0,0 +1,98 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// msgConn is the connection a *net.Resolver made by NewResolver "dials".
+// Since it isn't a net.PacketConn, the resolver writes its queries to it
+// framed as over TCP, each prefixed by its length, and msgConn answers them
+// with an Exchanger.
+type msgConn struct {
+	ctx      context.Context
+	ex       Exchanger
+	deadline time.Time
+
+	query bytes.Buffer
+	resp  []byte
+}
+
+func (c *msgConn) Write(p []byte) (int, error) {
+	return c.query.Write(p)
+}
+
+func (c *msgConn) Read(p []byte) (int, error) {
+	if len(c.resp) == 0 {
+		if err := c.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.resp)
+	c.resp = c.resp[n:]
+	return n, nil
+}
+
+// exchange answers the query that's been written.
+func (c *msgConn) exchange() error {
+	b := c.query.Bytes()
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return io.ErrUnexpectedEOF
+	}
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	q := new(dns.Msg)
+	if err := q.Unpack(b[2:n]); err != nil {
+		return err
+	}
+	c.query.Next(n)
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	r, err := c.ex.Exchange(ctx, q)
+	if err != nil {
+		// The resolver recognizes timeouts by their net.Error type.
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return os.ErrDeadlineExceeded
+		}
+		return err
+	}
+	r.Id = q.Id
+	out, err := r.Pack()
+	if err != nil {
+		return err
+	}
+	c.resp = binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(out)), uint16(len(out))) //nolint:gosec // Packed messages are at most 64KiB.
+	c.resp = append(c.resp, out...)
+	return nil
+}
+
+func (c *msgConn) Close() error { return nil }
+
+func (c *msgConn) LocalAddr() net.Addr  { return msgAddr{} }
+func (c *msgConn) RemoteAddr() net.Addr { return msgAddr{} }
+
+func (c *msgConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *msgConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *msgConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// msgAddr is the address of both ends of a msgConn.
+type msgAddr struct{}
+
+func (msgAddr) Network() string { return "dns" }
+func (msgAddr) String() string  { return "resolver" }
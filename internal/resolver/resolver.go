@@ -0,0 +1,153 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ContextDialer dials connections to DNS-over-TLS and DNS-over-HTTPS
+// servers.  It has the same shape as dialer.ContextDialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Exchanger sends a DNS query and returns the response.
+type Exchanger interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+// IsSystem reports whether rawURL selects the system's name servers: it's
+// empty or "system".
+func IsSystem(rawURL string) bool {
+	return rawURL == "" || strings.EqualFold(rawURL, "system")
+}
+
+// NewExchanger returns an Exchanger for the DNS server at rawURL, which is
+// one of:
+//
+//   - system (or ""): the name servers listed in /etc/resolv.conf, in turn
+//   - udp://ip[:port] (default port 53), retrying over TCP if a response is
+//     truncated
+//   - tcp://host[:port] (default port 53)
+//   - tls://host[:port] (default port 853)
+//   - https://host[:port][/path] (default path /dns-query)
+//
+// Connections to tcp://, tls:// and https:// servers are made with d, which
+// may route them through an upstream proxy.  If d is nil, they're dialed
+// directly.  Direct connections, including all queries to system and
+// udp:// servers, are made with direct, such as to set a mark on their
+// sockets, or with a default net.Dialer if it's nil.
+func NewExchanger(rawURL string, d ContextDialer, direct *net.Dialer) (Exchanger, error) {
+	if IsSystem(rawURL) {
+		return newSystemExchanger(direct), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("DNS server %q: missing host", rawURL)
+	}
+	if direct == nil {
+		direct = &net.Dialer{}
+	}
+	if d == nil {
+		d = direct
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "udp":
+		if u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("DNS server %q: unexpected path", rawURL)
+		}
+		if _, err := netip.ParseAddr(u.Hostname()); err != nil {
+			return nil, fmt.Errorf("DNS server %q: host must be an IP address", rawURL)
+		}
+		return newUDPExchanger(hostPort(u, "53"), direct), nil
+	case "tcp", "tls":
+		if u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("DNS server %q: unexpected path", rawURL)
+		}
+		if u.Scheme == "tcp" {
+			return newTCPExchanger(hostPort(u, "53"), d), nil
+		}
+		return newTLSExchanger(hostPort(u, "853"), d, nil), nil
+	case "https":
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/dns-query"
+		}
+		return newHTTPSExchanger(u.String(), d, nil), nil
+	default:
+		return nil, fmt.Errorf("DNS server %q: unsupported scheme %q (want system, udp, tcp, tls or https)", rawURL, u.Scheme)
+	}
+}
+
+// NewResolver returns a *net.Resolver that sends its queries to ex.  Like
+// any Go resolver, it consults /etc/hosts first.
+//
+// Hostnames that have to be resolved to reach ex's server itself (such as
+// that of an https:// server, or of an upstream proxy its queries are
+// routed through) are looked up with the system's DNS servers instead,
+// dialed with direct, or a default net.Dialer if it's nil.
+func NewResolver(ex Exchanger, direct *net.Dialer) *net.Resolver {
+	if direct == nil {
+		direct = &net.Dialer{}
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if bootstrapping(ctx) {
+				return direct.DialContext(ctx, network, address)
+			}
+			return &msgConn{ctx: ctx, ex: ex}, nil
+		},
+	}
+}
+
+// NewSystemResolver returns a *net.Resolver that queries the system's name
+// servers, dialing them with direct.  If direct is nil, it's
+// net.DefaultResolver, which may use the C library's resolver instead.
+func NewSystemResolver(direct *net.Dialer) *net.Resolver {
+	if direct == nil {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{PreferGo: true, Dial: direct.DialContext}
+}
+
+// bootstrapKey marks the contexts of dials made to reach a DNS server.
+type bootstrapKey struct{}
+
+func withBootstrap(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bootstrapKey{}, true)
+}
+
+func bootstrapping(ctx context.Context) bool {
+	return ctx.Value(bootstrapKey{}) != nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+var errIDMismatch = errors.New("DNS response ID doesn't match query")
+
+// secureConfig returns cfg, or the default TLS client configuration if it's
+// nil.
+func secureConfig(cfg *tls.Config) *tls.Config {
+	if cfg != nil {
+		return cfg
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12}
+}
@@ -0,0 +1,246 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/die-net/conduit/internal/testutil"
+)
+
+// answer responds to queries for example.test, and NXDOMAIN for all else.
+func answer(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	if q.Question[0].Name != "example.test." {
+		r.Rcode = dns.RcodeNameError
+		return r
+	}
+	hdr := dns.RR_Header{Name: q.Question[0].Name, Class: dns.ClassINET, Ttl: 60, Rrtype: q.Question[0].Qtype}
+	switch q.Question[0].Qtype {
+	case dns.TypeA:
+		r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")})
+	case dns.TypeAAAA:
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+	}
+	return r
+}
+
+var handler = dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+	_ = w.WriteMsg(answer(q))
+})
+
+func startUDPServer(t *testing.T) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func startTCPServer(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: ln, Net: "tcp", Handler: handler}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return ln.Addr().String()
+}
+
+func startTLSServer(t *testing.T, certs *testutil.TLSCerts) string {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", certs.ServerConfig(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: handler}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return ln.Addr().String()
+}
+
+func startHTTPSServer(t *testing.T, certs *testutil.TLSCerts) string {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		q := new(dns.Msg)
+		if err != nil || r.Header.Get("Content-Type") != "application/dns-message" || q.Unpack(b) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if q.Id != 0 {
+			http.Error(w, "nonzero ID", http.StatusBadRequest)
+			return
+		}
+		out, _ := answer(q).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(out)
+	}))
+	srv.TLS = certs.ServerConfig(false)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv.URL + "/dns-query"
+}
+
+func TestResolver(t *testing.T) {
+	t.Parallel()
+
+	certs := testutil.NewTLSCerts(t)
+	clientTLS := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: certs.CAPool}
+	d := &net.Dialer{}
+
+	tests := []struct {
+		name string
+		ex   Exchanger
+	}{
+		{name: "udp", ex: &udpExchanger{addr: startUDPServer(t)}},
+		{name: "tcp", ex: newTCPExchanger(startTCPServer(t), d)},
+		{name: "tls", ex: newTLSExchanger(startTLSServer(t, certs), d, clientTLS)},
+		{name: "https", ex: newHTTPSExchanger(startHTTPSServer(t, certs), d, clientTLS)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := NewResolver(tt.ex, nil)
+			// Look up twice, to reuse connections.
+			for range 2 {
+				addrs, err := r.LookupNetIP(t.Context(), "ip", "example.test.")
+				if err != nil {
+					t.Fatal(err)
+				}
+				slices.SortFunc(addrs, netip.Addr.Compare)
+				want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+				if !slices.Equal(addrs, want) {
+					t.Errorf("LookupNetIP = %v, want %v", addrs, want)
+				}
+			}
+
+			_, err := r.LookupNetIP(t.Context(), "ip4", "missing.test.")
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Errorf("LookupNetIP(missing.test) err = %v, want not found", err)
+			}
+		})
+	}
+}
+
+func TestNewExchanger(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		url      string
+		wantAddr string
+		wantErr  bool
+	}{
+		{url: "", wantAddr: "system"},
+		{url: "SYSTEM", wantAddr: "system"},
+		{url: "udp://192.0.2.53", wantAddr: "192.0.2.53:53"},
+		{url: "udp://[2001:db8::53]:5353", wantAddr: "[2001:db8::53]:5353"},
+		{url: "udp://dns.example", wantErr: true},
+		{url: "tcp://dns.example", wantAddr: "dns.example:53"},
+		{url: "tls://dns.example", wantAddr: "dns.example:853"},
+		{url: "https://dns.example", wantAddr: "https://dns.example/dns-query"},
+		{url: "https://dns.example:8443/resolve", wantAddr: "https://dns.example:8443/resolve"},
+		{url: "quic://dns.example", wantErr: true},
+		{url: "tls://", wantErr: true},
+	}
+	for _, tt := range tests {
+		ex, err := NewExchanger(tt.url, nil, nil)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NewExchanger(%q) succeeded, want error", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewExchanger(%q): %v", tt.url, err)
+			continue
+		}
+		var addr string
+		switch v := ex.(type) {
+		case *systemExchanger:
+			addr = "system"
+		case *udpExchanger:
+			addr = v.addr
+		case *streamExchanger:
+			addr = v.addr
+		case *httpsExchanger:
+			addr = v.url
+		}
+		if addr != tt.wantAddr {
+			t.Errorf("NewExchanger(%q) address = %q, want %q", tt.url, addr, tt.wantAddr)
+		}
+	}
+}
+
+// Dials made to reach the DNS server mustn't be resolved with the resolver
+// itself.
+func TestResolverBootstrap(t *testing.T) {
+	t.Parallel()
+
+	r := NewResolver(&udpExchanger{addr: startUDPServer(t)}, nil)
+	for _, bootstrap := range []bool{false, true} {
+		ctx := t.Context()
+		if bootstrap {
+			ctx = withBootstrap(ctx)
+		}
+		c, err := r.Dial(ctx, "udp", "127.0.0.1:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+		if _, ok := c.(*msgConn); ok == bootstrap {
+			t.Errorf("bootstrap=%v: dial returned %T", bootstrap, c)
+		}
+	}
+}
+
+// Direct queries, such as to udp:// servers, are made with the given
+// dialer, so that its socket options apply to them.
+func TestExchangerDirectDialer(t *testing.T) {
+	t.Parallel()
+
+	var dials atomic.Int32
+	direct := &net.Dialer{Control: func(string, string, syscall.RawConn) error {
+		dials.Add(1)
+		return nil
+	}}
+	ex, err := NewExchanger("udp://"+startUDPServer(t), nil, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := NewResolver(ex, direct).LookupNetIP(t.Context(), "ip4", "example.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 {
+		t.Errorf("LookupNetIP = %v, want one address", addrs)
+	}
+	if dials.Load() == 0 {
+		t.Error("query wasn't made with the direct dialer")
+	}
+}
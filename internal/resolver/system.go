@@ -0,0 +1,88 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resolvConfCheckInterval is how often a systemExchanger checks whether
+// resolv.conf has changed, as the Go resolver does.
+const resolvConfCheckInterval = 5 * time.Second
+
+// defaultNameservers are used when resolv.conf is missing or lists none.
+var defaultNameservers = []string{"127.0.0.1:53", "[::1]:53"}
+
+// systemExchanger queries the name servers listed in resolv.conf in turn,
+// re-reading it when it changes (as it does when a laptop changes
+// networks).
+type systemExchanger struct {
+	path   string
+	dialer *net.Dialer
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	servers []string
+	timeout time.Duration
+}
+
+func newSystemExchanger(direct *net.Dialer) *systemExchanger {
+	return &systemExchanger{path: "/etc/resolv.conf", dialer: direct}
+}
+
+func (e *systemExchanger) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	servers, timeout := e.config()
+	err := errors.New("no name servers")
+	for _, addr := range servers {
+		attempt, cancel := context.WithTimeout(ctx, timeout)
+		var r *dns.Msg
+		r, err = newUDPExchanger(addr, e.dialer).Exchange(attempt, m)
+		cancel()
+		if err == nil {
+			return r, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+// config returns the name servers and per-server timeout from resolv.conf.
+func (e *systemExchanger) config() ([]string, time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if e.servers != nil && now.Sub(e.checked) < resolvConfCheckInterval {
+		return e.servers, e.timeout
+	}
+	e.checked = now
+
+	var modTime time.Time
+	if fi, err := os.Stat(e.path); err == nil {
+		modTime = fi.ModTime()
+	}
+	if e.servers != nil && modTime.Equal(e.modTime) {
+		return e.servers, e.timeout
+	}
+	e.modTime = modTime
+
+	e.servers, e.timeout = defaultNameservers, 5*time.Second
+	if conf, err := dns.ClientConfigFromFile(e.path); err == nil && len(conf.Servers) > 0 {
+		e.servers = make([]string, 0, len(conf.Servers))
+		for _, s := range conf.Servers {
+			e.servers = append(e.servers, net.JoinHostPort(s, conf.Port))
+		}
+		if conf.Timeout > 0 {
+			e.timeout = time.Duration(conf.Timeout) * time.Second
+		}
+	}
+	return e.servers, e.timeout
+}
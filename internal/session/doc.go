@@ -0,0 +1,8 @@
+// Package session describes the connections conduit is proxying.
+//
+// Each accepted connection (or, for non-CONNECT HTTP proxying, each
+// request) gets a Session, which is carried in the context it's served with.
+// The servers fill in what they learn as they negotiate, the tunnel copy
+// loop counts bytes into it, and it's written to the access log when it
+// ends.
+package session
@@ -0,0 +1,74 @@
+package session
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Registry keeps track of the active sessions of all listeners, so that
+// they can be listed and closed.
+//
+// A nil *Registry is valid and tracks nothing.
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[uint64]registered
+}
+
+type registered struct {
+	s      *Session
+	cancel context.CancelFunc
+}
+
+// Add records that s is active; cancel ends it.  The returned function
+// removes s again.
+func (r *Registry) Add(s *Session, cancel context.CancelFunc) (remove func()) {
+	if r == nil {
+		return func() {}
+	}
+
+	r.mu.Lock()
+	if r.sessions == nil {
+		r.sessions = make(map[uint64]registered)
+	}
+	r.sessions[s.ID] = registered{s: s, cancel: cancel}
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.sessions, s.ID)
+		r.mu.Unlock()
+	}
+}
+
+// List returns the active sessions, ordered by ID.
+func (r *Registry) List() []*Session {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*Session, 0, len(r.sessions))
+	for _, id := range slices.Sorted(maps.Keys(r.sessions)) {
+		list = append(list, r.sessions[id].s)
+	}
+	return list
+}
+
+// Close ends the session with the given ID, reporting whether it was
+// active.
+func (r *Registry) Close(id uint64) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.Lock()
+	reg, ok := r.sessions[id]
+	r.mu.Unlock()
+	if ok {
+		reg.cancel()
+	}
+	return ok
+}
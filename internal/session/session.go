@@ -0,0 +1,183 @@
+package session
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var lastID atomic.Uint64
+
+// Session is one proxied connection or request.
+type Session struct {
+	// ID is unique within the process.
+	ID uint64
+	// Listener is the name of the listener that accepted the connection.
+	Listener string
+	// Protocol is the listener's type, such as "http" or "socks5".
+	Protocol string
+	// Client is the client's address.
+	Client string
+	// Start is when the connection was accepted or the request received.
+	Start time.Time
+
+	// BytesUp and BytesDown count the bytes proxied from and to the
+	// client, not including those of a tunnel that is still running; see
+	// Bytes.
+	BytesUp, BytesDown atomic.Int64
+
+	mu       sync.Mutex
+	user     string
+	target   string
+	upstream string
+
+	live        func() (up, down int64)
+	tunnel      bool
+	ttfb        time.Duration
+	closedFirst string
+}
+
+// New returns a Session for a client (given by its address) of the named
+// listener.
+func New(listener, protocol, client string) *Session {
+	return &Session{
+		ID:       lastID.Add(1),
+		Listener: listener,
+		Protocol: protocol,
+		Client:   client,
+		Start:    time.Now(),
+	}
+}
+
+// SetUser records the authenticated username.
+func (s *Session) SetUser(user string) {
+	s.mu.Lock()
+	s.user = user
+	s.mu.Unlock()
+}
+
+// SetTarget records the requested destination.
+func (s *Session) SetTarget(target string) {
+	s.mu.Lock()
+	s.target = target
+	s.mu.Unlock()
+}
+
+// SetUpstream records the name of the upstream chosen for the destination.
+func (s *Session) SetUpstream(upstream string) {
+	s.mu.Lock()
+	s.upstream = upstream
+	s.mu.Unlock()
+}
+
+// StartTunnel records that the session's tunnel is running, with live
+// reporting its byte counts so far.
+func (s *Session) StartTunnel(live func() (up, down int64)) {
+	s.mu.Lock()
+	s.live = live
+	s.mu.Unlock()
+}
+
+// EndTunnel records the outcome of the session's tunnel: the bytes copied
+// up and down, the time until the first byte arrived from the upstream, and
+// which side ("client" or "upstream") closed first, if either did.
+func (s *Session) EndTunnel(up, down int64, ttfb time.Duration, closedFirst string) {
+	s.mu.Lock()
+	s.BytesUp.Add(up)
+	s.BytesDown.Add(down)
+	s.live = nil
+	s.tunnel = true
+	s.ttfb = ttfb
+	s.closedFirst = closedFirst
+	s.mu.Unlock()
+}
+
+// Bytes returns the bytes proxied from and to the client so far, including
+// those of a running tunnel.
+func (s *Session) Bytes() (up, down int64) {
+	s.mu.Lock()
+	live := s.live
+	up, down = s.BytesUp.Load(), s.BytesDown.Load()
+	if live != nil {
+		liveUp, liveDown := live()
+		up += liveUp
+		down += liveDown
+	}
+	s.mu.Unlock()
+	return up, down
+}
+
+// User returns the authenticated username, if any.
+func (s *Session) User() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user
+}
+
+// Target returns the requested destination, if known yet.
+func (s *Session) Target() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target
+}
+
+// Upstream returns the name of the chosen upstream, if known yet.
+func (s *Session) Upstream() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upstream
+}
+
+// LogAccess writes an access log record for s to logger, if it isn't nil.
+// err is the error that ended the session, if any; attrs are added to the
+// record.
+func (s *Session) LogAccess(ctx context.Context, logger *slog.Logger, err error, attrs ...slog.Attr) {
+	if logger == nil {
+		return
+	}
+
+	s.mu.Lock()
+	user, target, upstream := s.user, s.target, s.upstream
+	tunnel, ttfb, closedFirst := s.tunnel, s.ttfb, s.closedFirst
+	s.mu.Unlock()
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	base := []slog.Attr{
+		slog.Uint64("id", s.ID),
+		slog.String("listener", s.Listener),
+		slog.String("protocol", s.Protocol),
+		slog.String("client", s.Client),
+		slog.String("user", user),
+		slog.String("target", target),
+		slog.String("upstream", upstream),
+		slog.Duration("duration", time.Since(s.Start)),
+		slog.Int64("bytes_up", s.BytesUp.Load()),
+		slog.Int64("bytes_down", s.BytesDown.Load()),
+		slog.String("result", result),
+	}
+	if tunnel {
+		base = append(base, slog.Duration("ttfb", ttfb), slog.String("closed_first", closedFirst))
+	}
+	if err != nil {
+		base = append(base, slog.String("error", err.Error()))
+	}
+	logger.LogAttrs(ctx, slog.LevelInfo, "access", append(base, attrs...)...)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying s.
+func NewContext(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext returns the Session in ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(contextKey{}).(*Session)
+	return s
+}
@@ -84,3 +84,37 @@ func ClientConnect(conn net.Conn, address string) error {
 	}
 	return nil
 }
+
+// ClientUDPAssociate sends a SOCKS5 UDP ASSOCIATE request over conn, after
+// negotiation, and returns the address of the server's UDP relay.  The
+// association lasts until conn is closed.
+//
+// If the server replies with an unspecified address, the relay is taken to
+// be on the host conn is connected to.
+func ClientUDPAssociate(conn net.Conn) (string, error) {
+	// The client's address isn't known before it sends, so it's zero.
+	req := txsocks5.NewRequest(txsocks5.CmdUDP, txsocks5.ATYPIPv4, []byte{0, 0, 0, 0}, []byte{0, 0})
+	if _, err := req.WriteTo(conn); err != nil {
+		return "", fmt.Errorf("write request: %w", err)
+	}
+
+	rep, err := txsocks5.NewReplyFrom(conn)
+	if err != nil {
+		return "", fmt.Errorf("read reply: %w", err)
+	}
+	if rep.Rep != txsocks5.RepSuccess {
+		return "", errors.New("udp associate failed")
+	}
+
+	relay := rep.Address()
+	host, port, err := net.SplitHostPort(relay)
+	if err != nil {
+		return "", fmt.Errorf("relay address: %w", err)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		if ra, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			relay = net.JoinHostPort(ra.IP.String(), port)
+		}
+	}
+	return relay, nil
+}
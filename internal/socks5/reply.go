@@ -10,6 +10,8 @@ import (
 const (
 	// CmdConnect is the SOCKS5 CONNECT command value.
 	CmdConnect = txsocks5.CmdConnect
+	// CmdUDP is the SOCKS5 UDP ASSOCIATE command value.
+	CmdUDP = txsocks5.CmdUDP
 )
 
 // Auth configures optional username/password authentication for SOCKS5
@@ -25,6 +27,12 @@ func WriteCommandNotSupportedReply(conn net.Conn, atyp byte) {
 	_, _ = newZeroAddrReply(txsocks5.RepCommandNotSupported, atyp).WriteTo(conn)
 }
 
+// WriteNotAllowedReply writes a SOCKS5 reply indicating that the connection
+// is not allowed by the ruleset.
+func WriteNotAllowedReply(conn net.Conn, atyp byte) {
+	_, _ = newZeroAddrReply(txsocks5.RepNotAllowed, atyp).WriteTo(conn)
+}
+
 // WriteConnectionRefusedReply writes a SOCKS5 reply indicating that the
 // destination connection was refused.
 func WriteConnectionRefusedReply(conn net.Conn, atyp byte) {
@@ -8,6 +8,16 @@ import (
 	txsocks5 "github.com/txthinking/socks5"
 )
 
+// Errors returned by ServerNegotiate and ServerNegotiateFunc.
+var (
+	// ErrNoAcceptableMethods means the client didn't offer the required
+	// authentication method.
+	ErrNoAcceptableMethods = errors.New("no acceptable methods")
+	// ErrAuthFailed means the client's username and password were
+	// rejected.
+	ErrAuthFailed = errors.New("auth failed")
+)
+
 // ServerNegotiate performs SOCKS5 negotiation on conn.
 //
 // If auth.Username is set, the server requires username/password authentication
@@ -15,42 +25,59 @@ import (
 //
 // If auth.Username is empty, the server requires no-auth negotiation.
 func ServerNegotiate(conn net.Conn, auth Auth) error {
+	var verify func(username, password string) bool
+	if auth.Username != "" {
+		verify = func(username, password string) bool {
+			return username == auth.Username && password == auth.Password
+		}
+	}
+	_, err := ServerNegotiateFunc(conn, verify)
+	return err
+}
+
+// ServerNegotiateFunc performs SOCKS5 negotiation on conn, returning the
+// authenticated username.
+//
+// If verify is non-nil, the server requires username/password authentication
+// and accepts the credentials verify approves.  Otherwise it requires no-auth
+// negotiation.
+func ServerNegotiateFunc(conn net.Conn, verify func(username, password string) bool) (string, error) {
 	neg, err := txsocks5.NewNegotiationRequestFrom(conn)
 	if err != nil {
-		return fmt.Errorf("negotiation request: %w", err)
+		return "", fmt.Errorf("negotiation request: %w", err)
 	}
 
-	if auth.Username != "" {
+	if verify != nil {
 		if !containsMethod(neg.Methods, txsocks5.MethodUsernamePassword) {
 			writeNoAcceptableMethods(conn)
-			return errors.New("client does not support username/password")
+			return "", fmt.Errorf("%w: client does not support username/password", ErrNoAcceptableMethods)
 		}
 		if _, err := txsocks5.NewNegotiationReply(txsocks5.MethodUsernamePassword).WriteTo(conn); err != nil {
-			return fmt.Errorf("negotiation reply: %w", err)
+			return "", fmt.Errorf("negotiation reply: %w", err)
 		}
 
 		urq, err := txsocks5.NewUserPassNegotiationRequestFrom(conn)
 		if err != nil {
-			return fmt.Errorf("read userpass: %w", err)
+			return "", fmt.Errorf("read userpass: %w", err)
 		}
-		if string(urq.Uname) != auth.Username || string(urq.Passwd) != auth.Password {
+		if !verify(string(urq.Uname), string(urq.Passwd)) {
 			_, _ = txsocks5.NewUserPassNegotiationReply(txsocks5.UserPassStatusFailure).WriteTo(conn)
-			return errors.New("auth failed")
+			return "", ErrAuthFailed
 		}
 		if _, err := txsocks5.NewUserPassNegotiationReply(txsocks5.UserPassStatusSuccess).WriteTo(conn); err != nil {
-			return fmt.Errorf("write userpass: %w", err)
+			return "", fmt.Errorf("write userpass: %w", err)
 		}
-		return nil
+		return string(urq.Uname), nil
 	}
 
 	if !containsMethod(neg.Methods, txsocks5.MethodNone) {
 		writeNoAcceptableMethods(conn)
-		return errors.New("client does not support no-auth")
+		return "", fmt.Errorf("%w: client does not support no-auth", ErrNoAcceptableMethods)
 	}
 	if _, err := txsocks5.NewNegotiationReply(txsocks5.MethodNone).WriteTo(conn); err != nil {
-		return fmt.Errorf("negotiation reply: %w", err)
+		return "", fmt.Errorf("negotiation reply: %w", err)
 	}
-	return nil
+	return "", nil
 }
 
 // ServerNegotiateNoAuth is a convenience wrapper for ServerNegotiate with
@@ -108,3 +108,60 @@ func TestClientDialToServer(t *testing.T) {
 		})
 	}
 }
+
+func TestClientUDPAssociate(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	g := errgroup.Group{}
+	g.Go(func() error {
+		if err := ServerNegotiateNoAuth(serverConn); err != nil {
+			return err
+		}
+		req, err := ServerReadRequest(serverConn)
+		if err != nil {
+			return err
+		}
+		if req.Cmd != CmdUDP {
+			return fmt.Errorf("unexpected command: %d", req.Cmd)
+		}
+		return WriteSuccessReply(serverConn, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000})
+	})
+
+	if err := ClientNegotiate(clientConn, Auth{}); err != nil {
+		t.Fatal(err)
+	}
+	relay, err := ClientUDPAssociate(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay != "192.0.2.1:5000" {
+		t.Errorf("relay = %q, want 192.0.2.1:5000", relay)
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	for _, address := range []string{"192.0.2.1:53", "[2001:db8::1]:443", "example.com:53"} {
+		b, err := PackDatagram(address, []byte("payload"))
+		if err != nil {
+			t.Fatalf("PackDatagram(%q): %v", address, err)
+		}
+		data, err := UnpackDatagram(b)
+		if err != nil {
+			t.Fatalf("UnpackDatagram(%q): %v", address, err)
+		}
+		if string(data) != "payload" {
+			t.Errorf("%s: data = %q, want payload", address, data)
+		}
+	}
+
+	b, _ := PackDatagram("192.0.2.1:53", []byte("payload"))
+	b[2] = 1 // A fragment.
+	if _, err := UnpackDatagram(b); err == nil {
+		t.Error("UnpackDatagram accepted a fragment")
+	}
+}
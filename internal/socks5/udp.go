@@ -0,0 +1,35 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+
+	txsocks5 "github.com/txthinking/socks5"
+)
+
+// PackDatagram returns data with the SOCKS5 UDP request header for
+// address prepended, as sent to a UDP relay.
+func PackDatagram(address string, data []byte) ([]byte, error) {
+	atyp, dstAddr, dstPort, err := txsocks5.ParseAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("parse address: %w", err)
+	}
+	if atyp == txsocks5.ATYPDomain {
+		dstAddr = dstAddr[1:]
+	}
+	return txsocks5.NewDatagram(atyp, dstAddr, dstPort, data).Bytes(), nil
+}
+
+// UnpackDatagram returns the data from a datagram received from a UDP
+// relay, without its SOCKS5 UDP request header.  Fragments aren't
+// supported.
+func UnpackDatagram(b []byte) ([]byte, error) {
+	d, err := txsocks5.NewDatagramFromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse datagram: %w", err)
+	}
+	if d.Frag != 0 {
+		return nil, errors.New("fragmented datagram")
+	}
+	return d.Data, nil
+}
@@ -7,10 +7,13 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/singleflight"
+
+	"github.com/die-net/conduit/internal/metrics"
 )
 
 // ContextDialer is the interface for establishing TCP connections, used by Client
@@ -74,9 +77,26 @@ type Client struct {
 	config ClientConfig
 	dialer ContextDialer
 
-	mu        sync.Mutex
-	sshClient *ssh.Client
-	sf        singleflight.Group
+	mu         sync.Mutex
+	sshClient  *ssh.Client
+	connected  bool      // Whether a transport was ever established.
+	since      time.Time // When the current transport was established.
+	reconnects int       // Transports established after the first.
+	sf         singleflight.Group
+
+	channels atomic.Int64
+}
+
+// TransportStatus describes the state of a Client's SSH transport.
+type TransportStatus struct {
+	// Connected is whether a transport is currently established.
+	Connected bool
+	// Since is when the current transport was established.
+	Since time.Time
+	// Reconnects counts the transports established after the first.
+	Reconnects int
+	// Channels is the number of open channels.
+	Channels int64
 }
 
 // NewClient creates a new SSH client that will connect to the given address.
@@ -146,7 +166,14 @@ func (c *Client) DialContext(ctx context.Context, network, address string) (net.
 	stop := context.AfterFunc(ctx, func() {
 		_ = conn.Close()
 	})
-	return &channelConn{Conn: conn, stop: stop}, nil
+	active := metrics.SSHActiveChannels.WithLabelValues(c.addr)
+	active.Inc()
+	c.channels.Add(1)
+	release := func() {
+		active.Dec()
+		c.channels.Add(-1)
+	}
+	return &channelConn{Conn: conn, stop: stop, release: release}, nil
 }
 
 // Close closes the SSH transport connection if one is established.
@@ -162,6 +189,21 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// Status returns the state of the SSH transport.
+func (c *Client) Status() TransportStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := TransportStatus{
+		Connected:  c.sshClient != nil,
+		Reconnects: c.reconnects,
+		Channels:   c.channels.Load(),
+	}
+	if st.Connected {
+		st.Since = c.since
+	}
+	return st
+}
+
 // getTransport returns the shared SSH transport client, creating it if
 // needed.
 //
@@ -195,7 +237,24 @@ func (c *Client) getTransport(ctx context.Context) (*ssh.Client, error) {
 
 		c.mu.Lock()
 		c.sshClient = client
+		c.since = time.Now()
+		if c.connected {
+			c.reconnects++
+			metrics.SSHReconnects.WithLabelValues(c.addr).Inc()
+		}
+		c.connected = true
 		c.mu.Unlock()
+
+		// Forget the transport as soon as it dies, so that Status is
+		// accurate and the next dial reconnects without first failing.
+		go func() {
+			_ = client.Wait()
+			c.mu.Lock()
+			if c.sshClient == client {
+				c.sshClient = nil
+			}
+			c.mu.Unlock()
+		}()
 		return client, nil
 	})
 
@@ -270,7 +329,9 @@ func (c *Client) newTransport(ctx context.Context) (*ssh.Client, error) {
 // underlying channel.
 type channelConn struct {
 	net.Conn
-	stop func() bool
+	stop    func() bool
+	release func() // Called once, on the first Close.
+	once    sync.Once
 }
 
 // Close closes the underlying SSH channel.
@@ -278,5 +339,6 @@ func (c *channelConn) Close() error {
 	if c.stop != nil {
 		c.stop()
 	}
+	c.once.Do(c.release)
 	return c.Conn.Close()
 }
@@ -3,7 +3,7 @@ package ssh
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
@@ -82,7 +82,7 @@ func NewHostKeyCallback(path string) (ssh.HostKeyCallback, error) {
 			return fmt.Errorf("writing to known_hosts: %w", err)
 		}
 
-		log.Printf("ssh: added host key for %s to %s", hostname, path)
+		slog.Info("added SSH host key", "host", hostname, "file", path)
 		return nil
 	}, nil
 }
@@ -1,6 +1,7 @@
 package ssh
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
@@ -8,10 +9,14 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
+	"github.com/die-net/conduit/internal/acl"
 	"github.com/die-net/conduit/internal/conn"
+	"github.com/die-net/conduit/internal/metrics"
+	"github.com/die-net/conduit/internal/session"
 )
 
 // Server is an SSH server that supports TCP tunneling via direct-tcpip channels.
@@ -23,6 +28,10 @@ type Server struct {
 	config   *ssh.ServerConfig
 	listener net.Listener
 	dialer   ContextDialer
+	idle     time.Duration
+	name     string
+	registry *session.Registry
+	acl      *acl.ACL
 
 	mu       sync.Mutex
 	closed   bool
@@ -45,6 +54,22 @@ type ServerConfig struct {
 	// Dialer is used to establish outbound connections for direct-tcpip channels.
 	// If nil, a default net.Dialer is used.
 	Dialer ContextDialer
+
+	// TunnelIdleTimeout, if positive, closes channels that have carried no
+	// data in either direction for that long.
+	TunnelIdleTimeout time.Duration
+
+	// Name identifies the server in sessions and metrics.  It defaults to
+	// "ssh".
+	Name string
+
+	// Registry, if set, lists the channels being forwarded, and lets them
+	// be closed.
+	Registry *session.Registry
+
+	// ACL, if set, decides which destinations clients may connect to.
+	// Denied channels are rejected as Prohibited.
+	ACL *acl.ACL
 }
 
 // directTCPIPPayload is the payload for direct-tcpip channel requests.
@@ -91,6 +116,10 @@ func NewServer(addr string, cfg ServerConfig) (*Server, error) {
 		config:   sshConfig,
 		listener: ln,
 		dialer:   dialer,
+		idle:     cfg.TunnelIdleTimeout,
+		name:     cmp.Or(cfg.Name, "ssh"),
+		registry: cfg.Registry,
+		acl:      cfg.ACL,
 		shutdown: make(chan struct{}),
 	}
 
@@ -171,14 +200,14 @@ func (s *Server) handleConn(ctx context.Context, c net.Conn) {
 		}
 
 		wg.Go(func() {
-			s.handleDirectTCPIP(ctx, newChan)
+			s.handleDirectTCPIP(ctx, sshConn, newChan)
 		})
 	}
 	wg.Wait()
 }
 
 // handleDirectTCPIP handles a direct-tcpip channel request.
-func (s *Server) handleDirectTCPIP(ctx context.Context, newChan ssh.NewChannel) {
+func (s *Server) handleDirectTCPIP(ctx context.Context, sshConn *ssh.ServerConn, newChan ssh.NewChannel) {
 	var payload directTCPIPPayload
 	if err := ssh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
 		_ = newChan.Reject(ssh.Prohibited, "invalid direct-tcpip payload")
@@ -186,14 +215,38 @@ func (s *Server) handleDirectTCPIP(ctx context.Context, newChan ssh.NewChannel)
 	}
 
 	addr := net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port))
-	dst, err := s.dialer.DialContext(ctx, "tcp", addr)
+	sess := session.New(s.name, "ssh", sshConn.RemoteAddr().String())
+	sess.SetUser(sshConn.User())
+	sess.SetTarget(addr)
+	ctx, cancel := context.WithCancel(session.NewContext(ctx, sess))
+	remove := s.registry.Add(sess, cancel)
+
+	req := acl.NewRequest(sess, addr)
+	if err := s.acl.Check(ctx, req); err != nil {
+		remove()
+		cancel()
+		metrics.ACLDenials.WithLabelValues(s.name).Inc()
+		_ = newChan.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	dst, err := s.dialer.DialContext(acl.NewContext(ctx, s.acl, req), "tcp", addr)
 	if err != nil {
+		remove()
+		cancel()
+		if errors.Is(err, acl.ErrDenied) {
+			metrics.ACLDenials.WithLabelValues(s.name).Inc()
+			_ = newChan.Reject(ssh.Prohibited, err.Error())
+			return
+		}
 		_ = newChan.Reject(ssh.ConnectionFailed, fmt.Sprintf("dial %s: %v", addr, err))
 		return
 	}
 
 	ch, reqs, err := newChan.Accept()
 	if err != nil {
+		remove()
+		cancel()
 		_ = dst.Close()
 		return
 	}
@@ -203,7 +256,9 @@ func (s *Server) handleDirectTCPIP(ctx context.Context, newChan ssh.NewChannel)
 
 	// Proxy data bidirectionally.
 	go func() {
-		_ = conn.CopyBidirectional(ctx, dst, ch)
+		defer cancel()
+		defer remove()
+		_, _ = conn.CopyBidirectional(ctx, ch, dst, s.idle)
 	}()
 }
 
@@ -7,12 +7,17 @@ import (
 	"crypto/rand"
 	"errors"
 	"net"
+	"net/netip"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"golang.org/x/crypto/ssh"
 
+	"github.com/die-net/conduit/internal/acl"
+	"github.com/die-net/conduit/internal/metrics"
 	"github.com/die-net/conduit/internal/testutil"
 )
 
@@ -424,6 +429,118 @@ func TestClientServerChannelToUnreachable(t *testing.T) {
 	testutil.AssertEcho(t, conn, conn, []byte("still-works"))
 }
 
+func TestServerACL(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+
+	sshSrv, err := NewServer("127.0.0.1:0", ServerConfig{
+		HostKeys:         []ssh.Signer{mustGenerateKey(t)},
+		PasswordCallback: SimplePasswordAuth("user", "pass"),
+		ACL: &acl.ACL{Rules: []acl.Rule{
+			{Action: acl.Deny, Users: []string{"user"}, IPs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshSrv.Close()
+	go func() { _ = sshSrv.Serve(ctx) }()
+
+	client, err := NewClient(sshSrv.Addr().String(), ClientConfig{
+		Username:        "user",
+		Password:        "pass",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // Test.
+		DialTimeout:     2 * time.Second,
+	}, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.DialContext(ctx, "tcp", echoLn.Addr().String())
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.Prohibited {
+		t.Fatalf("err=%v, want a Prohibited rejection", err)
+	}
+}
+
+// staticResolver resolves hostnames from a map, for ACLs.
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	return r[host], nil
+}
+
+// rebindDialer connects to loopback whatever host it's asked for, checking
+// the ACL in the dial's context like a direct dialer does.
+type rebindDialer struct{}
+
+func (rebindDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{ControlContext: func(ctx context.Context, _, address string, _ syscall.RawConn) error {
+		return acl.CheckConnect(ctx, netip.MustParseAddrPort(address).Addr())
+	}}
+	return d.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+}
+
+// A hostname that the ACL resolves to an allowed address is still
+// prohibited if it's connected to at a denied one.
+func TestServerACLConnectedAddress(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	echoLn, echoStop := testutil.StartEchoTCPServer(ctx, t)
+	defer echoStop()
+	_, port, _ := net.SplitHostPort(echoLn.Addr().String())
+
+	const name = "ssh-acl-connected"
+	sshSrv, err := NewServer("127.0.0.1:0", ServerConfig{
+		Name:             name,
+		HostKeys:         []ssh.Signer{mustGenerateKey(t)},
+		PasswordCallback: SimplePasswordAuth("user", "pass"),
+		Dialer:           rebindDialer{},
+		ACL: &acl.ACL{
+			Rules:    []acl.Rule{{Action: acl.Deny, IPs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}},
+			Resolver: staticResolver{"rebind.test": {netip.MustParseAddr("192.0.2.1")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshSrv.Close()
+	go func() { _ = sshSrv.Serve(ctx) }()
+
+	client, err := NewClient(sshSrv.Addr().String(), ClientConfig{
+		Username:        "user",
+		Password:        "pass",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // Test.
+		DialTimeout:     2 * time.Second,
+	}, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.DialContext(ctx, "tcp", net.JoinHostPort("rebind.test", port))
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.Prohibited {
+		t.Fatalf("err=%v, want a Prohibited rejection", err)
+	}
+	if n := promtest.ToFloat64(metrics.ACLDenials.WithLabelValues(name)); n != 1 {
+		t.Errorf("ACL denials = %v, want 1", n)
+	}
+}
+
 // mustGenerateKey generates an Ed25519 key for testing.
 func mustGenerateKey(t *testing.T) ssh.Signer {
 	t.Helper()
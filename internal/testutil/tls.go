@@ -0,0 +1,132 @@
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TLSCerts is a throwaway CA plus server and client certificates issued by
+// it, written to PEM files in a test temp directory.
+//
+// The server certificate is valid for "localhost", 127.0.0.1 and ::1.
+type TLSCerts struct {
+	CAFile         string
+	ServerCertFile string
+	ServerKeyFile  string
+	ClientCertFile string
+	ClientKeyFile  string
+
+	CA     *x509.Certificate
+	CAPool *x509.CertPool
+	Server tls.Certificate
+	Client tls.Certificate
+}
+
+// NewTLSCerts generates a fresh TLSCerts.
+func NewTLSCerts(t *testing.T) *TLSCerts {
+	t.Helper()
+
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "conduit test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &TLSCerts{
+		CAFile: filepath.Join(dir, "ca.pem"),
+		CA:     ca,
+		CAPool: x509.NewCertPool(),
+	}
+	tc.CAPool.AddCert(ca)
+	writePEM(t, tc.CAFile, "CERTIFICATE", caDER)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage, name string) (tls.Certificate, string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile := filepath.Join(dir, name+".pem")
+		keyFile := filepath.Join(dir, name+"-key.pem")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, certFile, keyFile
+	}
+
+	tc.Server, tc.ServerCertFile, tc.ServerKeyFile = issue(2, x509.ExtKeyUsageServerAuth, "server")
+	tc.Client, tc.ClientCertFile, tc.ClientKeyFile = issue(3, x509.ExtKeyUsageClientAuth, "client")
+	return tc
+}
+
+// ServerConfig returns a server-side *tls.Config using the server
+// certificate. If requireClientCert is set, clients must present a
+// certificate issued by the CA.
+func (tc *TLSCerts) ServerConfig(requireClientCert bool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{tc.Server},
+	}
+	if requireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = tc.CAPool
+	}
+	return cfg
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,7 @@
+// Package tlsconfig builds crypto/tls configurations from the small set of
+// TLS knobs conduit exposes for upstream proxies and listeners.
+//
+// Options can be populated from flags or from URL query parameters (see
+// ParseQuery), and are turned into a *tls.Config by ClientConfig (for
+// connections to upstream proxies) or ServerConfig (for listeners).
+package tlsconfig
@@ -0,0 +1,233 @@
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Options holds the user-configurable TLS settings.
+type Options struct {
+	// CertFile and KeyFile are the paths to a PEM-encoded certificate chain
+	// and matching private key. Clients present it as a client certificate
+	// (mTLS); servers present it as their own certificate.
+	CertFile string
+	KeyFile  string
+	// CAFile is the path to a PEM bundle of trusted CA certificates. For
+	// clients, it replaces the system roots. For servers, clients must
+	// present a certificate issued by one of these CAs.
+	CAFile string
+	// Pins are base64-encoded SHA-256 hashes of a SubjectPublicKeyInfo. If
+	// any are set, at least one certificate in the peer's chain must match
+	// one of them, in addition to normal certificate verification.
+	Pins []string
+	// ServerName overrides the name sent via SNI and used to verify the
+	// peer certificate. Clients only.
+	ServerName string
+}
+
+// Query parameter names recognized by ParseQuery.
+const (
+	QueryCert       = "cert"
+	QueryKey        = "key"
+	QueryCA         = "ca"
+	QueryPin        = "pin"
+	QueryServerName = "sni"
+)
+
+// IsZero reports whether no options are set.
+func (o *Options) IsZero() bool {
+	return o.CertFile == "" && o.KeyFile == "" && o.CAFile == "" && len(o.Pins) == 0 && o.ServerName == ""
+}
+
+// ParseQuery returns a copy of o with any TLS query parameters in q applied
+// on top, along with the parameters it didn't recognize.
+//
+// Recognized parameters are cert, key, ca, sni, and pin (which may be
+// repeated).
+func (o Options) ParseQuery(q url.Values) (Options, url.Values, error) {
+	rest := url.Values{}
+	for k, vs := range q {
+		if k == QueryPin {
+			o.Pins = append(o.Pins[:len(o.Pins):len(o.Pins)], vs...)
+			continue
+		}
+
+		var dst *string
+		switch k {
+		case QueryCert:
+			dst = &o.CertFile
+		case QueryKey:
+			dst = &o.KeyFile
+		case QueryCA:
+			dst = &o.CAFile
+		case QueryServerName:
+			dst = &o.ServerName
+		default:
+			rest[k] = vs
+			continue
+		}
+		if len(vs) != 1 {
+			return o, nil, fmt.Errorf("tls option %q: expected exactly one value", k)
+		}
+		*dst = vs[0]
+	}
+	return o, rest, nil
+}
+
+// ClientConfig returns a *tls.Config for connecting to serverName, unless
+// overridden by ServerName.
+//
+// Certificate, key, and CA files are read immediately so configuration
+// errors surface at startup rather than on first use.
+func (o *Options) ClientConfig(serverName string) (*tls.Config, error) {
+	if o.ServerName != "" {
+		serverName = o.ServerName
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, errors.New("tls: cert and key must be set together")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.CAFile != "" {
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(o.Pins) > 0 {
+		pins, err := parsePins(o.Pins)
+		if err != nil {
+			return nil, err
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	return cfg, nil
+}
+
+// ServerConfig returns a *tls.Config for accepting TLS connections.
+//
+// CertFile and KeyFile are required. If CAFile is set, clients must present a
+// certificate issued by one of its CAs.
+func (o *Options) ServerConfig() (*tls.Config, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, errors.New("tls: cert and key are required")
+	}
+	if len(o.Pins) > 0 || o.ServerName != "" {
+		return nil, errors.New("tls: pin and server name options are not supported for listeners")
+	}
+
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: loading certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if o.CAFile != "" {
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path) //nolint:gosec // Path is from user config.
+	if err != nil {
+		return nil, fmt.Errorf("tls: reading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates found in CA file %s", path)
+	}
+	return pool, nil
+}
+
+// parsePins decodes SPKI pins. Each may optionally be prefixed with
+// "sha256/" or "sha256//" (as used by HPKP and curl respectively).  Base64
+// can itself start with "/", so both prefixes are tried.
+func parsePins(pins []string) (map[[sha256.Size]byte]struct{}, error) {
+	m := make(map[[sha256.Size]byte]struct{}, len(pins))
+	for _, p := range pins {
+		b, ok := decodePin(p)
+		if !ok {
+			return nil, fmt.Errorf("tls: invalid pin %q: expected base64 SHA-256 hash", p)
+		}
+		m[b] = struct{}{}
+	}
+	return m, nil
+}
+
+func decodePin(p string) ([sha256.Size]byte, bool) {
+	for _, prefix := range []string{"sha256//", "sha256/", ""} {
+		s, ok := strings.CutPrefix(p, prefix)
+		if !ok {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == sha256.Size {
+			return [sha256.Size]byte(b), true
+		}
+	}
+	return [sha256.Size]byte{}, false
+}
+
+// verifyPins checks the certificates the peer sent as well as the verified
+// chains, so a pin may name a root CA that the peer doesn't send.
+func verifyPins(cs tls.ConnectionState, pins map[[sha256.Size]byte]struct{}) error {
+	match := func(certs []*x509.Certificate) bool {
+		for _, cert := range certs {
+			if _, ok := pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if match(cs.PeerCertificates) {
+		return nil
+	}
+	for _, chain := range cs.VerifiedChains {
+		if match(chain) {
+			return nil
+		}
+	}
+	return errors.New("tls: no peer certificate matches the configured pins")
+}
+
+// SPKIPin returns the pin string for cert, suitable for Options.Pins.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
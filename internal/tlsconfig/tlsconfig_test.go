@@ -0,0 +1,130 @@
+package tlsconfig
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	t.Parallel()
+
+	base := Options{CAFile: "flag-ca.pem", Pins: []string{"flagpin"}}
+	q := url.Values{
+		"cert":  {"c.pem"},
+		"key":   {"k.pem"},
+		"ca":    {"q-ca.pem"},
+		"pin":   {"a", "b"},
+		"sni":   {"proxy.example"},
+		"other": {"x"},
+	}
+
+	got, rest, err := base.ParseQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Options{
+		CertFile:   "c.pem",
+		KeyFile:    "k.pem",
+		CAFile:     "q-ca.pem",
+		Pins:       []string{"flagpin", "a", "b"},
+		ServerName: "proxy.example",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+	if !reflect.DeepEqual(rest, url.Values{"other": {"x"}}) {
+		t.Fatalf("unexpected rest: %v", rest)
+	}
+	if len(base.Pins) != 1 {
+		t.Fatalf("ParseQuery modified receiver pins: %v", base.Pins)
+	}
+
+	if _, _, err := base.ParseQuery(url.Values{"ca": {"a", "b"}}); err == nil {
+		t.Fatal("expected error for repeated ca")
+	}
+}
+
+func TestClientConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "cert without key", opts: Options{CertFile: "c.pem"}},
+		{name: "missing cert file", opts: Options{CertFile: "/nonexistent/c.pem", KeyFile: "/nonexistent/k.pem"}},
+		{name: "missing ca file", opts: Options{CAFile: "/nonexistent/ca.pem"}},
+		{name: "bad pin encoding", opts: Options{Pins: []string{"not base64!"}}},
+		{name: "bad pin length", opts: Options{Pins: []string{"c2hvcnQ="}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := tt.opts.ClientConfig("example.com"); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestClientConfigServerName(t *testing.T) {
+	t.Parallel()
+
+	o := Options{}
+	cfg, err := o.ClientConfig("proxy.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerName != "proxy.example" {
+		t.Fatalf("got %q", cfg.ServerName)
+	}
+
+	o.ServerName = "override.example"
+	cfg, err = o.ClientConfig("proxy.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerName != "override.example" {
+		t.Fatalf("got %q", cfg.ServerName)
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "missing cert", opts: Options{}},
+		{name: "missing key", opts: Options{CertFile: "c.pem"}},
+		{name: "pins unsupported", opts: Options{CertFile: "c.pem", KeyFile: "k.pem", Pins: []string{"x"}}},
+		{name: "server name unsupported", opts: Options{CertFile: "c.pem", KeyFile: "k.pem", ServerName: "x"}},
+		{name: "missing cert file", opts: Options{CertFile: "/nonexistent/c.pem", KeyFile: "/nonexistent/k.pem"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := tt.opts.ServerConfig(); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	t.Parallel()
+
+	// A pin may itself start with "/", so only the prefixes are stripped.
+	const pin = "/VAbo/EZnOyhqUUpaQ9io7tJAzx/m52gxDcEJ958PWM="
+	for _, p := range []string{pin, "sha256/" + pin, "sha256//" + pin} {
+		if _, err := parsePins([]string{p}); err != nil {
+			t.Errorf("parsePins(%q): %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,526 @@
+package tproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Linux capability bits, from linux/capability.h.
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+// CheckConfig describes a transparent proxy listener for Check.
+type CheckConfig struct {
+	// Listen is the listener's IP:port.
+	Listen string
+	// Redirect is true for a listener that expects REDIRECT or DNAT rules
+	// rather than TPROXY rules.
+	Redirect bool
+	// UDP is true if the listener also proxies UDP.
+	UDP bool
+	// Mark is the firewall mark that TPROXY rules set, which policy
+	// routing must deliver locally.  0 accepts any fwmark rule.
+	Mark uint32
+	// OutboundMark is the mark conduit sets on its own outbound sockets,
+	// if any, which the redirecting rules should exempt.
+	OutboundMark uint32
+}
+
+// Level is how serious a Finding is.
+type Level int
+
+// Finding levels.
+const (
+	LevelOK Level = iota
+	LevelWarn
+	LevelFail
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelOK:
+		return "ok"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "FAIL"
+	}
+}
+
+// Finding is one result of Check: what was found and, unless it's fine,
+// how to fix it.
+type Finding struct {
+	Level   Level
+	Message string
+	Fix     string
+}
+
+// checkEnv is how Check inspects the system, replaced by tests.
+type checkEnv struct {
+	readFile func(path string) ([]byte, error)
+	glob     func(pattern string) ([]string, error)
+	run      func(name string, args ...string) ([]byte, error)
+}
+
+var systemEnv = checkEnv{
+	readFile: os.ReadFile,
+	glob:     filepath.Glob,
+	run: func(name string, args ...string) ([]byte, error) {
+		out, err := exec.Command(name, args...).Output() //nolint:gosec // The commands are fixed; only their arguments vary.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return out, err
+	},
+}
+
+// Check inspects the Linux kernel and firewall prerequisites for a
+// transparent proxy listener: capabilities, TPROXY or NAT rules sending
+// traffic to its port, policy routing for the TPROXY mark, forwarding and
+// reverse path filtering, for IPv4 and IPv6.  It only reports what it can
+// see as the current user; firewall rules generally need root to list.
+func Check(cfg CheckConfig) []Finding {
+	if runtime.GOOS != "linux" {
+		return []Finding{{Level: LevelFail, Message: "tproxy-check only inspects Linux systems"}}
+	}
+	return check(systemEnv, cfg)
+}
+
+func check(env checkEnv, cfg CheckConfig) []Finding {
+	host, portStr, err := net.SplitHostPort(cfg.Listen)
+	var port uint64
+	if err == nil {
+		port, err = strconv.ParseUint(portStr, 10, 16)
+	}
+	if err != nil || port == 0 {
+		return []Finding{{Level: LevelFail, Message: fmt.Sprintf("invalid listen address %q", cfg.Listen)}}
+	}
+	ipv6 := host == ""
+	addr, err := netip.ParseAddr(host)
+	if err == nil {
+		ipv6 = addr.IsUnspecified() || (addr.Is6() && !addr.Is4In6())
+	}
+
+	c := &checker{env: env, cfg: cfg, port: strconv.FormatUint(port, 10)}
+	if addr.IsLoopback() {
+		if cfg.Redirect {
+			c.add(LevelWarn, "listen on 0.0.0.0 or the interface's address instead", "the listener is on a loopback address, but REDIRECT rules in PREROUTING send to the incoming interface's address, so only this host's own traffic (redirected in OUTPUT) reaches it")
+		} else {
+			c.add(LevelWarn, fmt.Sprintf("add --on-ip %s to the TPROXY rules (nftables: tproxy to %s), or listen on 0.0.0.0", addr, net.JoinHostPort(addr.String(), c.port)),
+				"the listener is on a loopback address, which TPROXY rules only reach if they name it")
+		}
+	}
+	c.capabilities()
+	rules := c.firewall(ipv6)
+	for _, fam := range []family{ipv4, ipv6Family} {
+		if fam == ipv6Family && !rules[fam] {
+			continue
+		}
+		if !cfg.Redirect {
+			c.policyRouting(fam)
+		}
+		c.forwarding(fam)
+	}
+	if !cfg.Redirect {
+		c.rpFilter()
+	}
+	return c.findings
+}
+
+type family int
+
+const (
+	ipv4 family = iota
+	ipv6Family
+)
+
+func (f family) String() string {
+	if f == ipv6Family {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+type checker struct {
+	env      checkEnv
+	cfg      CheckConfig
+	port     string
+	findings []Finding
+}
+
+func (c *checker) add(level Level, fix, format string, args ...any) {
+	c.findings = append(c.findings, Finding{Level: level, Message: fmt.Sprintf(format, args...), Fix: fix})
+}
+
+// capabilities checks that this process has the capabilities that
+// IP_TRANSPARENT and SO_MARK need.
+func (c *checker) capabilities() {
+	status, err := c.env.readFile("/proc/self/status")
+	if err != nil {
+		c.add(LevelWarn, "", "can't read capabilities: %v", err)
+		return
+	}
+	var capEff uint64
+	for line := range strings.Lines(string(status)) {
+		if v, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			capEff, _ = strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		}
+	}
+	has := func(bit int) bool { return capEff&(1<<bit) != 0 }
+
+	const grant = "run conduit as root, or grant it with `setcap cap_net_admin,cap_net_raw+ep /path/to/conduit` or systemd's AmbientCapabilities=CAP_NET_ADMIN CAP_NET_RAW"
+	switch {
+	case c.cfg.Redirect:
+		c.add(LevelOK, "", "redirect mode needs no capabilities to listen")
+	case has(capNetAdmin) || has(capNetRaw):
+		c.add(LevelOK, "", "CAP_NET_ADMIN or CAP_NET_RAW is effective, as IP_TRANSPARENT needs")
+	default:
+		c.add(LevelFail, grant, "neither CAP_NET_ADMIN nor CAP_NET_RAW is effective, so listening with IP_TRANSPARENT will fail")
+	}
+	if c.cfg.OutboundMark != 0 {
+		if has(capNetAdmin) {
+			c.add(LevelOK, "", "CAP_NET_ADMIN is effective, as --outbound-mark needs")
+		} else {
+			c.add(LevelFail, grant, "CAP_NET_ADMIN isn't effective, so setting --outbound-mark will fail")
+		}
+	}
+}
+
+// ruleKey is a family and protocol that rules send to the listener.
+type ruleKey struct {
+	fam   family
+	proto string
+}
+
+// firewall looks for nftables and iptables rules sending traffic to the
+// listener's port, and returns which families have them.
+func (c *checker) firewall(ipv6 bool) map[family]bool {
+	found := make(map[ruleKey]bool)
+	exempt := false
+	var listed []string
+	var errs []string
+
+	if out, err := c.env.run("nft", "list", "ruleset"); err == nil {
+		listed = append(listed, "nft")
+		exempt = c.scanNft(out, found) || exempt
+	} else {
+		errs = append(errs, fmt.Sprintf("nft: %v", err))
+	}
+	for _, fam := range []family{ipv4, ipv6Family} {
+		cmd := "iptables-save"
+		if fam == ipv6Family {
+			cmd = "ip6tables-save"
+		}
+		if out, err := c.env.run(cmd); err == nil {
+			listed = append(listed, cmd)
+			exempt = c.scanIptables(out, fam, found) || exempt
+		} else {
+			errs = append(errs, fmt.Sprintf("%s: %v", cmd, err))
+		}
+	}
+
+	kind := "TPROXY"
+	if c.cfg.Redirect {
+		kind = "REDIRECT/DNAT"
+	}
+	if len(listed) == 0 {
+		c.add(LevelWarn, "run tproxy-check as root, with nft or iptables-save installed", "can't list firewall rules (%s)", strings.Join(errs, "; "))
+		return map[family]bool{ipv4: true, ipv6Family: ipv6}
+	}
+
+	protos := []string{"tcp"}
+	if c.cfg.UDP {
+		protos = append(protos, "udp")
+	}
+	families := make(map[family]bool)
+	for _, fam := range []family{ipv4, ipv6Family} {
+		for _, proto := range protos {
+			k := ruleKey{fam, proto}
+			switch {
+			case found[k]:
+				families[fam] = true
+				c.add(LevelOK, "", "found a %s rule sending %s %s to port %s", kind, fam, strings.ToUpper(proto), c.port)
+			case fam == ipv4:
+				c.add(LevelFail, c.ruleFix(k), "no %s rule sends %s %s to port %s (looked in %s)", kind, fam, strings.ToUpper(proto), c.port, strings.Join(listed, ", "))
+			case ipv6:
+				c.add(LevelWarn, c.ruleFix(k), "no %s rule sends %s %s to port %s, so it isn't intercepted", kind, fam, strings.ToUpper(proto), c.port)
+			}
+		}
+	}
+
+	if c.cfg.OutboundMark != 0 {
+		if exempt {
+			c.add(LevelOK, "", "found a rule matching --outbound-mark %#x", c.cfg.OutboundMark)
+		} else {
+			c.add(LevelWarn, fmt.Sprintf("iptables -t mangle -I PREROUTING -m mark --mark %#x -j RETURN (and the same in OUTPUT, or the nat table in redirect mode)", c.cfg.OutboundMark),
+				"no rule matches --outbound-mark %#x, so conduit's own connections may be redirected back to it", c.cfg.OutboundMark)
+		}
+	}
+	return families
+}
+
+// ruleFix returns an example rule sending k's traffic to the listener.
+func (c *checker) ruleFix(k ruleKey) string {
+	cmd := "iptables"
+	if k.fam == ipv6Family {
+		cmd = "ip6tables"
+	}
+	if c.cfg.Redirect {
+		return fmt.Sprintf("%s -t nat -A PREROUTING -p %s --dport 80 -j REDIRECT --to-ports %s", cmd, k.proto, c.port)
+	}
+	mark := c.cfg.Mark
+	if mark == 0 {
+		mark = 1
+	}
+	return fmt.Sprintf("%s -t mangle -A PREROUTING -p %s --dport 80 -j TPROXY --tproxy-mark %#x/%#x --on-port %s", cmd, k.proto, mark, mark, c.port)
+}
+
+var (
+	nftTable     = regexp.MustCompile(`^table (ip6?|inet) `)
+	nftTarget    = regexp.MustCompile(`\b(tproxy|redirect|dnat)(?: (ip6?))?(?: to)? (\S*):(\d+)\b`)
+	iptTarget    = regexp.MustCompile(`-j (TPROXY|REDIRECT|DNAT)\b`)
+	iptOnPort    = regexp.MustCompile(`--(?:on-port|to-ports) (\d+)\b`)
+	iptToDest    = regexp.MustCompile(`--to-destination \S*:(\d+)\b`)
+	iptProto     = regexp.MustCompile(`-p (tcp|udp)\b`)
+	markMatchIpt = regexp.MustCompile(`--mark (0x[0-9a-fA-F]+|\d+)\b`)
+	markMatchNft = regexp.MustCompile(`\bmark (?:== )?(0x[0-9a-fA-F]+|\d+)\b`)
+)
+
+// scanNft records in found the families and protocols that nft's rules
+// send to the listener, and returns whether any rule matches the outbound
+// mark.
+func (c *checker) scanNft(out []byte, found map[ruleKey]bool) bool {
+	exempt := false
+	tableFam := ""
+	for line := range strings.Lines(string(out)) {
+		line = strings.TrimSpace(line)
+		if m := nftTable.FindStringSubmatch(line); m != nil {
+			tableFam = m[1]
+			continue
+		}
+		exempt = exempt || c.matchesMark(markMatchNft, line)
+
+		m := nftTarget.FindStringSubmatch(line)
+		if m == nil || m[4] != c.port || (m[1] == "tproxy") == c.cfg.Redirect {
+			continue
+		}
+		fam := m[2]
+		if fam == "" {
+			fam = tableFam
+		}
+		var fams []family
+		switch fam {
+		case "ip":
+			fams = []family{ipv4}
+		case "ip6":
+			fams = []family{ipv6Family}
+		default:
+			fams = []family{ipv4, ipv6Family}
+		}
+		for _, f := range fams {
+			for _, proto := range lineProtos(strings.Contains(line, "tcp"), strings.Contains(line, "udp")) {
+				found[ruleKey{f, proto}] = true
+			}
+		}
+	}
+	return exempt
+}
+
+// scanIptables records in found the protocols that the rules from
+// iptables-save or ip6tables-save send to the listener, and returns
+// whether any rule matches the outbound mark.
+func (c *checker) scanIptables(out []byte, fam family, found map[ruleKey]bool) bool {
+	exempt := false
+	for line := range strings.Lines(string(out)) {
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		exempt = exempt || c.matchesMark(markMatchIpt, line)
+
+		t := iptTarget.FindStringSubmatch(line)
+		if t == nil || (t[1] == "TPROXY") == c.cfg.Redirect {
+			continue
+		}
+		p := iptOnPort.FindStringSubmatch(line)
+		if t[1] == "DNAT" {
+			p = iptToDest.FindStringSubmatch(line)
+		}
+		if p == nil || p[1] != c.port {
+			continue
+		}
+		proto := iptProto.FindStringSubmatch(line)
+		for _, pr := range lineProtos(proto != nil && proto[1] == "tcp", proto != nil && proto[1] == "udp") {
+			found[ruleKey{fam, pr}] = true
+		}
+	}
+	return exempt
+}
+
+// lineProtos returns the protocols a rule applies to: those it mentions,
+// or both if it mentions neither.
+func lineProtos(tcp, udp bool) []string {
+	switch {
+	case tcp && udp, !tcp && !udp:
+		return []string{"tcp", "udp"}
+	case tcp:
+		return []string{"tcp"}
+	default:
+		return []string{"udp"}
+	}
+}
+
+// matchesMark returns whether line, a firewall rule, matches the outbound
+// mark with re.
+func (c *checker) matchesMark(re *regexp.Regexp, line string) bool {
+	if c.cfg.OutboundMark == 0 {
+		return false
+	}
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	v, err := strconv.ParseUint(m[1], 0, 32)
+	return err == nil && uint32(v) == c.cfg.OutboundMark //nolint:gosec // ParseUint checked the size.
+}
+
+var (
+	ipRuleFwmark = regexp.MustCompile(`\bfwmark (0x[0-9a-fA-F]+|\d+)(?:/(0x[0-9a-fA-F]+|\d+))?\b.*\blookup (\S+)`)
+	ipRouteLocal = regexp.MustCompile(`^local (default|0\.0\.0\.0/0|::/0) `)
+)
+
+// policyRouting checks that packets with the TPROXY mark are routed to
+// the local host.
+func (c *checker) policyRouting(fam family) {
+	var opts []string
+	v6, routeFix := "", "ip route add local 0.0.0.0/0 dev lo table 100"
+	if fam == ipv6Family {
+		opts = []string{"-6"}
+		v6, routeFix = "-6 ", "ip -6 route add local ::/0 dev lo table 100"
+	}
+	args := append(opts, "rule", "show")
+	mark := c.cfg.Mark
+	if mark == 0 {
+		mark = 1
+	}
+	ruleFix := fmt.Sprintf("ip %srule add fwmark %#x lookup 100", v6, mark)
+
+	out, err := c.env.run("ip", args...)
+	if err != nil {
+		c.add(LevelWarn, "", "can't check %s policy routing: ip %s: %v", fam, strings.Join(args, " "), err)
+		return
+	}
+	table := ""
+	for line := range strings.Lines(string(out)) {
+		m := ipRuleFwmark.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if c.cfg.Mark != 0 {
+			value, _ := strconv.ParseUint(m[1], 0, 32)
+			mask := uint64(0xffffffff)
+			if m[2] != "" {
+				mask, _ = strconv.ParseUint(m[2], 0, 32)
+			}
+			if uint64(c.cfg.Mark)&mask != value {
+				continue
+			}
+		}
+		table = m[3]
+		break
+	}
+	if table == "" {
+		what := "any fwmark"
+		if c.cfg.Mark != 0 {
+			what = fmt.Sprintf("fwmark %#x", c.cfg.Mark)
+		}
+		c.add(LevelFail, ruleFix+"; "+routeFix, "no %s ip rule routes %s, so intercepted packets won't be delivered to conduit", fam, what)
+		return
+	}
+
+	out, err = c.env.run("ip", append(opts, "route", "show", "table", table)...)
+	if err != nil {
+		c.add(LevelWarn, "", "can't check %s routing table %s: %v", fam, table, err)
+		return
+	}
+	for line := range strings.Lines(string(out)) {
+		if ipRouteLocal.MatchString(line) {
+			c.add(LevelOK, "", "%s marked packets are looked up in table %s, which routes them locally", fam, table)
+			return
+		}
+	}
+	c.add(LevelFail, strings.Replace(routeFix, "table 100", "table "+table, 1), "%s routing table %s has no local default route, so intercepted packets won't be delivered to conduit", fam, table)
+}
+
+// forwarding checks that the kernel forwards packets, as a gateway for
+// other hosts needs.
+func (c *checker) forwarding(fam family) {
+	path, name := "/proc/sys/net/ipv4/ip_forward", "net.ipv4.ip_forward"
+	if fam == ipv6Family {
+		path, name = "/proc/sys/net/ipv6/conf/all/forwarding", "net.ipv6.conf.all.forwarding"
+	}
+	v, err := c.readSysctl(path)
+	switch {
+	case err != nil:
+		c.add(LevelWarn, "", "can't read %s: %v", name, err)
+	case v == 0:
+		c.add(LevelWarn, fmt.Sprintf("sysctl -w %s=1", name), "%s is 0, so only this host's own traffic can be intercepted, not that of clients routing through it", name)
+	default:
+		c.add(LevelOK, "", "%s is enabled", name)
+	}
+}
+
+// rpFilter checks for strict reverse path filtering, which can drop
+// packets that TPROXY delivers locally.
+func (c *checker) rpFilter() {
+	all, err := c.readSysctl("/proc/sys/net/ipv4/conf/all/rp_filter")
+	if err != nil {
+		c.add(LevelWarn, "", "can't read net.ipv4.conf.all.rp_filter: %v", err)
+		return
+	}
+	paths, _ := c.env.glob("/proc/sys/net/ipv4/conf/*/rp_filter")
+	var strict []string
+	for _, path := range paths {
+		iface := filepath.Base(filepath.Dir(path))
+		if iface == "all" || iface == "default" || iface == "lo" {
+			continue
+		}
+		v, err := c.readSysctl(path)
+		if err != nil {
+			continue
+		}
+		// The kernel uses the larger of the "all" and interface values.
+		if max(all, v) == 1 {
+			strict = append(strict, iface)
+		}
+	}
+	if len(strict) == 0 {
+		c.add(LevelOK, "", "no interface has strict reverse path filtering")
+		return
+	}
+	fix := "sysctl -w net.ipv4.conf.all.rp_filter=2"
+	for _, iface := range strict {
+		fix += fmt.Sprintf(" net.ipv4.conf.%s.rp_filter=2", iface)
+	}
+	c.add(LevelWarn, fix, "strict reverse path filtering (rp_filter=1) on %s can drop intercepted packets", strings.Join(strict, ", "))
+}
+
+func (c *checker) readSysctl(path string) (int, error) {
+	b, err := c.env.readFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(bytes.TrimSpace(b)))
+}
@@ -0,0 +1,182 @@
+package tproxy
+
+import (
+	"errors"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeEnv is a checkEnv serving files and command output from maps.
+func fakeEnv(files, commands map[string]string) checkEnv {
+	return checkEnv{
+		readFile: func(path string) ([]byte, error) {
+			if s, ok := files[path]; ok {
+				return []byte(s), nil
+			}
+			return nil, fs.ErrNotExist
+		},
+		glob: func(pattern string) ([]string, error) {
+			var paths []string
+			for path := range files {
+				if ok, _ := filepath.Match(pattern, path); ok {
+					paths = append(paths, path)
+				}
+			}
+			return paths, nil
+		},
+		run: func(name string, args ...string) ([]byte, error) {
+			cmd := strings.Join(append([]string{name}, args...), " ")
+			if s, ok := commands[cmd]; ok {
+				return []byte(s), nil
+			}
+			return nil, errors.New("executable file not found")
+		},
+	}
+}
+
+var (
+	rootFiles = map[string]string{
+		"/proc/self/status":                      "Name:\tconduit\nCapEff:\t000001ffffffffff\n",
+		"/proc/sys/net/ipv4/ip_forward":          "1\n",
+		"/proc/sys/net/ipv6/conf/all/forwarding": "1\n",
+		"/proc/sys/net/ipv4/conf/all/rp_filter":  "0\n",
+		"/proc/sys/net/ipv4/conf/eth0/rp_filter": "2\n",
+		"/proc/sys/net/ipv4/conf/lo/rp_filter":   "1\n",
+	}
+	policyRouting = map[string]string{
+		"ip rule show":               "0:\tfrom all lookup local\n32765:\tfrom all fwmark 0x1/0x1 lookup 100\n32766:\tfrom all lookup main\n",
+		"ip route show table 100":    "local default dev lo scope host\n",
+		"ip -6 rule show":            "0:\tfrom all lookup local\n32765:\tfrom all fwmark 0x1 lookup 100\n",
+		"ip -6 route show table 100": "local ::/0 dev lo metric 1024 pref medium\n",
+	}
+)
+
+// merge returns the union of ms, later maps taking precedence.
+func merge(ms ...map[string]string) map[string]string {
+	out := make(map[string]string)
+	for _, m := range ms {
+		maps.Copy(out, m)
+	}
+	return out
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      CheckConfig
+		files    map[string]string
+		commands map[string]string
+		// want are substrings of the findings expected at each level,
+		// besides OK.
+		wantWarn, wantFail []string
+	}{
+		{
+			name:  "iptables tproxy",
+			cfg:   CheckConfig{Listen: "0.0.0.0:12345", UDP: true, Mark: 1, OutboundMark: 2},
+			files: rootFiles,
+			commands: merge(policyRouting, map[string]string{
+				"iptables-save": "*mangle\n-A PREROUTING -m mark --mark 0x2 -j RETURN\n" +
+					"-A PREROUTING -p tcp -m tcp --dport 80 -j TPROXY --on-port 12345 --on-ip 0.0.0.0 --tproxy-mark 0x1/0x1\n" +
+					"-A PREROUTING -p udp -m udp --dport 443 -j TPROXY --on-port 12345 --on-ip 0.0.0.0 --tproxy-mark 0x1/0x1\nCOMMIT\n",
+				"ip6tables-save": "*mangle\nCOMMIT\n",
+			}),
+			wantWarn: []string{
+				"no TPROXY rule sends IPv6 TCP to port 12345",
+				"no TPROXY rule sends IPv6 UDP to port 12345",
+			},
+		},
+		{
+			name:  "nft tproxy, both families",
+			cfg:   CheckConfig{Listen: "[::]:12345", OutboundMark: 2},
+			files: rootFiles,
+			commands: merge(policyRouting, map[string]string{
+				"nft list ruleset": "table inet conduit {\n\tchain prerouting {\n\t\ttype filter hook prerouting priority mangle; policy accept;\n" +
+					"\t\tmeta mark 0x00000002 return\n" +
+					"\t\tmeta l4proto tcp tproxy ip to :12345 meta mark set 0x00000001 accept\n" +
+					"\t\tmeta l4proto tcp tproxy ip6 to :12345 meta mark set 0x00000001 accept\n\t}\n}\n",
+			}),
+		},
+		{
+			name:  "nft redirect",
+			cfg:   CheckConfig{Listen: "0.0.0.0:8080", Redirect: true},
+			files: merge(rootFiles, map[string]string{"/proc/self/status": "CapEff:\t0000000000000000\n"}),
+			commands: map[string]string{
+				"nft list ruleset": "table ip nat {\n\tchain prerouting {\n\t\ttcp dport 80 redirect to :8080\n\t}\n}\n",
+			},
+			// 0.0.0.0 listens on IPv6, too.
+			wantWarn: []string{"no REDIRECT/DNAT rule sends IPv6 TCP to port 8080"},
+		},
+		{
+			name: "missing setup",
+			cfg:  CheckConfig{Listen: "127.0.0.1:12345", Mark: 4, OutboundMark: 2},
+			files: merge(rootFiles, map[string]string{
+				"/proc/self/status":                      "CapEff:\t0000000000000000\n",
+				"/proc/sys/net/ipv4/ip_forward":          "0\n",
+				"/proc/sys/net/ipv4/conf/eth0/rp_filter": "1\n",
+			}),
+			commands: merge(policyRouting, map[string]string{
+				"iptables-save": "*mangle\n-A PREROUTING -p tcp -j TPROXY --on-port 1080 --tproxy-mark 0x4\nCOMMIT\n",
+			}),
+			wantWarn: []string{
+				"loopback address",
+				"no rule matches --outbound-mark 0x2",
+				"net.ipv4.ip_forward is 0",
+				"rp_filter=1) on eth0",
+			},
+			wantFail: []string{
+				"neither CAP_NET_ADMIN nor CAP_NET_RAW",
+				"CAP_NET_ADMIN isn't effective",
+				"no TPROXY rule sends IPv4 TCP to port 12345",
+				"no IPv4 ip rule routes fwmark 0x4",
+			},
+		},
+		{
+			name: "rules unlisted, route table incomplete",
+			cfg:  CheckConfig{Listen: "0.0.0.0:12345"},
+			files: merge(rootFiles, map[string]string{
+				"/proc/sys/net/ipv4/conf/all/rp_filter":  "1\n",
+				"/proc/sys/net/ipv4/conf/eth0/rp_filter": "0\n",
+			}),
+			commands: map[string]string{
+				"ip rule show":            "32765:\tfrom all fwmark 0x1 lookup 100\n",
+				"ip route show table 100": "",
+				"ip -6 rule show":         "",
+			},
+			wantWarn: []string{
+				"can't list firewall rules",
+				"rp_filter=1) on eth0",
+			},
+			wantFail: []string{
+				"IPv4 routing table 100 has no local default route",
+				"no IPv6 ip rule routes any fwmark",
+			},
+		},
+		{
+			name:     "invalid listen address",
+			cfg:      CheckConfig{Listen: "12345"},
+			wantFail: []string{"invalid listen address"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[Level][]string{}
+			for _, f := range check(fakeEnv(tt.files, tt.commands), tt.cfg) {
+				got[f.Level] = append(got[f.Level], f.Message)
+			}
+			for level, want := range map[Level][]string{LevelWarn: tt.wantWarn, LevelFail: tt.wantFail} {
+				if len(got[level]) != len(want) {
+					t.Errorf("%s findings = %q, want %d matching %q", level, got[level], len(want), want)
+					continue
+				}
+				for i, w := range want {
+					if !strings.Contains(got[level][i], w) {
+						t.Errorf("%s finding %d = %q, want it to contain %q", level, i, got[level][i], w)
+					}
+				}
+			}
+		})
+	}
+}
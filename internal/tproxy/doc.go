@@ -4,6 +4,9 @@
 // On Linux, it listens with IP_TRANSPARENT and retrieves the original
 // destination of redirected TCP connections via SO_ORIGINAL_DST (getsockopt).
 // This is designed for use with iptables/nftables TPROXY rules.
+// ListenRedirectTCP instead listens on an ordinary socket, for REDIRECT or
+// DNAT rules, where SO_ORIGINAL_DST works the same way.  UDPServer forwards
+// UDP redirected by TPROXY rules, using IP_RECVORIGDSTADDR.
 //
 // On FreeBSD, it listens with IP_BINDANY (protocol-level) and retrieves the
 // original destination from the socket's local address (which IPFW fwd and
@@ -13,6 +16,15 @@
 // original destination from the socket's local address (which PF rdr-to
 // preserves).
 //
+// Connections to addresses handed out by the fake-IP DNS server (see
+// package fakeip) are forwarded to the hostname the address stands for.
+// Otherwise, if sniffing is enabled, connections are forwarded to the
+// hostname in a TLS ClientHello's server name or an HTTP request's Host
+// header, if the client sends one.
+//
+// Check reports on the Linux kernel and firewall setup that a listener
+// needs, for the tproxy-check subcommand.
+//
 // On other platforms, the listener and original-destination lookup are stubbed
 // out and return errors.
 package tproxy
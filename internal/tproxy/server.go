@@ -4,12 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
 
+	"github.com/die-net/conduit/internal/acl"
 	"github.com/die-net/conduit/internal/conn"
 	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/metrics"
 	"github.com/die-net/conduit/internal/proxy"
+	"github.com/die-net/conduit/internal/session"
 )
 
 // Server is a transparent proxy (TPROXY-style) connection forwarder.
@@ -18,7 +24,7 @@ import (
 // original destination (as reported by OriginalDst).
 type Server struct {
 	ctx     context.Context
-	Dialer  dialer.ContextDialer
+	cfg     atomic.Pointer[proxy.Config]
 	Verbose bool
 }
 
@@ -27,7 +33,15 @@ func NewServer(ctx context.Context, cfg proxy.Config, verbose bool) *Server {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	return &Server{ctx: ctx, Dialer: cfg.Dialer, Verbose: verbose}
+	s := &Server{ctx: ctx, Verbose: verbose}
+	s.SetConfig(cfg)
+	return s
+}
+
+// SetConfig replaces the dialer used for new connections.  Connections
+// already being forwarded are unaffected.
+func (s *Server) SetConfig(cfg proxy.Config) {
+	s.cfg.Store(&cfg)
 }
 
 // Serve accepts connections from ln and forwards each one to its original
@@ -40,34 +54,132 @@ func (s *Server) Serve(ln net.Listener) error {
 		if err != nil {
 			return fmt.Errorf("accept: %w", err)
 		}
+		cfg := s.cfg.Load()
+		metrics.AcceptedConnections.WithLabelValues(cfg.Name).Inc()
+		done := cfg.Tracker.Add()
 		go func() {
-			if err := s.handle(c); err != nil {
+			defer done()
+			if err := s.handle(cfg, c); err != nil {
 				if s.Verbose {
-					log.Printf("tproxy: connection error: %v", err)
+					slog.Info("connection error", "listener", cfg.Name, "protocol", "tproxy", "client", c.RemoteAddr().String(), "error", err)
 				}
 			}
 		}()
 	}
 }
 
-func (s *Server) handle(c net.Conn) error {
+func (s *Server) handle(cfg *proxy.Config, c net.Conn) (err error) {
 	defer c.Close()
-	ctx, cancel := context.WithCancel(s.ctx)
+	sess := session.New(cfg.Name, "tproxy", c.RemoteAddr().String())
+	ctx, cancel := context.WithCancel(session.NewContext(s.ctx, sess))
 	defer cancel()
+	defer cfg.Registry.Add(sess, cancel)()
+	defer func() {
+		sess.LogAccess(ctx, cfg.AccessLog, err)
+	}()
+	// Closing the session via the registry interrupts negotiation, too.
+	stop := context.AfterFunc(ctx, func() { _ = c.Close() })
+	defer stop()
 
 	dst, ok := OriginalDst(c)
 	if !ok {
+		metrics.NegotiationFailures.WithLabelValues(cfg.Name, "original_dst").Inc()
 		return errors.New("original destination unavailable")
 	}
 
-	up, err := s.Dialer.DialContext(ctx, "tcp", dst.String())
+	addr := unmap(dst.AddrPort())
+	if err := checkLoop(cfg, addr); err != nil {
+		return err
+	}
+	target, fake, err := fakeIPTarget(cfg, addr)
+	if err != nil {
+		return err
+	}
+	var sniffed []byte
+	if !fake && cfg.Sniff {
+		var name string
+		if name, sniffed = sniff(c); name != "" {
+			target = net.JoinHostPort(name, strconv.Itoa(int(addr.Port())))
+		}
+	}
+	sess.SetTarget(target)
+	sess.SetUpstream(dialer.UpstreamName(cfg.Dialer, target))
+
+	req := acl.NewRequest(sess, target)
+	if err := cfg.ACL.Check(ctx, req); err != nil {
+		metrics.ACLDenials.WithLabelValues(cfg.Name).Inc()
+		return err
+	}
+
+	up, err := cfg.Dialer.DialContext(acl.NewContext(ctx, cfg.ACL, req), "tcp", target)
 	if err != nil {
+		if errors.Is(err, acl.ErrDenied) {
+			metrics.ACLDenials.WithLabelValues(cfg.Name).Inc()
+		}
 		return err
 	}
 	defer up.Close()
 
-	if err := conn.CopyBidirectional(ctx, c, up); err != nil {
+	if len(sniffed) > 0 {
+		if _, err := up.Write(sniffed); err != nil {
+			return fmt.Errorf("proxy: %w", err)
+		}
+	}
+	if _, err := conn.CopyBidirectional(ctx, c, up, cfg.TunnelIdleTimeout); err != nil {
 		return fmt.Errorf("proxy: %w", err)
 	}
 	return nil
 }
+
+// fakeIPTarget returns the destination to dial for a connection to addr:
+// the hostname and port that addr stands for, and true, if it's a fake IP,
+// and otherwise addr itself.
+func fakeIPTarget(cfg *proxy.Config, addr netip.AddrPort) (string, bool, error) {
+	if cfg.FakeIP == nil || !cfg.FakeIP.Contains(addr.Addr()) {
+		return addr.String(), false, nil
+	}
+	name, ok := cfg.FakeIP.Name(addr.Addr())
+	if !ok {
+		metrics.NegotiationFailures.WithLabelValues(cfg.Name, "fake_ip").Inc()
+		return "", false, fmt.Errorf("fake IP %s isn't mapped to a hostname", addr.Addr().Unmap())
+	}
+	return net.JoinHostPort(name, strconv.Itoa(int(addr.Port()))), true, nil
+}
+
+// checkLoop returns an error if addr is one of conduit's own listeners.
+func checkLoop(cfg *proxy.Config, addr netip.AddrPort) error {
+	for _, self := range cfg.Self {
+		if self.Port() != addr.Port() {
+			continue
+		}
+		if self.Addr() == addr.Addr() || (self.Addr().IsUnspecified() && isLocal(addr.Addr())) {
+			metrics.NegotiationFailures.WithLabelValues(cfg.Name, "loop").Inc()
+			return fmt.Errorf("original destination %s is a conduit listener; outbound traffic is being redirected back", addr)
+		}
+	}
+	return nil
+}
+
+// isLocal returns whether addr is assigned to one of this host's
+// interfaces.
+func isLocal(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if p, err := netip.ParsePrefix(a.String()); err == nil && p.Addr().Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// unmap returns ap with an IPv4-mapped IPv6 address replaced by the IPv4
+// address.
+func unmap(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
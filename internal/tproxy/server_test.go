@@ -0,0 +1,28 @@
+package tproxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/die-net/conduit/internal/proxy"
+)
+
+func TestCheckLoop(t *testing.T) {
+	cfg := &proxy.Config{Self: []netip.AddrPort{
+		netip.MustParseAddrPort("0.0.0.0:12345"),
+		netip.MustParseAddrPort("192.0.2.1:1080"),
+	}}
+	for addr, loop := range map[string]bool{
+		"127.0.0.1:12345": true,
+		"[::1]:12345":     true,
+		"192.0.2.1:1080":  true,
+		"192.0.2.2:1080":  false,
+		"192.0.2.9:12345": false,
+		"127.0.0.1:443":   false,
+	} {
+		err := checkLoop(cfg, netip.MustParseAddrPort(addr))
+		if (err != nil) != loop {
+			t.Errorf("checkLoop(%s) = %v, want loop %v", addr, err, loop)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package tproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sniffTimeout bounds how long sniff waits for a client to send enough to
+// find a hostname in.  Clients of protocols in which the server speaks
+// first (SSH, SMTP, ...) send nothing, so they're delayed by this much.
+const sniffTimeout = 300 * time.Millisecond
+
+// maxSniff is the most that sniff reads from a client.
+const maxSniff = 16 << 10
+
+var (
+	errSniffed  = errors.New("sniffed")
+	errSniffMax = errors.New("sniff limit reached")
+)
+
+// sniff reads the start of what the client sends on c, and returns the
+// server name from a TLS ClientHello or the host from an HTTP request's
+// Host header, if it finds one, along with all that it read.  The caller
+// must send what was read on to the destination.
+func sniff(c net.Conn) (string, []byte) {
+	_ = c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+
+	rec := &recorder{r: c}
+	br := bufio.NewReader(rec)
+	first, err := br.Peek(1)
+	if err != nil {
+		return "", rec.buf
+	}
+
+	var host string
+	switch {
+	case first[0] == 0x16: // A TLS handshake record.
+		cfg := &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				host = hello.ServerName
+				return nil, errSniffed
+			},
+		}
+		_ = tls.Server(&sniffConn{Conn: c, r: br}, cfg).Handshake()
+	case 'A' <= first[0] && first[0] <= 'Z': // Perhaps an HTTP method.
+		if req, err := http.ReadRequest(br); err == nil {
+			host = req.Host
+		}
+	}
+	return validHost(host), rec.buf
+}
+
+// validHost returns host, lowercased and without any port, if it's a
+// plausible DNS name, and otherwise "".
+func validHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || len(host) > 253 || net.ParseIP(host) != nil {
+		return ""
+	}
+	for _, r := range host {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '.' && r != '_' {
+			return ""
+		}
+	}
+	return host
+}
+
+// recorder keeps a copy of what's read from r, up to maxSniff bytes.
+type recorder struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	if len(r.buf) >= maxSniff {
+		return 0, errSniffMax
+	}
+	n, err := r.r.Read(p[:min(len(p), maxSniff-len(r.buf))])
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// sniffConn reads from r and discards writes, such as the alert that a TLS
+// handshake sends when it's cut short.
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *sniffConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
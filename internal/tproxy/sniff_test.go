@@ -0,0 +1,67 @@
+package tproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestSniff(t *testing.T) {
+	tlsClient := func(c net.Conn) {
+		_ = tls.Client(c, &tls.Config{ServerName: "WWW.Example.com"}).Handshake()
+	}
+	for _, tc := range []struct {
+		name string
+		send string // What the client sends, unless it's TLS.
+		want string
+	}{
+		{name: "tls", want: "www.example.com"},
+		{name: "http", send: "GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", want: "example.com"},
+		{name: "http address", send: "GET / HTTP/1.1\r\nHost: 192.0.2.1\r\n\r\n"},
+		{name: "other", send: "SSH-2.0-OpenSSH_9.9\r\n"},
+		{name: "server first"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			switch {
+			case tc.name == "tls":
+				go tlsClient(client)
+			case tc.send != "":
+				go func() { _, _ = client.Write([]byte(tc.send)) }()
+			}
+
+			host, data := sniff(server)
+			if host != tc.want {
+				t.Errorf("host = %q, want %q", host, tc.want)
+			}
+			// All that was read must be returned, to be sent on.
+			if tc.name == "tls" {
+				if len(data) == 0 || data[0] != 0x16 || !bytes.Contains(data, []byte("WWW.Example.com")) {
+					t.Errorf("sniff returned %q, want the ClientHello", data)
+				}
+			} else if string(data) != tc.send {
+				t.Errorf("sniff returned %q, want %q", data, tc.send)
+			}
+		})
+	}
+}
+
+func TestValidHost(t *testing.T) {
+	for host, want := range map[string]string{
+		"Example.COM.":     "example.com",
+		"example.com:443":  "example.com",
+		"_svc.example.com": "_svc.example.com",
+		"[2001:db8::1]:80": "",
+		"10.0.0.1":         "",
+		"exa mple.com":     "",
+		"":                 "",
+	} {
+		if got := validHost(host); got != want {
+			t.Errorf("validHost(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -40,6 +40,14 @@ func ListenTransparentTCP(addr string, keepAliveConfig net.KeepAliveConfig) (net
 	return &conn.KeepAliveListener{Listener: ln, KeepAliveConfig: keepAliveConfig}, nil
 }
 
+// ListenRedirectTCP listens on addr with an ordinary socket, for connections
+// redirected by NAT rules (iptables REDIRECT or DNAT, nftables redirect or
+// dnat).  Unlike ListenTransparentTCP, it needs no privileges or policy
+// routing; OriginalDst recovers destinations from the connection tracker.
+func ListenRedirectTCP(addr string, keepAliveConfig net.KeepAliveConfig) (net.Listener, error) {
+	return conn.ListenTCP("tcp", addr, keepAliveConfig)
+}
+
 // isV6 looks up the connection's local address and returns whether it is
 // IPv6-capable or not.
 func isV6(tc *net.TCPConn) bool {
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenRedirectTCP is not supported on this platform.
+func ListenRedirectTCP(_ string, _ net.KeepAliveConfig) (net.Listener, error) {
+	return nil, errors.New("redirect mode is only supported on Linux")
+}
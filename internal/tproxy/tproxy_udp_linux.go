@@ -0,0 +1,134 @@
+//go:build linux
+
+package tproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenTransparentUDP listens on addr with IP_TRANSPARENT and
+// IP_RECVORIGDSTADDR (or their IPv6 equivalents) enabled, so that it
+// receives datagrams redirected by TPROXY rules and a UDPReader can
+// recover their original destinations.
+func ListenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, _ string, c syscall.RawConn) error {
+		var ctrlErr error
+		err := c.Control(func(fd uintptr) {
+			// Reply sockets may need to bind the listener's own
+			// address, if that was the original destination.
+			ctrlErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			if ctrlErr == nil {
+				ctrlErr = setTransparent(int(fd), network)
+			}
+			if network == "udp6" {
+				// Dual-stack sockets receive IPv4 datagrams, too.
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+				if ctrlErr == nil {
+					ctrlErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+				}
+			} else if ctrlErr == nil {
+				ctrlErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return ctrlErr
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen tproxy udp %s: %w", addr, err)
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// UDPReader reads datagrams, along with their original destinations, from
+// a socket from ListenTransparentUDP.  It isn't safe for concurrent use.
+type UDPReader struct {
+	c   *net.UDPConn
+	oob []byte
+}
+
+// NewUDPReader returns a UDPReader for c, which must have come from
+// ListenTransparentUDP.
+func NewUDPReader(c *net.UDPConn) *UDPReader {
+	return &UDPReader{c: c, oob: make([]byte, unix.CmsgSpace(unix.SizeofSockaddrInet6))}
+}
+
+// ReadFromUDP reads a datagram into b.  It returns the datagram's length,
+// its source and its original destination, which is invalid if it couldn't
+// be recovered.
+func (r *UDPReader) ReadFromUDP(b []byte) (n int, src, dst netip.AddrPort, err error) {
+	n, oobn, _, src, err := r.c.ReadMsgUDPAddrPort(b, r.oob)
+	if err != nil {
+		return 0, src, dst, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(r.oob[:oobn])
+	if err != nil {
+		return n, unmap(src), dst, nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= unix.SizeofSockaddrInet4:
+			// struct sockaddr_in: family, port, address.
+			addr := netip.AddrFrom4([4]byte(m.Data[4:8]))
+			dst = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(m.Data[2:4]))
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= unix.SizeofSockaddrInet6:
+			// struct sockaddr_in6: family, port, flow info, address.
+			addr := netip.AddrFrom16([16]byte(m.Data[8:24])).Unmap()
+			dst = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(m.Data[2:4]))
+		}
+	}
+	return n, unmap(src), dst, nil
+}
+
+// DialUDPFrom returns a UDP socket bound to laddr, which needn't be a local
+// address, and connected to raddr, for replying to a client from the
+// original destination of the datagrams it sent.  As the socket matches
+// the client's datagrams more closely than the listener does, the kernel
+// may deliver later ones to it instead.
+func DialUDPFrom(laddr, raddr netip.AddrPort) (*net.UDPConn, error) {
+	d := net.Dialer{
+		LocalAddr: net.UDPAddrFromAddrPort(laddr),
+		Control: func(network, _ string, c syscall.RawConn) error {
+			var ctrlErr error
+			err := c.Control(func(fd uintptr) {
+				// Other sessions' sockets may be bound to the same
+				// address.
+				ctrlErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+				if ctrlErr == nil {
+					ctrlErr = setTransparent(int(fd), network)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return ctrlErr
+		},
+	}
+	network := "udp4"
+	if laddr.Addr().Is6() {
+		network = "udp6"
+	}
+	c, err := d.Dial(network, raddr.String())
+	if err != nil {
+		return nil, fmt.Errorf("dial udp from %s: %w", laddr, err)
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// setTransparent sets IP_TRANSPARENT, or IPV6_TRANSPARENT for an IPv6
+// socket, on fd.
+func setTransparent(fd int, network string) error {
+	if network == "udp6" || network == "tcp6" {
+		return unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+}
@@ -0,0 +1,172 @@
+//go:build linux
+
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/die-net/conduit/internal/conn"
+	"github.com/die-net/conduit/internal/proxy"
+	"github.com/die-net/conduit/internal/session"
+)
+
+// listenTransparentUDP is ListenTransparentUDP, skipping the test without
+// the privileges it needs.
+func listenTransparentUDP(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+
+	pc, err := ListenTransparentUDP(addr)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("IP_TRANSPARENT needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	return pc
+}
+
+func TestTransparentUDP(t *testing.T) {
+	pc := listenTransparentUDP(t, "127.0.0.1:0")
+	ln := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	_ = pc.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := client.WriteToUDPAddrPort([]byte("ping"), ln); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a TPROXY rule, the original destination is the listener.
+	buf := make([]byte, 64)
+	n, src, dst, err := NewUDPReader(pc).ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || dst != ln || src != client.LocalAddr().(*net.UDPAddr).AddrPort() {
+		t.Fatalf("ReadFromUDP = %q from %s to %s, want ping from %s to %s", buf[:n], src, dst, client.LocalAddr(), ln)
+	}
+
+	// Replies come from the original destination.
+	reply, err := DialUDPFrom(dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	if _, err := reply.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	n, from, err := client.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" || from != netip.AddrPortFrom(ln.Addr(), ln.Port()) {
+		t.Errorf("client got %q from %s, want pong from %s", buf[:n], from, ln)
+	}
+}
+
+// redirectDialer dials addr instead of each destination.
+type redirectDialer struct {
+	addr string
+}
+
+func (d redirectDialer) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, d.addr)
+}
+
+func TestUDPServer(t *testing.T) {
+	pc := listenTransparentUDP(t, "127.0.0.1:0")
+	ln := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, from, err := echo.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDPAddrPort(buf[:n], from)
+		}
+	}()
+
+	d := redirectDialer{addr: echo.LocalAddr().String()}
+	s := NewUDPServer(t.Context(), proxy.Config{Name: "udp", Dialer: d, Tracker: &conn.Tracker{}, Registry: &session.Registry{}}, false)
+	go func() { _ = s.Serve(pc) }()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Replies are relayed back from the original destination, which
+	// without a TPROXY rule is the listener.
+	buf := make([]byte, 64)
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := client.WriteToUDPAddrPort([]byte(msg), ln); err != nil {
+			t.Fatal(err)
+		}
+		n, from, err := client.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg || from != ln {
+			t.Errorf("client got %q from %s, want %s from %s", buf[:n], from, msg, ln)
+		}
+	}
+}
+
+// failingDialer counts its dials, all of which fail.
+type failingDialer struct {
+	dials atomic.Int32
+}
+
+func (d *failingDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	d.dials.Add(1)
+	return nil, errors.New("unreachable")
+}
+
+func TestUDPServerFailedSession(t *testing.T) {
+	pc := listenTransparentUDP(t, "127.0.0.1:0")
+	ln := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	d := &failingDialer{}
+	s := NewUDPServer(t.Context(), proxy.Config{Name: "udp", Dialer: d, Tracker: &conn.Tracker{}, Registry: &session.Registry{}}, false)
+	go func() { _ = s.Serve(pc) }()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Datagrams after a failed dial are dropped rather than redialed.
+	for range 5 {
+		if _, err := client.WriteToUDPAddrPort([]byte("ping"), ln); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := d.dials.Load(); n != 1 {
+		t.Errorf("dialed %d times, want 1", n)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package tproxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var errUDPUnsupported = errors.New("UDP transparent proxy is only supported on Linux")
+
+// ListenTransparentUDP is not supported on this platform.
+func ListenTransparentUDP(_ string) (*net.UDPConn, error) {
+	return nil, errUDPUnsupported
+}
+
+// UDPReader is not supported on this platform.
+type UDPReader struct{}
+
+// NewUDPReader is not supported on this platform.
+func NewUDPReader(_ *net.UDPConn) *UDPReader {
+	return &UDPReader{}
+}
+
+// ReadFromUDP is not supported on this platform.
+func (*UDPReader) ReadFromUDP(_ []byte) (int, netip.AddrPort, netip.AddrPort, error) {
+	return 0, netip.AddrPort{}, netip.AddrPort{}, errUDPUnsupported
+}
+
+// DialUDPFrom is not supported on this platform.
+func DialUDPFrom(_, _ netip.AddrPort) (*net.UDPConn, error) {
+	return nil, errUDPUnsupported
+}
@@ -0,0 +1,262 @@
+package tproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/die-net/conduit/internal/acl"
+	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/metrics"
+	"github.com/die-net/conduit/internal/proxy"
+	"github.com/die-net/conduit/internal/session"
+)
+
+const (
+	// defaultUDPIdleTimeout is how long a UDP session lasts without a
+	// datagram in either direction, unless configured otherwise.
+	defaultUDPIdleTimeout = time.Minute
+
+	// udpQueue is how many of a client's datagrams are queued for its
+	// session, such as while its upstream is being dialed.  More are
+	// dropped.
+	udpQueue = 64
+
+	// maxDatagram is the largest UDP payload.
+	maxDatagram = 64 << 10
+
+	// udpFailedHold is how long a session that couldn't be set up, such
+	// as because its upstream couldn't be dialed or an ACL denied it, is
+	// kept to drop the client's further datagrams, rather than retrying
+	// for each one.
+	udpFailedHold = 5 * time.Second
+)
+
+// UDPServer is a transparent proxy for UDP.
+//
+// It reads datagrams redirected by TPROXY rules and forwards them to their
+// original destinations, keeping a session for each pair of client and
+// destination, so that replies are sent back to the client from the
+// destination's address.
+type UDPServer struct {
+	ctx     context.Context
+	cfg     atomic.Pointer[proxy.Config]
+	Verbose bool
+
+	mu       sync.Mutex
+	sessions map[udpKey]*udpSession
+}
+
+type udpKey struct {
+	client, dst netip.AddrPort
+}
+
+// udpSession is a client's datagrams to one destination.
+type udpSession struct {
+	queue chan []byte
+	last  atomic.Int64 // Unix nanoseconds of the last datagram.
+
+	// established is set once the session is forwarding, and failed if it
+	// ended before then.
+	established, failed atomic.Bool
+}
+
+func (us *udpSession) touch() {
+	us.last.Store(time.Now().UnixNano())
+}
+
+func (us *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, us.last.Load()))
+}
+
+// NewUDPServer constructs a UDP transparent proxy UDPServer.
+func NewUDPServer(ctx context.Context, cfg proxy.Config, verbose bool) *UDPServer {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s := &UDPServer{ctx: ctx, Verbose: verbose, sessions: make(map[udpKey]*udpSession)}
+	s.SetConfig(cfg)
+	return s
+}
+
+// SetConfig replaces the dialer used for new sessions.  Sessions already
+// being forwarded are unaffected.
+func (s *UDPServer) SetConfig(cfg proxy.Config) {
+	s.cfg.Store(&cfg)
+}
+
+// Serve reads datagrams from pc, which must have come from
+// ListenTransparentUDP, and forwards each one to its original destination.
+//
+// Each session is handled in its own goroutine, and lasts until it's idle
+// for the configured UDP idle timeout, even if pc is closed first.
+func (s *UDPServer) Serve(pc *net.UDPConn) error {
+	r := NewUDPReader(pc)
+	buf := make([]byte, maxDatagram)
+	for {
+		n, client, dst, err := r.ReadFromUDP(buf)
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		if !dst.IsValid() {
+			metrics.NegotiationFailures.WithLabelValues(s.cfg.Load().Name, "original_dst").Inc()
+			continue
+		}
+
+		key := udpKey{client: client, dst: dst}
+		s.mu.Lock()
+		us := s.sessions[key]
+		if us == nil {
+			us = &udpSession{queue: make(chan []byte, udpQueue)}
+			// Not idle yet, before the session starts watching for that.
+			us.touch()
+			s.sessions[key] = us
+			s.start(key, us)
+		}
+		s.mu.Unlock()
+
+		if us.failed.Load() {
+			continue
+		}
+		us.touch()
+		select {
+		case us.queue <- bytes.Clone(buf[:n]):
+		default:
+		}
+	}
+}
+
+func (s *UDPServer) start(key udpKey, us *udpSession) {
+	cfg := s.cfg.Load()
+	metrics.AcceptedConnections.WithLabelValues(cfg.Name).Inc()
+	done := cfg.Tracker.Add()
+	remove := func() {
+		s.mu.Lock()
+		if s.sessions[key] == us {
+			delete(s.sessions, key)
+		}
+		s.mu.Unlock()
+	}
+	go func() {
+		defer done()
+		err := s.handle(cfg, key, us)
+		if err != nil && s.Verbose {
+			slog.Info("connection error", "listener", cfg.Name, "protocol", "tproxy-udp", "client", key.client.String(), "error", err)
+		}
+		if err != nil && !us.established.Load() {
+			us.failed.Store(true)
+			time.AfterFunc(udpFailedHold, remove)
+			return
+		}
+		remove()
+	}()
+}
+
+func (s *UDPServer) handle(cfg *proxy.Config, key udpKey, us *udpSession) (err error) {
+	sess := session.New(cfg.Name, "tproxy-udp", key.client.String())
+	ctx, cancel := context.WithCancel(session.NewContext(s.ctx, sess))
+	defer cancel()
+	defer cfg.Registry.Add(sess, cancel)()
+	defer func() {
+		sess.LogAccess(ctx, cfg.AccessLog, err)
+	}()
+
+	if err := checkLoop(cfg, key.dst); err != nil {
+		return err
+	}
+	target, _, err := fakeIPTarget(cfg, key.dst)
+	if err != nil {
+		return err
+	}
+	sess.SetTarget(target)
+	sess.SetUpstream(dialer.UpstreamName(cfg.Dialer, target))
+
+	req := acl.NewRequest(sess, target)
+	if err := cfg.ACL.Check(ctx, req); err != nil {
+		metrics.ACLDenials.WithLabelValues(cfg.Name).Inc()
+		return err
+	}
+
+	up, err := cfg.Dialer.DialContext(acl.NewContext(ctx, cfg.ACL, req), "udp", target)
+	if err != nil {
+		if errors.Is(err, acl.ErrDenied) {
+			metrics.ACLDenials.WithLabelValues(cfg.Name).Inc()
+		}
+		return err
+	}
+	defer up.Close()
+
+	reply, err := DialUDPFrom(key.dst, key.client)
+	if err != nil {
+		return err
+	}
+	defer reply.Close()
+
+	us.established.Store(true)
+
+	// Closing the session via the registry, or shutting down, stops it.
+	stop := context.AfterFunc(ctx, func() {
+		_ = up.Close()
+		_ = reply.Close()
+	})
+	defer stop()
+
+	// Client datagrams arrive both via the listener's queue and, once it
+	// exists, the reply socket.
+	go func() {
+		for {
+			select {
+			case b := <-us.queue:
+				_, _ = up.Write(b)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		defer cancel()
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := reply.Read(buf)
+			if err != nil {
+				return
+			}
+			us.touch()
+			_, _ = up.Write(buf[:n])
+		}
+	}()
+
+	idle := cfg.UDPIdleTimeout
+	if idle <= 0 {
+		idle = defaultUDPIdleTimeout
+	}
+	buf := make([]byte, maxDatagram)
+	for {
+		_ = up.SetReadDeadline(time.Now().Add(idle - us.idle()))
+		n, err := up.Read(buf)
+		if err != nil {
+			switch {
+			case ctx.Err() != nil:
+				return nil
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				if us.idle() >= idle {
+					return nil
+				}
+				continue
+			}
+			return fmt.Errorf("proxy: %w", err)
+		}
+		us.touch()
+		if _, err := reply.Write(buf[:n]); err != nil {
+			return fmt.Errorf("proxy: %w", err)
+		}
+	}
+}
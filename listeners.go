@@ -0,0 +1,778 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/die-net/conduit/internal/admin"
+	"github.com/die-net/conduit/internal/config"
+	"github.com/die-net/conduit/internal/conn"
+	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/dnsserver"
+	"github.com/die-net/conduit/internal/fakeip"
+	"github.com/die-net/conduit/internal/hostmatch"
+	"github.com/die-net/conduit/internal/hosts"
+	"github.com/die-net/conduit/internal/proxy"
+	"github.com/die-net/conduit/internal/resolver"
+	"github.com/die-net/conduit/internal/session"
+	"github.com/die-net/conduit/internal/tproxy"
+)
+
+// server runs the listeners from a configuration, and applies each new
+// configuration to them as it's loaded.
+//
+// Listeners are identified by their listen address: a listener whose address
+// and kind (type and whether it uses TLS) are unchanged keeps its socket and
+// is just given the new configuration for connections it accepts from then
+// on.  Listeners that disappear or change kind are stopped, and new ones are
+// started.  Established connections are never interrupted by a reload.
+//
+// Listeners stop accepting when ctx is done, but the connections they
+// accepted run until they finish or connCtx is done.  tracker counts them,
+// and registry lists them for the admin API.
+type server struct {
+	ctx      context.Context
+	connCtx  context.Context
+	g        *errgroup.Group
+	tracker  *conn.Tracker
+	registry *session.Registry
+
+	mu        sync.Mutex
+	grace     time.Duration
+	resolver  *dnsResolver
+	dnsDialer dnsDialer
+	dnsServer *dnsserver.Server
+	dnsEx     resolver.Exchanger // What dnsServer answers with.
+	fakeIP    *fakeip.Pool
+	upstreams map[string]*upstream
+	listeners map[string]*listener // By listen address.
+
+	// newDialer constructs upstream dialers; tests replace it.
+	newDialer func(dialer.Config, string) (dialer.ContextDialer, error)
+}
+
+func newServer(ctx, connCtx context.Context, g *errgroup.Group) *server {
+	return &server{
+		ctx:       ctx,
+		connCtx:   connCtx,
+		g:         g,
+		tracker:   &conn.Tracker{},
+		registry:  &session.Registry{},
+		listeners: make(map[string]*listener),
+		newDialer: dialer.New,
+	}
+}
+
+// dnsResolver is the resolver for direct dials, along with the settings it
+// was constructed from, so that it (and its cache, and the upstreams using
+// it) can be kept across reloads that don't change them.
+type dnsResolver struct {
+	settings dnsSettings
+	resolver *net.Resolver
+	ex       resolver.Exchanger // For the DNS forwarder.
+}
+
+type dnsSettings struct {
+	url   string
+	cache bool
+	cfg   resolver.CacheConfig
+	mark  uint32
+}
+
+// dnsDialer connects to TCP, DNS-over-TLS and DNS-over-HTTPS servers,
+// through the upstream named by the dns_upstream setting or else directly.
+// It follows reloads, so that the resolver using it needn't be replaced.
+type dnsDialer struct {
+	upstream atomic.Pointer[upstream]
+	direct   atomic.Pointer[net.Dialer]
+}
+
+func (d *dnsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if up := d.upstream.Load(); up != nil {
+		return up.dialer.DialContext(ctx, network, address)
+	}
+	nd := d.direct.Load()
+	if nd == nil {
+		nd = &net.Dialer{}
+	}
+	return nd.DialContext(ctx, network, address)
+}
+
+// upstream is a dialer, along with what it was constructed from, so that it
+// (and any connections it holds, such as to an SSH server) can be kept
+// across reloads that don't change it.
+type upstream struct {
+	url    string
+	cfg    dialer.Config
+	files  []fileStamp
+	dialer dialer.ContextDialer
+}
+
+func (u *upstream) equal(o *upstream) bool {
+	return u.url == o.url && slices.Equal(u.files, o.files) && reflect.DeepEqual(u.cfg, o.cfg)
+}
+
+// close closes the connections the upstream's dialer holds, such as to an
+// SSH server or HTTP/2 proxy.
+func (u *upstream) close() {
+	if c, ok := u.dialer.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// fileStamp identifies a version of a file that a dialer reads when it's
+// constructed, so that a reload picks up rotated certificates and keys.
+type fileStamp struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func stampFiles(paths ...string) []fileStamp {
+	var stamps []fileStamp
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		s := fileStamp{path: p}
+		if fi, err := os.Stat(p); err == nil {
+			s.size, s.modTime = fi.Size(), fi.ModTime()
+		}
+		stamps = append(stamps, s)
+	}
+	return stamps
+}
+
+// listener is a running listener.
+type listener struct {
+	name      string
+	typ       string
+	tls       bool
+	udp       bool
+	mode      string
+	tlsConfig atomic.Pointer[tls.Config]
+	setConfig func(proxy.Config)
+	// retire stops accepting connections without interrupting those
+	// already established.  close also stops established connections.
+	retire, close func()
+	stopped       atomic.Bool
+}
+
+// pendingListener is a listener as prepared by apply, before any running
+// listeners are changed.
+type pendingListener struct {
+	name    string
+	l       *config.Listener
+	pcfg    proxy.Config
+	tls     *tls.Config
+	verbose bool
+}
+
+// apply starts serving cfg.  Upstreams, routes, credentials and TLS
+// certificates take effect for new connections on all listeners.  Settings
+// that are fixed when a listener is started (TCP keepalive for accepted
+// connections, the HTTP idle timeout, and verbose logging) only apply to
+// listeners started by this call.
+//
+// If cfg is invalid, nothing is changed.  Errors starting new listeners are
+// returned together after all other listeners have been updated.
+func (s *server) apply(cfg *config.Config) error {
+	ka, err := parseTCPKeepAlive(cfg.TCPKeepAlive)
+	if err != nil {
+		return settingError(cfg, "tcp_keepalive", "tcp-keepalive", err)
+	}
+	exceptions, err := hostmatch.ParsePrefixes(cfg.PublicExceptions)
+	if err != nil {
+		return settingError(cfg, "public_exceptions", "public-except", err)
+	}
+	fakeExclude, err := hostmatch.ParseList(cfg.FakeIPExclude)
+	if err != nil {
+		return settingError(cfg, "fake_ip_exclude", "fake-ip-exclude", err)
+	}
+	var globalHosts hosts.Map
+	if cfg.HostsFile != "" {
+		if globalHosts, err = hosts.ParseFile(cfg.HostsFile); err != nil {
+			return settingError(cfg, "hosts_file", "hosts-file", err)
+		}
+	}
+
+	s.mu.Lock()
+	err = s.checkDNSForwarding(cfg)
+	var res *dnsResolver
+	if err == nil {
+		res, err = s.newResolver(cfg)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Resolving can take a while, so don't hold s.mu for it.
+	self := selfAddrs(s.ctx, res.resolver, cfg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range cfg.ACLs {
+		a.Parsed.Resolver = res.resolver
+	}
+
+	upstreams, err := s.newUpstreams(cfg, dialer.Config{
+		DialTimeout:        cfg.DialTimeout,
+		NegotiationTimeout: cfg.NegotiationTimeout,
+		KeepAlive:          ka,
+		SSHKeyPath:         cfg.SSHKey,
+		SSHKnownHostsPath:  cfg.SSHKnownHosts,
+		Resolver:           res.resolver,
+		PublicOnly:         cfg.PublicOnly,
+		PublicExceptions:   exceptions,
+		Mark:               cfg.OutboundMark,
+	})
+	if err != nil {
+		return err
+	}
+	dialers := make(map[string]dialer.ContextDialer, len(upstreams))
+	for name, up := range upstreams {
+		dialers[name] = up.dialer
+	}
+
+	var accessLog *slog.Logger
+	if cfg.AccessLog {
+		accessLog = slog.Default()
+	}
+
+	pending := make([]pendingListener, 0, len(cfg.Listeners))
+	for _, name := range slices.Sorted(maps.Keys(cfg.Listeners)) {
+		l := cfg.Listeners[name]
+		p := pendingListener{
+			name:    name,
+			l:       l,
+			verbose: cfg.Verbose,
+			pcfg: proxy.Config{
+				Name:               name,
+				NegotiationTimeout: cfg.NegotiationTimeout,
+				HTTPIdleTimeout:    cfg.HTTPIdleTimeout,
+				HTTPMaxIdleConns:   cfg.HTTPMaxIdleConns,
+				TunnelIdleTimeout:  cfg.TunnelIdleTimeout,
+				UDPIdleTimeout:     cfg.UDPIdleTimeout,
+				KeepAlive:          ka,
+				Dialer:             dialer.NewHostsDialer(listenerHosts(cfg, l, globalHosts), listenerDialer(cfg, l, dialers)),
+				Users:              l.Auth.Users,
+				Tracker:            s.tracker,
+				Registry:           s.registry,
+				FakeIP:             s.fakeIP,
+				Sniff:              l.Sniff,
+				Self:               self,
+				AccessLog:          accessLog,
+			},
+		}
+		if l.ACL != "" {
+			p.pcfg.ACL = cfg.ACLs[l.ACL].Parsed
+		}
+		if !l.TLS.IsZero() {
+			opts := l.TLS.Options()
+			if p.tls, err = opts.ServerConfig(); err != nil {
+				return cfg.KeyError("listeners."+name+".tls", err)
+			}
+			if l.Type == config.TypeHTTP {
+				p.tls.NextProtos = []string{"h2", "http/1.1"}
+			}
+		}
+		pending = append(pending, p)
+	}
+
+	now := time.Now()
+	for name, old := range s.upstreams {
+		if upstreams[name] != old {
+			go s.retireUpstream(name, old, now, cfg.ShutdownGrace)
+		}
+	}
+	s.upstreams = upstreams
+	s.grace = cfg.ShutdownGrace
+	s.resolver = res
+	s.dnsEx = res.ex
+	if s.fakeIP != nil {
+		s.dnsEx = fakeip.NewExchanger(s.fakeIP, res.ex, fakeExclude)
+	}
+	if s.dnsServer != nil {
+		s.dnsServer.SetExchanger(s.dnsEx)
+	}
+	s.dnsDialer.upstream.Store(upstreams[cfg.DNSUpstream])
+	s.dnsDialer.direct.Store(&net.Dialer{Timeout: cfg.DialTimeout, KeepAliveConfig: ka, Control: dialer.MarkControl(cfg.OutboundMark)})
+
+	// Stop listeners that are gone or changed kind first, so that their
+	// addresses can be reused.
+	keep := make(map[string]bool, len(pending))
+	for _, p := range pending {
+		if ln := s.listeners[p.l.Listen]; ln != nil && ln.typ == p.l.Type && ln.tls == (p.tls != nil) && ln.udp == p.l.UDP && ln.mode == p.l.Mode {
+			keep[p.l.Listen] = true
+		}
+	}
+	for _, addr := range slices.Sorted(maps.Keys(s.listeners)) {
+		if keep[addr] {
+			continue
+		}
+		ln := s.listeners[addr]
+		ln.stopped.Store(true)
+		ln.retire()
+		delete(s.listeners, addr)
+		slog.Info("listener stopped", "listener", ln.name, "type", ln.typ, "addr", addr)
+	}
+
+	var errs []error
+	for _, p := range pending {
+		if ln := s.listeners[p.l.Listen]; ln != nil {
+			ln.name = p.name
+			ln.setConfig(p.pcfg)
+			if p.tls != nil {
+				ln.tlsConfig.Store(p.tls)
+			}
+			continue
+		}
+
+		ln, err := s.startListener(p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.listeners[p.l.Listen] = ln
+	}
+	return errors.Join(errs...)
+}
+
+// checkDNSForwarding checks that the DNS forwarder, if there is or will be
+// one, sends queries through an upstream rather than leaking them to the
+// local network, defaulting dns_upstream to the default upstream.  The
+// caller must hold s.mu.
+func (s *server) checkDNSForwarding(cfg *config.Config) error {
+	if cfg.DNSListen == "" && s.dnsServer == nil {
+		return nil
+	}
+	if scheme, _, _ := strings.Cut(cfg.DNS, "://"); resolver.IsSystem(cfg.DNS) || strings.EqualFold(scheme, "udp") {
+		return settingError(cfg, "dns", "dns", errors.New("the DNS forwarder sends queries through an upstream, which needs a tcp://, tls:// or https:// server"))
+	}
+	if cfg.DNSUpstream == "" {
+		if cfg.Upstreams[config.DefaultUpstream] == nil {
+			return settingError(cfg, "dns_upstream", "dns-upstream", errors.New("the DNS forwarder needs an upstream to send queries through"))
+		}
+		cfg.DNSUpstream = config.DefaultUpstream
+	}
+	return nil
+}
+
+// newResolver returns the resolver for cfg's DNS settings, reusing the
+// current one if they haven't changed.  The caller must hold s.mu.
+func (s *server) newResolver(cfg *config.Config) (*dnsResolver, error) {
+	settings := dnsSettings{url: cfg.DNS, cache: cfg.DNSCache, mark: cfg.OutboundMark}
+	if cfg.DNSCache {
+		if cfg.DNSCacheMaxTTL > 0 && cfg.DNSCacheMinTTL > cfg.DNSCacheMaxTTL {
+			return nil, settingError(cfg, "dns_cache_max_ttl", "dns-cache-max-ttl", errors.New("less than the minimum TTL"))
+		}
+		settings.cfg = resolver.CacheConfig{
+			MinTTL: cfg.DNSCacheMinTTL,
+			MaxTTL: cfg.DNSCacheMaxTTL,
+			Stale:  cfg.DNSCacheStale,
+		}
+	}
+	if s.resolver != nil && s.resolver.settings == settings {
+		return s.resolver, nil
+	}
+
+	// Queries made directly are marked, like other outbound sockets, so
+	// that transparent proxy rules don't loop them back to conduit.
+	var direct *net.Dialer
+	if cfg.OutboundMark != 0 {
+		direct = &net.Dialer{Control: dialer.MarkControl(cfg.OutboundMark)}
+	}
+	ex, err := resolver.NewExchanger(cfg.DNS, &s.dnsDialer, direct)
+	if err != nil {
+		return nil, settingError(cfg, "dns", "dns", err)
+	}
+	if cfg.DNSCache {
+		ex = resolver.NewCache(ex, settings.cfg)
+	}
+	res := &dnsResolver{settings: settings, resolver: resolver.NewResolver(ex, direct), ex: ex}
+
+	// Without a cache, the system's name servers are best used via
+	// the system's own resolver.
+	if resolver.IsSystem(cfg.DNS) && !cfg.DNSCache {
+		res.resolver = resolver.NewSystemResolver(direct)
+	}
+	return res, nil
+}
+
+// listenDNS starts a DNS forwarder on addr, answering UDP and TCP queries
+// with the DNS server given by the dns setting, or with fake IPs.  It
+// follows reloads of those settings, but addr can only change with a
+// restart.
+func (s *server) listenDNS(addr string, verbose bool) error {
+	lc := net.ListenConfig{}
+	pc, err := lc.ListenPacket(s.ctx, "udp", addr)
+	if err != nil {
+		return fmt.Errorf("dns listen: %w", err)
+	}
+	ln, err := lc.Listen(s.ctx, "tcp", addr)
+	if err != nil {
+		_ = pc.Close()
+		return fmt.Errorf("dns listen: %w", err)
+	}
+
+	s.mu.Lock()
+	srv := dnsserver.NewServer(s.dnsEx, verbose)
+	s.dnsServer = srv
+	s.mu.Unlock()
+
+	s.g.Go(func() error {
+		return srv.Serve(s.ctx, pc, ln)
+	})
+	slog.Info("dns listening", "addr", addr)
+	return nil
+}
+
+// enableFakeIP has the DNS forwarder answer address queries with fake IPs,
+// which transparent proxy listeners map back to hostnames.  It must be
+// called before the first apply, as the fake IP ranges can't be changed
+// by reloads.
+func (s *server) enableFakeIP(cfg *config.Config) error {
+	if cfg.DNSListen == "" {
+		return settingError(cfg, "fake_ip", "fake-ip", errors.New("requires dns_listen"))
+	}
+	prefixes, err := hostmatch.ParsePrefixes(cfg.FakeIPRanges)
+	if err == nil {
+		s.fakeIP, err = fakeip.NewPool(prefixes)
+	}
+	if err != nil {
+		return settingError(cfg, "fake_ip_ranges", "fake-ip-range", err)
+	}
+	return nil
+}
+
+// upstreamStatus describes the current upstreams, for the admin API.
+func (s *server) upstreamStatus() []admin.Upstream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]admin.Upstream, 0, len(s.upstreams))
+	for _, name := range slices.Sorted(maps.Keys(s.upstreams)) {
+		up := s.upstreams[name]
+		list = append(list, admin.NewUpstream(name, up.url, up.dialer))
+	}
+	return list
+}
+
+// newUpstreams constructs a dialer for each upstream in cfg, from base and
+// the upstream's own settings, reusing the current one where nothing about it
+// has changed.  The caller must hold s.mu.
+func (s *server) newUpstreams(cfg *config.Config, base dialer.Config) (map[string]*upstream, error) {
+	next := make(map[string]*upstream, len(cfg.Upstreams))
+	for _, name := range slices.Sorted(maps.Keys(cfg.Upstreams)) {
+		u := cfg.Upstreams[name]
+		up := &upstream{url: u.URL, cfg: base}
+		up.cfg.TLS = u.TLS.Options()
+		up.cfg.HTTP2 = u.HTTP2
+		if u.SSHKey != nil {
+			up.cfg.SSHKeyPath = *u.SSHKey
+		}
+		if u.SSHKnownHosts != nil {
+			up.cfg.SSHKnownHostsPath = *u.SSHKnownHosts
+		}
+		// known_hosts isn't included, since the SSH dialer appends to it.
+		up.files = stampFiles(up.cfg.TLS.CertFile, up.cfg.TLS.KeyFile, up.cfg.TLS.CAFile, up.cfg.SSHKeyPath)
+
+		if old := s.upstreams[name]; old != nil && old.equal(up) {
+			next[name] = old
+			continue
+		}
+
+		d, err := s.newDialer(up.cfg, u.URL)
+		if err != nil {
+			return nil, settingError(cfg, "upstreams."+name+".url", "upstream", err)
+		}
+		up.dialer = dialer.NewInstrumented(name, d)
+		next[name] = up
+	}
+	return next, nil
+}
+
+// retirePoll is how often retireUpstream checks whether a replaced
+// upstream is still in use.
+const retirePoll = time.Second
+
+// retireUpstream closes up, which a reload at since replaced, once no
+// connection accepted before then is still using it, or once grace has
+// passed.
+func (s *server) retireUpstream(name string, up *upstream, since time.Time, grace time.Duration) {
+	defer up.close()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	ticker := time.NewTicker(retirePoll)
+	defer ticker.Stop()
+	for s.upstreamInUse(name, since) {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			slog.Info("closing replaced upstream still in use", "upstream", name, "grace", grace)
+			return
+		case <-s.connCtx.Done():
+			return
+		}
+	}
+}
+
+// upstreamInUse returns whether any connection accepted before since is
+// using the named upstream.
+func (s *server) upstreamInUse(name string, since time.Time) bool {
+	for _, sess := range s.registry.List() {
+		if sess.Start.Before(since) && sess.Upstream() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerDialer returns the dialer for l: its upstream, or a router over
+// upstreams for its route.
+func listenerDialer(cfg *config.Config, l *config.Listener, upstreams map[string]dialer.ContextDialer) dialer.ContextDialer {
+	if l.Route == "" {
+		return upstreams[l.Upstream]
+	}
+
+	r := cfg.Routes[l.Route]
+	routes := make([]dialer.Route, 0, len(r.Rules))
+	for _, rule := range r.Rules {
+		routes = append(routes, dialer.Route{Match: rule.Patterns, Dialer: upstreams[rule.Upstream]})
+	}
+	return dialer.NewRouter(routes, upstreams[r.Default])
+}
+
+// listenerHosts returns the host overrides for l: its own, then the global
+// ones.
+func listenerHosts(cfg *config.Config, l *config.Listener, global hosts.Map) hosts.Map {
+	if l.Hosts == "" {
+		return global
+	}
+	return slices.Concat(cfg.Hosts[l.Hosts].Parsed, global)
+}
+
+// selfResolveTimeout bounds how long selfAddrs spends resolving hostnames.
+const selfResolveTimeout = 5 * time.Second
+
+// selfAddrs returns the addresses of all of cfg's listeners, for the
+// transparent proxy to recognize connections redirected back to conduit, or
+// nil if cfg has no transparent proxy listeners.  Hostnames are resolved
+// with res, and an empty host is the unspecified address.
+func selfAddrs(ctx context.Context, res *net.Resolver, cfg *config.Config) []netip.AddrPort {
+	transparent := false
+	for _, l := range cfg.Listeners {
+		transparent = transparent || l.Type == config.TypeTProxy
+	}
+	if !transparent {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, selfResolveTimeout)
+	defer cancel()
+
+	listens := []string{cfg.DNSListen, cfg.DebugListen}
+	for _, l := range cfg.Listeners {
+		listens = append(listens, l.Listen)
+	}
+
+	var self []netip.AddrPort
+	for _, listen := range listens {
+		host, portStr, err := net.SplitHostPort(listen)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			continue
+		}
+		var addrs []netip.Addr
+		if host == "" {
+			addrs = []netip.Addr{netip.IPv6Unspecified()}
+		} else if addr, err := netip.ParseAddr(host); err == nil {
+			addrs = []netip.Addr{addr}
+		} else {
+			if addrs, err = res.LookupNetIP(ctx, "ip", host); err != nil {
+				slog.Warn("can't resolve listen address", "listen", listen, "error", err)
+			}
+		}
+		for _, addr := range addrs {
+			self = append(self, netip.AddrPortFrom(addr.Unmap(), uint16(port))) //nolint:gosec // ParseUint checked the size.
+		}
+	}
+	return self
+}
+
+// startListener starts serving p in s.g until s.ctx is done or it's
+// retired, and closes it along with its connections when s.connCtx is done.
+func (s *server) startListener(p pendingListener) (*listener, error) {
+	l := &listener{name: p.name, typ: p.l.Type, tls: p.tls != nil, udp: p.l.UDP, mode: p.l.Mode}
+
+	var (
+		ln    net.Listener
+		serve func(net.Listener) error
+		err   error
+	)
+	switch p.l.Type {
+	case config.TypeHTTP:
+		ln, err = conn.ListenTCP("tcp", p.l.Listen, p.pcfg.KeepAlive)
+		if err != nil {
+			break
+		}
+		srv := proxy.NewHTTPProxyServer(s.connCtx, p.pcfg)
+		serve, l.setConfig = srv.Serve, srv.SetConfig
+		l.retire = func() {
+			go func() { _ = srv.Shutdown(s.connCtx) }()
+		}
+		l.close = func() {
+			_ = srv.Close()
+			_ = ln.Close()
+		}
+
+	case config.TypeSOCKS5:
+		ln, err = conn.ListenTCP("tcp", p.l.Listen, p.pcfg.KeepAlive)
+		if err != nil {
+			break
+		}
+		srv := proxy.NewSOCKS5Server(s.connCtx, p.pcfg, p.verbose)
+		serve, l.setConfig = srv.Serve, srv.SetConfig
+
+	case config.TypeTProxy:
+		if p.l.Mode == config.ModeRedirect {
+			ln, err = tproxy.ListenRedirectTCP(p.l.Listen, p.pcfg.KeepAlive)
+		} else {
+			ln, err = tproxy.ListenTransparentTCP(p.l.Listen, p.pcfg.KeepAlive)
+		}
+		if err != nil {
+			break
+		}
+		srv := tproxy.NewServer(s.connCtx, p.pcfg, p.verbose)
+		serve, l.setConfig = srv.Serve, srv.SetConfig
+		if p.l.UDP {
+			err = s.startUDP(p, l, ln)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s listen: %w", p.name, err)
+	}
+
+	if p.tls != nil {
+		// Look up the current TLS configuration for each handshake, so
+		// that reloads can replace certificates.
+		l.tlsConfig.Store(p.tls)
+		ln = tls.NewListener(ln, &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return l.tlsConfig.Load(), nil
+			},
+		})
+	}
+
+	if l.close == nil {
+		l.close = func() {
+			_ = ln.Close()
+		}
+	}
+	if l.retire == nil {
+		l.retire = l.close
+	}
+	context.AfterFunc(s.ctx, func() {
+		l.stopped.Store(true)
+		l.retire()
+	})
+	context.AfterFunc(s.connCtx, l.close)
+
+	s.g.Go(func() error {
+		if err := serve(ln); err != nil && !l.stopped.Load() {
+			return fmt.Errorf("%s serve: %w", l.name, err)
+		}
+		return nil
+	})
+
+	attrs := []any{"listener", p.name, "type", p.l.Type, "addr", p.l.Listen}
+	if p.l.Type == config.TypeTProxy {
+		attrs = append(attrs, "mode", p.l.Mode, "udp", p.l.UDP)
+	}
+	slog.Info("listening", attrs...)
+	return l, nil
+}
+
+// startUDP starts proxying UDP for the tproxy listener l, on the address of
+// ln, which is closed if that fails.  Its sessions are configured, stopped
+// and closed along with l.
+func (s *server) startUDP(p pendingListener, l *listener, ln net.Listener) error {
+	pc, err := tproxy.ListenTransparentUDP(p.l.Listen)
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+	srv := tproxy.NewUDPServer(s.connCtx, p.pcfg, p.verbose)
+	setConfig := l.setConfig
+	l.setConfig = func(cfg proxy.Config) {
+		setConfig(cfg)
+		srv.SetConfig(cfg)
+	}
+	l.close = func() {
+		_ = ln.Close()
+		_ = pc.Close()
+	}
+
+	s.g.Go(func() error {
+		if err := srv.Serve(pc); err != nil && !l.stopped.Load() {
+			return fmt.Errorf("%s serve udp: %w", l.name, err)
+		}
+		return nil
+	})
+	return nil
+}
+
+// settingError reports err against a configuration key, or against the
+// equivalent flag if the configuration came from flags.
+func settingError(cfg *config.Config, key, flag string, err error) error {
+	if cfg.File() == "" {
+		return fmt.Errorf("invalid --%s: %w", flag, err)
+	}
+	return cfg.KeyError(key, err)
+}
+
+// drain waits up to the configured shutdown grace period for the
+// connections being served to finish, then calls closeConns (which should
+// cancel s.connCtx) to close any that remain.
+func (s *server) drain(closeConns context.CancelFunc) {
+	defer closeConns()
+
+	s.mu.Lock()
+	grace := s.grace
+	s.mu.Unlock()
+
+	n := s.tracker.Len()
+	if n == 0 {
+		return
+	}
+	slog.Info("waiting for connections to finish", "connections", n, "grace", grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := s.tracker.Wait(ctx); err != nil {
+		slog.Warn("shutdown grace period expired; closing connections", "connections", s.tracker.Len())
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/die-net/conduit/internal/config"
+	"github.com/die-net/conduit/internal/dialer"
+	"github.com/die-net/conduit/internal/session"
+)
+
+// fakeUpstream is an upstream dialer that records being closed.
+type fakeUpstream struct {
+	closed chan struct{}
+}
+
+func (*fakeUpstream) DialContext(context.Context, string, string) (net.Conn, error) {
+	return nil, errors.New("fake upstream")
+}
+
+func (f *fakeUpstream) Close() error {
+	close(f.closed)
+	return nil
+}
+
+func TestReloadClosesReplacedUpstream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g, gctx := errgroup.WithContext(ctx)
+	defer func() {
+		cancel()
+		_ = g.Wait()
+	}()
+
+	var mu sync.Mutex
+	fakes := map[string]*fakeUpstream{}
+	srv := newServer(gctx, ctx, g)
+	srv.newDialer = func(_ dialer.Config, url string) (dialer.ContextDialer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		f := &fakeUpstream{closed: make(chan struct{})}
+		fakes[url] = f
+		return f, nil
+	}
+	fake := func(url string) *fakeUpstream {
+		mu.Lock()
+		defer mu.Unlock()
+		return fakes[url]
+	}
+
+	apply := func(url string) {
+		t.Helper()
+		cfg, err := config.Parse("conduit.yaml", []byte(`
+upstreams:
+  corp: `+url+`
+listeners:
+  socks:
+    type: socks5
+    listen: 127.0.0.1:0
+    upstream: corp
+`), config.Settings{TCPKeepAlive: "off", DNS: "system", ShutdownGrace: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.apply(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closedWithin := func(f *fakeUpstream, d time.Duration) bool {
+		select {
+		case <-f.closed:
+			return true
+		case <-time.After(d):
+			return false
+		}
+	}
+
+	// An unused upstream is closed as soon as it's replaced.
+	apply("ssh://me@a.example")
+	apply("ssh://me@b.example")
+	if !closedWithin(fake("ssh://me@a.example"), 5*time.Second) {
+		t.Fatal("replaced upstream a not closed")
+	}
+
+	// One still used by a connection is closed once that ends.
+	sess := session.New("socks", "socks5", "127.0.0.1:1234")
+	sess.SetUpstream("corp")
+	remove := srv.registry.Add(sess, func() {})
+	time.Sleep(time.Millisecond) // So that the reload is after sess.Start.
+	apply("ssh://me@c.example")
+	if closedWithin(fake("ssh://me@b.example"), 100*time.Millisecond) {
+		t.Fatal("replaced upstream b closed while in use")
+	}
+	remove()
+	if !closedWithin(fake("ssh://me@b.example"), 5*time.Second) {
+		t.Fatal("replaced upstream b not closed after its connection ended")
+	}
+
+	// The current upstream stays open.
+	if closedWithin(fake("ssh://me@c.example"), 0) {
+		t.Error("current upstream c closed")
+	}
+}
+
+func TestDNSForwarding(t *testing.T) {
+	tests := []struct {
+		name         string
+		yaml         string
+		wantErr      string
+		wantUpstream string
+	}{
+		{
+			name:    "system",
+			yaml:    "dns_listen: 127.0.0.1:0\n",
+			wantErr: "conduit.yaml:2: dns: the DNS forwarder sends queries through an upstream, which needs a tcp://, tls:// or https:// server",
+		},
+		{
+			name:    "udp",
+			yaml:    "dns_listen: 127.0.0.1:0\ndns: udp://192.0.2.53\n",
+			wantErr: "conduit.yaml:3: dns: the DNS forwarder sends queries through an upstream, which needs a tcp://, tls:// or https:// server",
+		},
+		{
+			name:    "no upstream",
+			yaml:    "dns_listen: 127.0.0.1:0\ndns: tcp://192.0.2.53\n",
+			wantErr: "conduit.yaml:2: dns_upstream: the DNS forwarder needs an upstream to send queries through",
+		},
+		{
+			name:         "default upstream",
+			yaml:         "dns_listen: 127.0.0.1:0\ndns: tcp://192.0.2.53\nupstreams: {default: 'socks5://192.0.2.1:1080'}\n",
+			wantUpstream: config.DefaultUpstream,
+		},
+		{
+			name:         "named upstream",
+			yaml:         "dns_listen: 127.0.0.1:0\ndns: tls://192.0.2.53\ndns_upstream: direct\n",
+			wantUpstream: config.DirectUpstream,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			g, gctx := errgroup.WithContext(ctx)
+			defer func() {
+				cancel()
+				_ = g.Wait()
+			}()
+
+			cfg, err := config.Parse("conduit.yaml", []byte("\n"+tt.yaml+"listeners: {socks: {type: socks5, listen: '127.0.0.1:0'}}\n"),
+				config.Settings{TCPKeepAlive: "off", ShutdownGrace: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = newServer(gctx, ctx, g).apply(cfg)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("apply err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.DNSUpstream != tt.wantUpstream {
+				t.Errorf("dns_upstream = %q, want %q", cfg.DNSUpstream, tt.wantUpstream)
+			}
+		})
+	}
+}
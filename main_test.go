@@ -0,0 +1,30 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/die-net/conduit/internal/config"
+)
+
+func TestRestartSettings(t *testing.T) {
+	started := &config.Config{Settings: config.Settings{
+		DebugListen:  "127.0.0.1:6060",
+		FakeIPRanges: []string{"198.18.0.0/15"},
+		LogFormat:    "text",
+	}}
+
+	cfg := *started
+	cfg.DialTimeout = 1
+	if got := restartSettings(started, &cfg); len(got) != 0 {
+		t.Errorf("reloadable change: got %q, want none", got)
+	}
+
+	cfg.DebugListen = "127.0.0.1:6061"
+	cfg.FakeIPRanges = []string{"198.18.0.0/16"}
+	cfg.LogFile = "conduit.log"
+	want := []string{"debug_listen", "fake_ip_ranges", "log_file"}
+	if got := restartSettings(started, &cfg); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// reopenSignals ask for the log file to be reopened.  There are none on
+// this platform.
+var reopenSignals []os.Signal
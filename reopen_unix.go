@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals ask for the log file to be reopened.
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
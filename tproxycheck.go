@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/spf13/pflag"
+
+	"github.com/die-net/conduit/internal/config"
+	"github.com/die-net/conduit/internal/tproxy"
+)
+
+// tproxyCheck implements the tproxy-check subcommand, which reports on the
+// kernel and firewall prerequisites of transparent proxy listeners, either
+// those of a configuration file or one described by flags.
+func tproxyCheck(args []string) error {
+	fs := pflag.NewFlagSet("tproxy-check", pflag.ContinueOnError)
+	configFile := fs.String("config", "", "Check the tproxy listeners in this YAML configuration file")
+	listen := fs.String("tproxy-listen", "", "Transparent proxy listen address to check, without --config")
+	mode := fs.String("tproxy-mode", config.ModeTProxy, "Listener mode, without --config: tproxy or redirect")
+	udp := fs.Bool("tproxy-udp", false, "Also check UDP rules, without --config")
+	mark := fs.Uint32("tproxy-mark", 0, "Firewall mark that the TPROXY rules set, which policy routing must match (0 accepts any fwmark rule)")
+	outboundMark := fs.Uint32("outbound-mark", 0, "Mark set by --outbound-mark, which the rules should exempt from redirection")
+	fs.SortFlags = false
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s tproxy-check [flags]\n\nReport on the kernel and firewall setup that transparent proxy listeners need.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if errors.Is(err, pflag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	checks := make(map[string]tproxy.CheckConfig)
+	if *configFile != "" {
+		for _, name := range []string{"tproxy-listen", "tproxy-mode", "tproxy-udp"} {
+			if fs.Changed(name) {
+				return fmt.Errorf("--%s can't be combined with --config", name)
+			}
+		}
+		cfg, err := config.Load(*configFile, config.Settings{})
+		if err != nil {
+			return err
+		}
+		if !fs.Changed("outbound-mark") {
+			*outboundMark = cfg.OutboundMark
+		}
+		for _, name := range slices.Sorted(maps.Keys(cfg.Listeners)) {
+			l := cfg.Listeners[name]
+			if l.Type != config.TypeTProxy {
+				continue
+			}
+			names = append(names, name)
+			checks[name] = tproxy.CheckConfig{Listen: l.Listen, Redirect: l.Mode == config.ModeRedirect, UDP: l.UDP}
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("%s has no tproxy listeners", *configFile)
+		}
+	} else {
+		if *listen == "" {
+			return errors.New("set --tproxy-listen or --config")
+		}
+		if *mode != config.ModeTProxy && *mode != config.ModeRedirect {
+			return fmt.Errorf("invalid --tproxy-mode %q (expected %s or %s)", *mode, config.ModeTProxy, config.ModeRedirect)
+		}
+		if *udp && *mode == config.ModeRedirect {
+			return fmt.Errorf("--tproxy-udp isn't supported in %s mode", config.ModeRedirect)
+		}
+		names = []string{config.TypeTProxy}
+		checks[config.TypeTProxy] = tproxy.CheckConfig{Listen: *listen, Redirect: *mode == config.ModeRedirect, UDP: *udp}
+	}
+
+	failed := false
+	for i, name := range names {
+		c := checks[name]
+		c.Mark, c.OutboundMark = *mark, *outboundMark
+		mode := config.ModeTProxy
+		if c.Redirect {
+			mode = config.ModeRedirect
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("listener %s (%s, mode %s):\n", name, c.Listen, mode)
+		for _, f := range tproxy.Check(c) {
+			fmt.Printf("  %-4s  %s\n", f.Level, f.Message)
+			if f.Fix != "" {
+				fmt.Printf("        fix: %s\n", f.Fix)
+			}
+			failed = failed || f.Level == tproxy.LevelFail
+		}
+	}
+	if failed {
+		return errors.New("tproxy-check: found problems")
+	}
+	return nil
+}